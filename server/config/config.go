@@ -23,15 +23,25 @@ var fileMutex sync.Mutex
 var indexedFileMutex sync.Mutex
 
 type Config struct {
-	DataDir     string
-	GitDataDir  string
-	ConfDir     string
-	IndexedDir  string
-	Port        int
-	IndexerType string
-	Schedule    string
-	Debug       bool
-	settings    []SyncSetting
+	DataDir      string
+	GitDataDir   string
+	ConfDir      string
+	IndexedDir   string
+	Port         int
+	IndexerType  string
+	IndexShard   string
+	StoreContent bool
+	ESURL        string
+	Schedule     string
+	AdminToken   string
+	Debug        bool
+	Import       ImportSetting
+	settings     []SyncSetting
+
+	// The state of the indexed refs kept in memory. See GetIndexedState.
+	indexedLoaded     bool
+	indexedGeneration uint64
+	indexedUpdated    time.Time
 }
 
 func NewConfig(c *cli.Context, debug bool) *Config {
@@ -42,18 +52,38 @@ func NewConfig(c *cli.Context, debug bool) *Config {
 	indexedDir := dataDir + "/" + "indexed"
 
 	indexerType := c.GlobalString("indexer")
+	indexShard := c.GlobalString("shard")
+	if indexShard != "" && indexShard != "organization" && indexShard != "repository" {
+		log.Fatalf("Unknown shard mode: %s. Please specified \"organization\" or \"repository\"\n", indexShard)
+	}
+	storeContent := c.GlobalBool("store-content")
+	esURL := c.GlobalString("es-url")
 
 	schedule := c.String("schedule")
+	adminToken := c.String("admin-token")
+
+	importSetting := DefaultImportSetting().Merge(&ImportSetting{
+		SyncWorkers:  c.GlobalInt("sync-workers"),
+		ScanWorkers:  c.GlobalInt("scan-workers"),
+		QueueSize:    c.GlobalInt("queue-size"),
+		BatchSize:    c.GlobalInt64("batch-size"),
+		BatchLatency: c.GlobalInt64("batch-latency"),
+	})
 
 	config := &Config{
-		DataDir:     dataDir,
-		GitDataDir:  gitDataDir,
-		ConfDir:     confDir,
-		IndexedDir:  indexedDir,
-		Port:        port,
-		IndexerType: indexerType,
-		Schedule:    schedule,
-		Debug:       false,
+		DataDir:      dataDir,
+		GitDataDir:   gitDataDir,
+		ConfDir:      confDir,
+		IndexedDir:   indexedDir,
+		Port:         port,
+		IndexerType:  indexerType,
+		IndexShard:   indexShard,
+		StoreContent: storeContent,
+		ESURL:        esURL,
+		Schedule:     schedule,
+		AdminToken:   adminToken,
+		Debug:        false,
+		Import:       importSetting,
 	}
 
 	config.init()
@@ -157,6 +187,25 @@ func (c *Config) FindSetting(organization string) (SyncSetting, bool) {
 	return nil, false
 }
 
+func (c *Config) GetRanking(organization string) RankingSetting {
+	setting, ok := c.FindSetting(organization)
+	if ok {
+		return setting.GetRanking()
+	}
+	return DefaultRankingSetting()
+}
+
+// GetImport returns the import setting of the organization over the server setting.
+// The server setting is returned for the unknown organization.
+func (c *Config) GetImport(organization string) ImportSetting {
+	importSetting := DefaultImportSetting().Merge(&c.Import)
+	setting, ok := c.FindSetting(organization)
+	if ok {
+		return importSetting.Merge(setting.GetImport())
+	}
+	return importSetting
+}
+
 func (c *Config) GetSizeLimit(organization, project, repository string) int64 {
 	setting, ok := c.FindSetting(organization)
 	if ok {
@@ -187,6 +236,8 @@ type SyncSetting interface {
 	JSON() ([]byte, error)
 	GetRefFilters(project string, repository string) (*regexp.Regexp, *regexp.Regexp, *regexp.Regexp, *regexp.Regexp)
 	GetSizeLimit() int64
+	GetRanking() RankingSetting
+	GetImport() *ImportSetting
 }
 
 type OrganizationSetting struct {
@@ -198,6 +249,87 @@ type OrganizationSetting struct {
 	ExcludeBranches string            `json:"excludeBranches,omitempty"`
 	IncludeTags     string            `json:"includeTags,omitempty"`
 	ExcludeTags     string            `json:"excludeTags,omitempty"`
+	Ranking         *RankingSetting   `json:"ranking,omitempty"`
+	Import          *ImportSetting    `json:"import,omitempty"`
+}
+
+// RankingSetting has the boost weights to re-rank the search results.
+// The boosts are multiplied to the score, so 1 means no effect and less than 1 means demotion.
+// DefaultBranch overrides the default branch of the repositories, which is HEAD saved at the syncing.
+// DemotePaths are glob patterns like "vendor/" (directory), "*.min.js" (file) or "/test/" (from the root).
+type RankingSetting struct {
+	DefaultBranch      string   `json:"defaultBranch,omitempty"`
+	DefaultBranchBoost float64  `json:"defaultBranchBoost,omitempty"`
+	FilenameBoost      float64  `json:"filenameBoost,omitempty"`
+	PathBoost          float64  `json:"pathBoost,omitempty"`
+	DemotePaths        []string `json:"demotePaths,omitempty"`
+	DemoteBoost        float64  `json:"demoteBoost,omitempty"`
+}
+
+func DefaultRankingSetting() RankingSetting {
+	return RankingSetting{
+		DefaultBranchBoost: 1.0,
+		FilenameBoost:      1.0,
+		PathBoost:          1.0,
+		DemotePaths:        []string{},
+		DemoteBoost:        1.0,
+	}
+}
+
+// ImportSetting has the parallelism and the batch size of the importing.
+// SyncWorkers is the number of the repositories synced at the same time, and ScanWorkers is the number of the goroutines
+// reading the blobs of a repository. BatchSize is the initial size of an index batch in bytes. It's adjusted between
+// MinBatchSize and MaxBatchSize to keep the latency of a batch around BatchLatency (milliseconds).
+// Set the same value to the min and max to disable the adjustment.
+type ImportSetting struct {
+	SyncWorkers  int   `json:"syncWorkers,omitempty"`
+	ScanWorkers  int   `json:"scanWorkers,omitempty"`
+	QueueSize    int   `json:"queueSize,omitempty"`
+	BatchSize    int64 `json:"batchSize,omitempty"`
+	MinBatchSize int64 `json:"minBatchSize,omitempty"`
+	MaxBatchSize int64 `json:"maxBatchSize,omitempty"`
+	BatchLatency int64 `json:"batchLatency,omitempty"`
+}
+
+func DefaultImportSetting() ImportSetting {
+	return ImportSetting{
+		SyncWorkers:  2,
+		ScanWorkers:  3,
+		QueueSize:    100,
+		BatchSize:    1024 * 512,       // 512KB
+		MinBatchSize: 1024 * 64,        // 64KB
+		MaxBatchSize: 1024 * 1024 * 16, // 16MB
+		BatchLatency: 1000,
+	}
+}
+
+// Merge returns the setting overridden by the set fields of the other.
+func (i ImportSetting) Merge(other *ImportSetting) ImportSetting {
+	if other == nil {
+		return i
+	}
+	if other.SyncWorkers > 0 {
+		i.SyncWorkers = other.SyncWorkers
+	}
+	if other.ScanWorkers > 0 {
+		i.ScanWorkers = other.ScanWorkers
+	}
+	if other.QueueSize > 0 {
+		i.QueueSize = other.QueueSize
+	}
+	if other.BatchSize > 0 {
+		i.BatchSize = other.BatchSize
+	}
+	if other.MinBatchSize > 0 {
+		i.MinBatchSize = other.MinBatchSize
+	}
+	if other.MaxBatchSize > 0 {
+		i.MaxBatchSize = other.MaxBatchSize
+	}
+	if other.BatchLatency > 0 {
+		i.BatchLatency = other.BatchLatency
+	}
+	return i
 }
 
 func (o *OrganizationSetting) GetName() string {
@@ -278,6 +410,37 @@ func (o *OrganizationSetting) GetSizeLimit() int64 {
 	return o.SizeLimit
 }
 
+// GetRanking returns the ranking setting. The default values are used for the unset fields.
+func (o *OrganizationSetting) GetRanking() RankingSetting {
+	ranking := DefaultRankingSetting()
+	if o.Ranking == nil {
+		return ranking
+	}
+	if o.Ranking.DefaultBranch != "" {
+		ranking.DefaultBranch = o.Ranking.DefaultBranch
+	}
+	if o.Ranking.DefaultBranchBoost > 0 {
+		ranking.DefaultBranchBoost = o.Ranking.DefaultBranchBoost
+	}
+	if o.Ranking.FilenameBoost > 0 {
+		ranking.FilenameBoost = o.Ranking.FilenameBoost
+	}
+	if o.Ranking.PathBoost > 0 {
+		ranking.PathBoost = o.Ranking.PathBoost
+	}
+	if o.Ranking.DemotePaths != nil {
+		ranking.DemotePaths = o.Ranking.DemotePaths
+	}
+	if o.Ranking.DemoteBoost > 0 {
+		ranking.DemoteBoost = o.Ranking.DemoteBoost
+	}
+	return ranking
+}
+
+func (o *OrganizationSetting) GetImport() *ImportSetting {
+	return o.Import
+}
+
 func (o *OrganizationSetting) GetRefFilters(project string, repository string) (*regexp.Regexp, *regexp.Regexp, *regexp.Regexp, *regexp.Regexp) {
 
 	ps, has := o.FindProjectSetting(project)
@@ -389,6 +552,41 @@ func (c *Config) GetIndexed(organization string, project string, repository stri
 	return c.readIndexed(organization, project, repository)
 }
 
+// GetIndexedState returns the generation which is bumped by every update of the indexed refs, and the last updated time of them.
+// The indexed files are read at the first call only, so it's cheap to call for every request.
+func (c *Config) GetIndexedState() (uint64, time.Time) {
+	indexedFileMutex.Lock()
+	defer indexedFileMutex.Unlock()
+
+	if !c.indexedLoaded {
+		c.indexedLoaded = true
+		c.indexedUpdated = c.readLastUpdated()
+	}
+	return c.indexedGeneration, c.indexedUpdated
+}
+
+// readLastUpdated finds the latest update time in the indexed files.
+func (c *Config) readLastUpdated() time.Time {
+	var lastUpdated time.Time
+
+	files, _ := filepath.Glob(filepath.Join(c.IndexedDir, "*", "*", "*.json"))
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var indexed Indexed
+		if err := json.Unmarshal(content, &indexed); err != nil {
+			continue
+		}
+		updated, err := time.ParseInLocation(DATE_LAYOUT, indexed.LastUpdated, time.Local)
+		if err == nil && updated.After(lastUpdated) {
+			lastUpdated = updated
+		}
+	}
+	return lastUpdated
+}
+
 func (c *Config) readIndexed(organization string, project string, repository string) Indexed {
 	fileName := c.getIndexedFilePath(organization, project, repository)
 
@@ -508,12 +706,13 @@ func (c *Config) writeSetting(organization string) error {
 }
 
 type Indexed struct {
-	LastUpdated  string            `json:"lastUpdated"`
-	Organization string            `json:"organization"`
-	Project      string            `json:"project"`
-	Repository   string            `json:"repository"`
-	Branches     BrancheIndexedMap `json:"branches"`
-	Tags         TagIndexedMap     `json:"tags"`
+	LastUpdated   string            `json:"lastUpdated"`
+	Organization  string            `json:"organization"`
+	Project       string            `json:"project"`
+	Repository    string            `json:"repository"`
+	DefaultBranch string            `json:"defaultBranch,omitempty"`
+	Branches      BrancheIndexedMap `json:"branches"`
+	Tags          TagIndexedMap     `json:"tags"`
 }
 
 type BrancheIndexedMap map[string]string
@@ -536,7 +735,15 @@ func (c *Config) writeIndexed(indexed Indexed) error {
 		log.Println("Write indexd file.", fileName)
 	}
 
-	return ioutil.WriteFile(fileName, content, os.ModePerm)
+	if err := ioutil.WriteFile(fileName, content, os.ModePerm); err != nil {
+		return err
+	}
+
+	c.indexedGeneration++
+	if t.After(c.indexedUpdated) {
+		c.indexedUpdated = t
+	}
+	return nil
 }
 
 func (c *Config) getIndexedFilePath(organization string, project string, repository string) string {
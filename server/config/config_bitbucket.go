@@ -81,9 +81,11 @@ func NewBitbucketOrganizationSetting(o OrganizationSetting) SyncSetting {
 
 func (b *BitbucketOrganizationSetting) JSON() ([]byte, error) {
 	setting := &struct {
-		Name string            `json:"name"`
-		Scm  map[string]string `json:"scm,omitempty"`
-	}{Name: b.Name, Scm: b.Scm}
+		Name    string            `json:"name"`
+		Scm     map[string]string `json:"scm,omitempty"`
+		Ranking *RankingSetting   `json:"ranking,omitempty"`
+		Import  *ImportSetting    `json:"import,omitempty"`
+	}{Name: b.Name, Scm: b.Scm, Ranking: b.Ranking, Import: b.Import}
 
 	bytes, err := json.MarshalIndent(setting, "", "  ")
 	if err != nil {
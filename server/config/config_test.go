@@ -53,3 +53,67 @@ func TestLineScanner(t *testing.T) {
 		t.Errorf("repository name should be samplerepo, %v", s[0].GetProjects()[0].Repositories[0].GetName())
 	}
 }
+
+func TestGetImport(t *testing.T) {
+	os.MkdirAll("./tmp/conf", 0755)
+	c := Config{ConfDir: "./tmp/conf", Import: ImportSetting{SyncWorkers: 4, BatchSize: 1024}}
+
+	testConfig := []byte(`{
+	"name": "test",
+	"import": {
+		"syncWorkers": 1,
+		"queueSize": 10
+	}
+}`)
+	err := ioutil.WriteFile("./tmp/conf/test.json", testConfig, os.ModePerm)
+	if err != nil {
+		t.Errorf("test.json create error, %+v", err)
+	}
+
+	defer os.RemoveAll("./tmp")
+
+	c.reloadSettings()
+
+	server := c.GetImport("unknown")
+	if server.SyncWorkers != 4 || server.QueueSize != 100 || server.BatchSize != 1024 {
+		t.Errorf("got %+v, want the server setting over the default", server)
+	}
+
+	org := c.GetImport("test")
+	if org.SyncWorkers != 1 || org.QueueSize != 10 || org.BatchSize != 1024 || org.ScanWorkers != 3 {
+		t.Errorf("got %+v, want the organization setting over the server setting", org)
+	}
+}
+
+func TestGetIndexedState(t *testing.T) {
+	os.MkdirAll("./tmp/indexed", 0755)
+	defer os.RemoveAll("./tmp")
+
+	c := Config{IndexedDir: "./tmp/indexed"}
+
+	generation, updated := c.GetIndexedState()
+	if generation != 0 || !updated.IsZero() {
+		t.Errorf("got %v %v, want 0 and zero time", generation, updated)
+	}
+
+	err := c.UpdateIndexed(Indexed{Organization: "o", Project: "p", Repository: "r", Branches: BrancheIndexedMap{"master": "c1"}})
+	if err != nil {
+		t.Fatalf("Unexpected returned err %+v", err)
+	}
+	err = c.DeleteIndexed("o", "p", "r", []string{"master"}, []string{})
+	if err != nil {
+		t.Fatalf("Unexpected returned err %+v", err)
+	}
+
+	generation, updated = c.GetIndexedState()
+	if generation != 2 || updated.IsZero() {
+		t.Errorf("got %v %v, want 2 and the update time", generation, updated)
+	}
+
+	// The update time is read from the indexed files by a new process
+	restarted := Config{IndexedDir: "./tmp/indexed"}
+	generation, restartedUpdated := restarted.GetIndexedState()
+	if generation != 0 || restartedUpdated.Unix() != updated.Unix() {
+		t.Errorf("got %v %v, want 0 and %v", generation, restartedUpdated, updated)
+	}
+}
@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+func AggregateRefs(c *gin.Context) {
+	i := getIndexer(c)
+
+	c.Request.ParseForm()
+
+	q, ok := c.Request.Form["q"]
+	if !ok {
+		errorJson := make(map[string]string)
+		errorJson["error"] = "q is required"
+		c.JSON(400, errorJson)
+		return
+	}
+
+	result, err := i.AggregateRefs(q[0], c.Param("organization"), c.Param("project"), c.Param("repository"))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, result)
+}
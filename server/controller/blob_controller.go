@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wadahiro/gitss/server/util"
+)
+
+// The max size of the uploaded file to hash
+const BLOB_UPLOAD_SIZE_LIMIT = 100 * 1024 * 1024
+
+var BLOB_SHA_PATTERN = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// FindBlob lists the locations of the blob SHA in the path.
+func FindBlob(c *gin.Context) {
+	sha := strings.ToLower(c.Param("sha"))
+
+	if !BLOB_SHA_PATTERN.MatchString(sha) {
+		errorJson := make(map[string]string)
+		errorJson["error"] = "Invalid blob SHA: " + c.Param("sha")
+		c.JSON(400, errorJson)
+		return
+	}
+
+	findBlob(c, sha)
+}
+
+// FindUploadedBlob hashes the uploaded file git-style, then lists the locations of the blob.
+// The file is sent as the "file" field of the multipart form or as the request body.
+func FindUploadedBlob(c *gin.Context) {
+	var body io.Reader = c.Request.Body
+
+	if strings.HasPrefix(c.Request.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := c.Request.FormFile("file")
+		if err != nil {
+			errorJson := make(map[string]string)
+			errorJson["error"] = "file is required"
+			c.JSON(400, errorJson)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(body, BLOB_UPLOAD_SIZE_LIMIT+1))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+	if len(content) > BLOB_UPLOAD_SIZE_LIMIT {
+		errorJson := make(map[string]string)
+		errorJson["error"] = "The file is too large"
+		c.JSON(413, errorJson)
+		return
+	}
+
+	findBlob(c, util.GitBlobHash(content))
+}
+
+func findBlob(c *gin.Context, sha string) {
+	i := getIndexer(c)
+
+	result, err := i.FindBlob(sha)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, result)
+}
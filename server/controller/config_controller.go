@@ -6,14 +6,17 @@ import (
 	// "bytes"
 	// "fmt"
 	// "log"
+	"fmt"
 
 	"github.com/gin-gonic/gin"
 	"github.com/wadahiro/gitss/server/config"
+	"github.com/wadahiro/gitss/server/indexer"
 )
 
 type IndexdStatisticsResult struct {
-	Count   Count            `json:"count"`
-	Indexes []config.Indexed `json:"indexes"`
+	Count       Count                    `json:"count"`
+	Indexes     []config.Indexed         `json:"indexes"`
+	SearchCache indexer.SearchCacheStats `json:"searchCache"`
 }
 
 type Count struct {
@@ -29,6 +32,12 @@ func GetIndexStatistics(c *gin.Context) {
 	cfg := getConfig(c)
 	i := getIndexer(c)
 
+	// The statistics have the search cache counters which change by every search, so they are validated by the ETag only
+	cacheStats := i.SearchCacheStats()
+	if checkNotModified(c, fmt.Sprint(cacheStats.Hits), fmt.Sprint(cacheStats.Misses)) {
+		return
+	}
+
 	list := []config.Indexed{}
 	projectCount := 0
 	repositoryCount := 0
@@ -68,6 +77,7 @@ func GetIndexStatistics(c *gin.Context) {
 			Tag:          tagCount,
 			Document:     docCount,
 		},
-		Indexes: list,
+		Indexes:     list,
+		SearchCache: cacheStats,
 	})
 }
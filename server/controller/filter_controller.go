@@ -23,6 +23,10 @@ type FilterResult struct {
 func GetBaseFilters(c *gin.Context) {
 	cfg := getConfig(c)
 
+	if checkNotModified(c) {
+		return
+	}
+
 	organization := c.Param("organization")
 	project := c.Param("project")
 	repository := c.Param("repository")
@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wadahiro/gitss/server/repo"
+	"github.com/wadahiro/gitss/server/service"
+)
+
+// GetPathHistory returns the versions of the path across the branches and tags.
+// The diff between two versions is added if "from" and "to" blobs are given.
+func GetPathHistory(c *gin.Context) {
+	i := getIndexer(c)
+
+	c.Request.ParseForm()
+
+	path := strings.TrimPrefix(c.Param("path"), "/")
+	if path == "" {
+		errorJson := make(map[string]string)
+		errorJson["error"] = "path is required"
+		c.JSON(400, errorJson)
+		return
+	}
+
+	history, err := i.GetPathHistory(c.Param("organization"), c.Param("project"), c.Param("repository"), path)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	from := strings.ToLower(c.Request.Form.Get("from"))
+	to := strings.ToLower(c.Request.Form.Get("to"))
+
+	if from != "" || to != "" {
+		_, fromOk := history.FindVersion(from)
+		_, toOk := history.FindVersion(to)
+		if !fromOk || !toOk {
+			errorJson := make(map[string]string)
+			errorJson["error"] = "from and to must be the blobs of the versions"
+			c.JSON(400, errorJson)
+			return
+		}
+
+		history.Diff, err = service.DiffPathVersions(repo.NewGitRepoReader(getConfig(c)), history, from, to)
+		if err != nil {
+			c.AbortWithError(500, err)
+			return
+		}
+	}
+
+	c.JSON(200, history)
+}
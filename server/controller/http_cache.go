@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/wadahiro/gitss/server/util"
+)
+
+const ENCODING_BROTLI = "br"
+const ENCODING_GZIP = "gzip"
+
+// The server start time makes the ETags unique over the restarts, since the index generation starts from 0.
+var bootTime = time.Now()
+
+// checkNotModified sets the ETag and Last-Modified headers derived from the index generation, the generation and
+// the last updated time of the indexed refs, and the settings. It responds 304 and returns true if the client has the same state.
+// The extra values are added to the ETag for the responses which depend on the other state.
+// Last-Modified isn't sent for them, since the time can't tell the changes of the extra values.
+func checkNotModified(c *gin.Context, extra ...string) bool {
+	cfg := getConfig(c)
+	i := getIndexer(c)
+
+	stats := i.SearchCacheStats()
+	indexedGeneration, indexedUpdated := cfg.GetIndexedState()
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%d\x00%d\x00%d\x00", bootTime.UnixNano(), stats.Generation, indexedGeneration)
+
+	var lastModified time.Time
+	if stats.Updated != nil {
+		lastModified = *stats.Updated
+	}
+	if indexedUpdated.After(lastModified) {
+		lastModified = indexedUpdated
+	}
+
+	for _, setting := range cfg.GetSettings() {
+		b, _ := setting.JSON()
+		h.Write(b)
+	}
+	for _, v := range extra {
+		fmt.Fprintf(h, "\x00%s", v)
+	}
+	if len(extra) > 0 {
+		lastModified = time.Time{}
+	}
+
+	etag := `W/"` + hex.EncodeToString(h.Sum(nil)) + `"`
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	// If-Modified-Since is ignored when If-None-Match is sent
+	ifNoneMatch := c.Request.Header.Get("If-None-Match")
+	if ifNoneMatch != "" {
+		if util.MatchETag(ifNoneMatch, etag) {
+			c.AbortWithStatus(304)
+			return true
+		}
+		return false
+	}
+	if util.NotModifiedSince(c.Request.Header.Get("If-Modified-Since"), lastModified) {
+		c.AbortWithStatus(304)
+		return true
+	}
+	return false
+}
+
+// Compress compresses the responses with brotli or gzip by the Accept-Encoding header.
+// The text responses only are compressed, and the partial and empty responses aren't.
+func Compress() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		encoding := util.NegotiateEncoding(c.Request.Header.Get("Accept-Encoding"), ENCODING_BROTLI, ENCODING_GZIP)
+
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if encoding == "" {
+			c.Next()
+			return
+		}
+
+		w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding}
+		c.Writer = w
+		defer w.Close()
+
+		c.Next()
+	}
+}
+
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding   string
+	decided    bool
+	compressor io.WriteCloser
+}
+
+// decide checks the response can be compressed when the body is written first.
+func (w *compressWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" || w.Status() == http.StatusPartialContent || !isCompressible(header.Get("Content-Type")) {
+		return
+	}
+
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+
+	switch w.encoding {
+	case ENCODING_BROTLI:
+		w.compressor = brotli.NewWriterLevel(w.ResponseWriter, brotli.DefaultCompression)
+	case ENCODING_GZIP:
+		w.compressor, _ = gzip.NewWriterLevel(w.ResponseWriter, gzip.DefaultCompression)
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	w.decide()
+	if w.compressor == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.compressor.Write(data)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) Flush() {
+	if f, ok := w.compressor.(interface {
+		Flush() error
+	}); ok {
+		f.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) Close() error {
+	if w.compressor == nil {
+		return nil
+	}
+	return w.compressor.Close()
+}
+
+func isCompressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range []string{"application/json", "application/javascript", "text/", "image/svg+xml"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
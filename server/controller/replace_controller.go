@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wadahiro/gitss/server/repo"
+	"github.com/wadahiro/gitss/server/service"
+)
+
+// MakeReplacePatches makes the patches in the repositories of the organizations.
+// The scope is required and the work is limited by the time, the number and the bytes of the patches.
+func MakeReplacePatches(c *gin.Context) {
+	cfg := getConfig(c)
+
+	c.Request.ParseForm()
+
+	search := c.Request.Form.Get("search")
+	if search == "" {
+		errorJson := make(map[string]string)
+		errorJson["error"] = "search is required"
+		c.JSON(400, errorJson)
+		return
+	}
+	if len(search) > service.REPLACE_MAX_SEARCH_LENGTH {
+		errorJson := make(map[string]string)
+		errorJson["error"] = "search is too long"
+		c.JSON(400, errorJson)
+		return
+	}
+
+	filterParams := getFilterParams(c)
+	if len(filterParams.Organizations) == 0 || len(filterParams.Repositories) == 0 {
+		errorJson := make(map[string]string)
+		errorJson["error"] = "organization (o) and repository (r) are required"
+		c.JSON(400, errorJson)
+		return
+	}
+
+	request := service.ReplaceRequest{
+		Search:       search,
+		Replace:      c.Request.Form.Get("replace"),
+		Regex:        c.Request.Form.Get("regex") == "true",
+		FilterParams: filterParams,
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), service.REPLACE_TIMEOUT)
+	defer cancel()
+
+	result, err := service.RunReplace(ctx, cfg, repo.NewGitRepoReader(cfg), request, service.ReplaceLimits{MaxPatches: service.REPLACE_MAX_PATCHES, MaxBytes: service.REPLACE_MAX_BYTES})
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, result)
+}
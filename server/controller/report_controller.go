@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wadahiro/gitss/server/indexer"
+)
+
+func ReportDuplicates(c *gin.Context) {
+	i := getIndexer(c)
+
+	c.Request.ParseForm()
+
+	size := indexer.DEFAULT_REPORT_SIZE
+	if s, err := strconv.Atoi(c.Request.Form.Get("size")); err == nil {
+		size = s
+	}
+
+	report, err := i.ReportDuplicates(size)
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, report)
+}
@@ -9,9 +9,15 @@ import (
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
 	"github.com/wadahiro/gitss/server/indexer"
+	"github.com/wadahiro/gitss/server/repo"
+	"github.com/wadahiro/gitss/server/service"
 )
 
+// LIVE_GREP runs "git grep" on the unindexed refs and files in addition to the index search
+const LIVE_GREP = "live"
+
 func SearchIndex(c *gin.Context) {
 	i := getIndexer(c)
 
@@ -20,35 +26,156 @@ func SearchIndex(c *gin.Context) {
 	q, ok := c.Request.Form["q"]
 	// fmt.Println(q, ok)
 	if ok {
-		exts, _ := c.Request.Form["x"]
-		organizations, _ := c.Request.Form["o"]
-		projects, _ := c.Request.Form["p"]
-		repositories, _ := c.Request.Form["r"]
-		branches, _ := c.Request.Form["b"]
-		tags, _ := c.Request.Form["t"]
-
-		reqPage, ok := c.Request.Form["i"]
-		page := 0
-		if ok {
-			p, err := strconv.Atoi(reqPage[0])
+		page := getPage(c)
+
+		options := indexer.SearchOptions{
+			AutoCorrect: c.Request.Form.Get("autocorrect") == "true",
+		}
+
+		sortBy := c.Request.Form.Get("sort")
+		if sortBy != "" && sortBy != indexer.SORT_OCCURRENCES {
+			errorJson := make(map[string]string)
+			errorJson["error"] = "Unsupported sort: " + sortBy
+			c.JSON(400, errorJson)
+			return
+		}
+		options.Sort = sortBy
+		options.CountOccurrences = c.Request.Form.Get("occurrences") == "true"
+
+		group := c.Request.Form.Get("group")
+		if group != "" {
+			if group != indexer.GROUP_REPOSITORY {
+				errorJson := make(map[string]string)
+				errorJson["error"] = "Unsupported group: " + group
+				c.JSON(400, errorJson)
+				return
+			}
+			options.Group = group
+
+			groupSize, err := strconv.Atoi(c.Request.Form.Get("groupSize"))
 			if err == nil {
-				page = p
+				options.GroupSize = groupSize
 			}
 		}
 
-		result, err := i.SearchQuery(q[0], indexer.FilterParams{Exts: exts, Organizations: organizations, Projects: projects, Repositories: repositories, Branches: branches, Tags: tags}, page)
+		grep := c.Request.Form.Get("grep")
+		if grep != "" && grep != LIVE_GREP {
+			errorJson := make(map[string]string)
+			errorJson["error"] = "Unsupported grep: " + grep
+			c.JSON(400, errorJson)
+			return
+		}
+		// The groups are paged instead of the hits, so the live grep hits can't be merged
+		if grep == LIVE_GREP && options.Group != "" {
+			errorJson := make(map[string]string)
+			errorJson["error"] = "grep=live can't be used with group"
+			c.JSON(400, errorJson)
+			return
+		}
+
+		// The live grep hits depend on the git repositories, not only the index
+		if grep != LIVE_GREP && checkNotModified(c) {
+			return
+		}
+
+		filterParams := getFilterParams(c)
+
+		result, err := i.SearchQuery(q[0], filterParams, page, options)
 
+		if errors.Cause(err) == indexer.ErrInvalidQuery {
+			errorJson := make(map[string]string)
+			errorJson["error"] = err.Error()
+			c.JSON(400, errorJson)
+			return
+		}
 		if err != nil {
 			c.AbortWithError(500, err)
 			return
 		}
 
+		// The live grep hits follow the indexed hits, so they are paged and counted in the size together
+		if grep == LIVE_GREP {
+			cfg := getConfig(c)
+			hits, status := service.RunLiveGrep(cfg, repo.NewGitRepoReader(cfg), q[0], filterParams)
+			result.Hits = appendLiveGrepHits(result, hits, page)
+			result.Size = result.Size + int64(len(hits))
+			result.LiveGrep = &status
+		}
+
 		c.JSON(200, result)
 	} else {
 		c.JSON(200, indexer.SearchResult{})
 	}
 }
 
+// appendLiveGrepHits returns the hits of the page filled with the live grep hits after the indexed hits.
+// The result can be cached by the indexer, so its hits aren't changed.
+func appendLiveGrepHits(result indexer.SearchResult, hits []indexer.Hit, page int) []indexer.Hit {
+	// the offset of the live grep hits in the page
+	start := int64(page*result.Limit) - result.Size
+	if start < 0 {
+		start = 0
+	}
+	end := int64((page+1)*result.Limit) - result.Size
+	if end > int64(len(hits)) {
+		end = int64(len(hits))
+	}
+
+	list := append([]indexer.Hit{}, result.Hits...)
+	if start < end {
+		list = append(list, hits[start:end]...)
+	}
+	return list
+}
+
+func ExplainSearch(c *gin.Context) {
+	i := getIndexer(c)
+
+	c.Request.ParseForm()
+
+	q, ok := c.Request.Form["q"]
+	if !ok {
+		errorJson := make(map[string]string)
+		errorJson["error"] = "q is required"
+		c.JSON(400, errorJson)
+		return
+	}
+
+	result, err := i.Explain(q[0], getFilterParams(c), getPage(c))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, result)
+}
+
+func getPage(c *gin.Context) int {
+	reqPage, ok := c.Request.Form["i"]
+	page := 0
+	if ok {
+		p, err := strconv.Atoi(reqPage[0])
+		if err == nil {
+			page = p
+		}
+	}
+	return page
+}
+
+// getFilterParams reads the filter params from the parsed form.
+func getFilterParams(c *gin.Context) indexer.FilterParams {
+	exts, _ := c.Request.Form["x"]
+	organizations, _ := c.Request.Form["o"]
+	projects, _ := c.Request.Form["p"]
+	repositories, _ := c.Request.Form["r"]
+	branches, _ := c.Request.Form["b"]
+	tags, _ := c.Request.Form["t"]
+	encodings, _ := c.Request.Form["e"]
+	sizes, _ := c.Request.Form["s"]
+
+	return indexer.FilterParams{Exts: exts, Organizations: organizations, Projects: projects, Repositories: repositories, Branches: branches, Tags: tags, Encodings: encodings, Sizes: sizes}
+}
+
 func getIndexer(c *gin.Context) indexer.Indexer {
 	r, _ := c.Get("indexer")
 	indexer := r.(indexer.Indexer)
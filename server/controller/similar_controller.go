@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+func SearchSimilar(c *gin.Context) {
+	i := getIndexer(c)
+
+	c.Request.ParseForm()
+
+	doc := c.Request.Form.Get("doc")
+	if doc == "" {
+		errorJson := make(map[string]string)
+		errorJson["error"] = "doc is required"
+		c.JSON(400, errorJson)
+		return
+	}
+
+	result, err := i.SearchSimilar(doc, getFilterParams(c), getPage(c))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, result)
+}
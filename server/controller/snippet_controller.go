@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The max size of the snippet in the request body
+const SNIPPET_SIZE_LIMIT = 1024 * 1024
+
+func SearchSnippet(c *gin.Context) {
+	i := getIndexer(c)
+
+	// Read the body before parsing the form, the filters are in the query string
+	snippet, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, SNIPPET_SIZE_LIMIT))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.Request.ParseForm()
+
+	if len(snippet) == 0 {
+		errorJson := make(map[string]string)
+		errorJson["error"] = "snippet is required in the request body"
+		c.JSON(400, errorJson)
+		return
+	}
+
+	result, err := i.SearchSnippet(string(snippet), getFilterParams(c))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, result)
+}
@@ -0,0 +1,21 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+func SuggestTerms(c *gin.Context) {
+	i := getIndexer(c)
+
+	c.Request.ParseForm()
+
+	prefix := c.Request.Form.Get("prefix")
+
+	result, err := i.SuggestTerms(prefix, getFilterParams(c))
+	if err != nil {
+		c.AbortWithError(500, err)
+		return
+	}
+
+	c.JSON(200, result)
+}
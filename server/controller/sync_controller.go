@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"crypto/subtle"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wadahiro/gitss/server/importer"
+	"github.com/wadahiro/gitss/server/service"
+)
+
+// SyncRepositories syncs the repository, or all repositories without the path parameters, in background.
+// The index is opened by the server, so the sync command can't be used while the server is running.
+// It returns 202 without waiting for the sync, or 409 while another sync is running. The result is written to the server log.
+func SyncRepositories(c *gin.Context) {
+	cfg := getConfig(c)
+	importer := getImporter(c)
+
+	organization := c.Param("organization")
+	project := c.Param("project")
+	repository := c.Param("repository")
+
+	var err error
+	if organization == "" {
+		err = service.StartSyncAll(cfg, importer)
+	} else {
+		err = service.StartSync(cfg, importer, organization, project, repository)
+	}
+	if err == service.ErrBusy {
+		errorJson := make(map[string]string)
+		errorJson["error"] = err.Error()
+		c.JSON(409, errorJson)
+		return
+	}
+
+	c.JSON(202, map[string]string{
+		"organization": organization,
+		"project":      project,
+		"repository":   repository,
+	})
+}
+
+// RequireAdminToken allows the requests with the "Authorization: Bearer <token>" header only.
+func RequireAdminToken(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.Request.Header.Get("Authorization")), expected) != 1 {
+			errorJson := make(map[string]string)
+			errorJson["error"] = "Unauthorized"
+			c.JSON(401, errorJson)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func getImporter(c *gin.Context) *importer.GitImporter {
+	r, _ := c.Get("importer")
+	importer := r.(*importer.GitImporter)
+
+	return importer
+}
@@ -0,0 +1,73 @@
+package importer
+
+import (
+	"time"
+
+	"github.com/wadahiro/gitss/server/config"
+)
+
+// batchSizer adjusts the size of the index batch by the measured latency.
+// The size grows when the batches finish faster than the target, and shrinks when they are slower.
+type batchSizer struct {
+	size   int64
+	min    int64
+	max    int64
+	target time.Duration
+}
+
+func newBatchSizer(setting config.ImportSetting) *batchSizer {
+	b := &batchSizer{
+		size:   setting.BatchSize,
+		min:    setting.MinBatchSize,
+		max:    setting.MaxBatchSize,
+		target: time.Duration(setting.BatchLatency) * time.Millisecond,
+	}
+	if b.min < 1 {
+		b.min = 1
+	}
+	if b.max < b.min {
+		b.max = b.min
+	}
+	b.size = b.clamp(b.size)
+	return b
+}
+
+func (b *batchSizer) Size() int64 {
+	return b.size
+}
+
+// Observe records the latency of a batch of the bytes, and returns true if the size is changed.
+// The change is limited to half or double per batch not to overreact to a slow batch.
+func (b *batchSizer) Observe(bytes int64, latency time.Duration) bool {
+	if b.target <= 0 || b.min == b.max || bytes <= 0 {
+		return false
+	}
+	if latency <= 0 {
+		latency = time.Millisecond
+	}
+
+	ideal := int64(float64(bytes) * float64(b.target) / float64(latency))
+	if ideal < b.size/2 {
+		ideal = b.size / 2
+	}
+	if ideal > b.size*2 {
+		ideal = b.size * 2
+	}
+
+	size := b.clamp(ideal)
+	if size == b.size {
+		return false
+	}
+	b.size = size
+	return true
+}
+
+func (b *batchSizer) clamp(size int64) int64 {
+	if size < b.min {
+		return b.min
+	}
+	if size > b.max {
+		return b.max
+	}
+	return size
+}
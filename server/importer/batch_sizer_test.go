@@ -0,0 +1,60 @@
+package importer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wadahiro/gitss/server/config"
+)
+
+func TestBatchSizer(t *testing.T) {
+	setting := config.ImportSetting{BatchSize: 1000, MinBatchSize: 100, MaxBatchSize: 3000, BatchLatency: 1000}
+
+	b := newBatchSizer(setting)
+	if b.Size() != 1000 {
+		t.Errorf("got %v, want %v", b.Size(), 1000)
+	}
+
+	// On target
+	if b.Observe(1000, time.Second) {
+		t.Errorf("got changed, want unchanged")
+	}
+
+	// Faster than target, but the growth is limited to double
+	b.Observe(1000, 100*time.Millisecond)
+	if b.Size() != 2000 {
+		t.Errorf("got %v, want %v", b.Size(), 2000)
+	}
+
+	// Limited by the max
+	b.Observe(2000, 100*time.Millisecond)
+	if b.Size() != 3000 {
+		t.Errorf("got %v, want %v", b.Size(), 3000)
+	}
+
+	// Slower than target
+	b.Observe(3000, 2*time.Second)
+	if b.Size() != 1500 {
+		t.Errorf("got %v, want %v", b.Size(), 1500)
+	}
+
+	// Limited by the min
+	for i := 0; i < 10; i++ {
+		b.Observe(b.Size(), 10*time.Second)
+	}
+	if b.Size() != 100 {
+		t.Errorf("got %v, want %v", b.Size(), 100)
+	}
+}
+
+func TestBatchSizerDisabled(t *testing.T) {
+	setting := config.ImportSetting{BatchSize: 1000, MinBatchSize: 1000, MaxBatchSize: 1000, BatchLatency: 1000}
+
+	b := newBatchSizer(setting)
+	if b.Observe(1000, 10*time.Second) {
+		t.Errorf("got changed, want unchanged")
+	}
+	if b.Size() != 1000 {
+		t.Errorf("got %v, want %v", b.Size(), 1000)
+	}
+}
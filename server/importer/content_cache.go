@@ -0,0 +1,50 @@
+package importer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// contentCache keeps the decoded text of the blobs read in an import on disk.
+// The refs of the blobs enumerated again by the later chunks of repo.StreamFileEntries are merged with it,
+// so the indexer which needs the content to update the document doesn't read the blobs from git again.
+type contentCache struct {
+	dir string
+}
+
+func newContentCache(parentDir string) (*contentCache, error) {
+	if parentDir != "" {
+		if err := os.MkdirAll(parentDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := ioutil.TempDir(parentDir, "gitss-content")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to make the content cache directory")
+	}
+	return &contentCache{dir: dir}, nil
+}
+
+// Put writes the text of the blob. The blob is written once per chunk by a scan worker.
+func (c *contentCache) Put(blob string, text string) error {
+	if err := ioutil.WriteFile(filepath.Join(c.dir, blob), []byte(text), 0644); err != nil {
+		return errors.Wrapf(err, "Failed to write the content cache of %s", blob)
+	}
+	return nil
+}
+
+// Get returns the text of the blob. It returns false if the blob wasn't read as text.
+func (c *contentCache) Get(blob string) (string, bool) {
+	text, err := ioutil.ReadFile(filepath.Join(c.dir, blob))
+	if err != nil {
+		return "", false
+	}
+	return string(text), true
+}
+
+func (c *contentCache) Close() error {
+	return os.RemoveAll(c.dir)
+}
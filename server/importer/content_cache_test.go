@@ -0,0 +1,37 @@
+package importer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestContentCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitss-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newContentCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Put("blob1", "package main\n"); err != nil {
+		t.Fatal(err)
+	}
+	if text, ok := c.Get("blob1"); !ok || text != "package main\n" {
+		t.Errorf("got %q %v, want %q", text, ok, "package main\n")
+	}
+	if _, ok := c.Get("blob2"); ok {
+		t.Errorf("got the content of blob2, want not found")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("blob1"); ok {
+		t.Errorf("got the content after Close, want removed")
+	}
+}
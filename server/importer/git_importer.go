@@ -10,6 +10,7 @@ import (
 	// "io/ioutil"
 	// "os"
 	"sync"
+	"sync/atomic"
 
 	"time"
 
@@ -56,6 +57,12 @@ func (g *GitImporter) Run(organization string, project string, url string) {
 		return
 	}
 
+	// the default branch for the ranking
+	defaultBranch, err := repo.GetDefaultBranch()
+	if err != nil {
+		log.Printf("Failed to get the default branch. %+v\n", err)
+	}
+
 	// branches in the config file
 	indexed := g.config.GetIndexed(organization, project, repo.Repository)
 
@@ -64,13 +71,18 @@ func (g *GitImporter) Run(organization string, project string, url string) {
 	// get sizeLimit for this repository
 	sizeLimit := g.config.GetSizeLimit(organization, project, repo.Repository)
 
+	// get parallelism and batch size for this organization
+	importSetting := g.config.GetImport(organization)
+
 	// progress bar
 	bar := pb.StartNew(0)
 	bar.ShowPercent = true
 
 	start := time.Now()
 
-	err = g.runIndexing(bar, repo, url, indexed, branchMap, tagMap, sizeLimit)
+	stats := &ImportStats{}
+
+	err = g.runIndexing(bar, repo, url, indexed, defaultBranch, branchMap, tagMap, sizeLimit, importSetting, stats)
 	if err != nil {
 		log.Printf("Failed to index. %+v", err)
 		return
@@ -112,7 +124,11 @@ func (g *GitImporter) Run(organization string, project string, url string) {
 
 	if len(removeBranches) > 0 || len(removeTags) > 0 {
 		log.Printf("Start index deleting for %s:%s/%s (%v) (%v)\n", organization, project, repo.Repository, removeBranches, removeTags)
-		g.indexer.DeleteIndexByRefs(organization, project, repo.Repository, removeBranches, removeTags)
+		err := g.indexer.DeleteIndexByRefs(organization, project, repo.Repository, removeBranches, removeTags)
+		if err != nil {
+			log.Printf("Failed to delete index. %+v", err)
+			return
+		}
 
 		bar.Add(len(removeBranches) + len(removeTags))
 
@@ -123,10 +139,10 @@ func (g *GitImporter) Run(organization string, project string, url string) {
 	end := time.Now()
 	time := (end.Sub(start)).Seconds()
 
-	bar.FinishPrint(fmt.Sprintf("Indexing Complete! [%f seconds] for %s:%s/%s\n", time, organization, project, repo.Repository))
+	bar.FinishPrint(fmt.Sprintf("Indexing Complete! [%f seconds] for %s:%s/%s, %s\n", time, organization, project, repo.Repository, stats))
 }
 
-func (g *GitImporter) runIndexing(bar *pb.ProgressBar, repo *repo.GitRepo, url string, indexed config.Indexed, branchMap config.BrancheIndexedMap, tagMap config.TagIndexedMap, sizeLimit int64) error {
+func (g *GitImporter) runIndexing(bar *pb.ProgressBar, repo *repo.GitRepo, url string, indexed config.Indexed, defaultBranch string, branchMap config.BrancheIndexedMap, tagMap config.TagIndexedMap, sizeLimit int64, importSetting config.ImportSetting, stats *ImportStats) error {
 	// collect create file entries
 	createBranches := make(map[string]string)
 	updateBranches := make(map[string][2]string)
@@ -168,25 +184,32 @@ func (g *GitImporter) runIndexing(bar *pb.ProgressBar, repo *repo.GitRepo, url s
 		}
 	}
 
-	queue := make(chan indexer.FileIndexOperation, 100)
+	queue := make(chan indexer.FileIndexOperation, importSetting.QueueSize)
 
 	// process
-	g.UpsertIndex(queue, bar, repo, createBranches, createTags, updateBranches, updateTags, sizeLimit)
+	done := g.UpsertIndex(queue, bar, repo, createBranches, createTags, updateBranches, updateTags, sizeLimit, importSetting.ScanWorkers, stats)
 
-	callBatch := func(operations []indexer.FileIndexOperation) {
-		err := g.indexer.BatchFileIndex(operations)
+	// The queue is read to the end after an error, so the enumeration isn't blocked
+	var batchErr error
+	callBatch := func(operations []indexer.FileIndexOperation) time.Duration {
+		start := time.Now()
+		err := g.indexer.BatchFileIndex(mergeOperations(operations))
 		if err != nil {
-			errors.Errorf("Batch indexed error: %+v", err)
+			log.Printf("Batch indexed error: %+v", err)
+			if batchErr == nil {
+				batchErr = err
+			}
 		} else {
 			// fmt.Printf("Batch indexed %d files.\n", len(operations))
 		}
 		bar.Add(len(operations))
+		return time.Now().Sub(start)
 	}
 
 	// batch
 	operations := []indexer.FileIndexOperation{}
 	var opsSize int64 = 0
-	var batchLimitSize int64 = 1024 * 512 // 512KB
+	sizer := newBatchSizer(importSetting)
 
 	// fmt.Println("start queue reading")
 
@@ -200,10 +223,15 @@ func (g *GitImporter) runIndexing(bar *pb.ProgressBar, repo *repo.GitRepo, url s
 		// }
 		// fmt.Printf(".")
 
-		if opsSize >= batchLimitSize {
+		if opsSize >= sizer.Size() {
 			// fmt.Printf("\n")
 
-			callBatch(operations)
+			latency := callBatch(operations)
+
+			// only the full batches are measured since the latency of a small batch is dominated by the overhead
+			if sizer.Observe(opsSize, latency) && g.debug {
+				log.Printf("Changed batch size to %d bytes for %s:%s/%s. latency: %v", sizer.Size(), repo.Organization, repo.Project, repo.Repository, latency)
+			}
 
 			// reset
 			operations = nil
@@ -217,8 +245,16 @@ func (g *GitImporter) runIndexing(bar *pb.ProgressBar, repo *repo.GitRepo, url s
 		callBatch(operations)
 	}
 
+	// Don't save the refs as indexed if the enumeration or the indexing failed
+	if err := <-done; err != nil {
+		return err
+	}
+	if batchErr != nil {
+		return errors.Wrapf(batchErr, "Failed to batch index.")
+	}
+
 	// Save config after index completed
-	err := g.config.UpdateIndexed(config.Indexed{Organization: repo.Organization, Project: repo.Project, Repository: repo.Repository, Branches: branchMap, Tags: tagMap})
+	err := g.config.UpdateIndexed(config.Indexed{Organization: repo.Organization, Project: repo.Project, Repository: repo.Repository, DefaultBranch: defaultBranch, Branches: branchMap, Tags: tagMap})
 
 	if err != nil {
 		return errors.Wrapf(err, "Faild to update indexed.")
@@ -227,60 +263,151 @@ func (g *GitImporter) runIndexing(bar *pb.ProgressBar, repo *repo.GitRepo, url s
 	return nil
 }
 
-func (g *GitImporter) UpsertIndex(queue chan indexer.FileIndexOperation, bar *pb.ProgressBar, r *repo.GitRepo, branchMap map[string]string, tagMap map[string]string, updateBranchMap map[string][2]string, updateTagMap map[string][2]string, sizeLimit int64) error {
-	addFiles, err := r.GetFileEntriesMap(branchMap, tagMap)
-	if err != nil {
-		return errors.Wrapf(err, "Failed to get file entries. branches: %v tags: %v", branchMap, tagMap)
-	}
+// UpsertIndex sends the index operations of the refs to the queue, and closes it when all operations are sent.
+// The files of the new refs are enumerated incrementally, so the indexing starts before the enumeration finishes.
+// The returned channel receives the result after the queue is closed.
+func (g *GitImporter) UpsertIndex(queue chan indexer.FileIndexOperation, bar *pb.ProgressBar, r *repo.GitRepo, branchMap map[string]string, tagMap map[string]string, updateBranchMap map[string][2]string, updateTagMap map[string][2]string, sizeLimit int64, scanWorkers int, stats *ImportStats) <-chan error {
+	done := make(chan error, 1)
 
-	updateAddFiles, delFiles, err := r.GetDiffFileEntriesMap(updateBranchMap, updateTagMap)
-	if err != nil {
-		return errors.Wrapf(err, "Failed to get diff. branches: %v tags: %v", branchMap, tagMap)
-	}
+	go func() {
+		defer close(queue)
 
-	var wg sync.WaitGroup
+		// The blobs can be enumerated again by the later chunks only if there are more refs than a chunk
+		var contents *contentCache
+		if len(branchMap)+len(tagMap) > repo.REF_CHUNK_SIZE {
+			var err error
+			contents, err = newContentCache(g.config.DataDir)
+			if err != nil {
+				done <- err
+				return
+			}
+			defer contents.Close()
+		}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		g.handleAddFiles(queue, bar, r, addFiles, sizeLimit)
-		g.handleAddFiles(queue, bar, r, updateAddFiles, sizeLimit)
+		err := g.handleAddFiles(queue, bar, r, sizeLimit, scanWorkers, stats, contents, func(add func(blob string, file repo.GitFile), flush func()) error {
+			return r.StreamFileEntries(branchMap, tagMap, add, flush)
+		})
+		if err != nil {
+			done <- errors.Wrapf(err, "Failed to get file entries. branches: %v tags: %v", branchMap, tagMap)
+			return
+		}
+
+		updateAddFiles, delFiles, err := r.GetDiffFileEntriesMap(updateBranchMap, updateTagMap)
+		if err != nil {
+			done <- errors.Wrapf(err, "Failed to get diff. branches: %v tags: %v", updateBranchMap, updateTagMap)
+			return
+		}
+
+		err = g.handleAddFiles(queue, bar, r, sizeLimit, scanWorkers, stats, nil, func(add func(blob string, file repo.GitFile), flush func()) error {
+			for blob, file := range updateAddFiles {
+				add(blob, file)
+			}
+			return nil
+		})
+		if err != nil {
+			done <- errors.Wrapf(err, "Failed to index the diff. branches: %v tags: %v", updateBranchMap, updateTagMap)
+			return
+		}
 		g.handleDelFiles(queue, bar, r, delFiles)
-	}()
 
-	go func() {
-		wg.Wait()
-		close(queue)
+		done <- nil
 	}()
 
-	return nil
+	return done
 }
 
-func (g *GitImporter) handleAddFiles(queue chan indexer.FileIndexOperation, bar *pb.ProgressBar, r *repo.GitRepo, addFiles map[string]repo.GitFile, sizeLimit int64) {
-	if len(addFiles) == 0 {
-		return
-	}
-
+// handleAddFiles scans the files from the enumerate function with the scanWorkers goroutines.
+// The flush function waits until the files added before are sent to the queue,
+// so the refs-only merges of the seen files are sent after the files they are merged into.
+// It returns the error of the enumeration, or the first error of the scan after all files are scanned.
+// The text of the blobs is kept in the contents if it isn't nil.
+func (g *GitImporter) handleAddFiles(queue chan indexer.FileIndexOperation, bar *pb.ProgressBar, r *repo.GitRepo, sizeLimit int64, scanWorkers int, stats *ImportStats, contents *contentCache, enumerate func(add func(blob string, file repo.GitFile), flush func()) error) error {
 	var wg sync.WaitGroup
+	var pending sync.WaitGroup
 	scanQueue := make(chan ScannedFile, 5)
 
-	for i := 0; i < 3; i++ {
+	var scanErr error
+	var scanErrOnce sync.Once
+	onError := func(err error) {
+		scanErrOnce.Do(func() { scanErr = err })
+	}
+
+	for i := 0; i < scanWorkers; i++ {
 		wg.Add(1)
-		go scanFiles(&wg, scanQueue, queue, g, r, bar)
+		go scanFiles(&wg, &pending, scanQueue, queue, g, r, bar, stats, contents, onError)
 	}
 
-	for blob, file := range addFiles {
+	err := enumerate(func(blob string, file repo.GitFile) {
 		// check size
 		if sizeLimit > 0 && file.Size > sizeLimit {
-			continue
+			return
 		}
 
+		pending.Add(1)
 		scanQueue <- ScannedFile{Blob: blob, GitFile: file}
-	}
+	}, pending.Wait)
 
 	close(scanQueue)
 
 	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	return scanErr
+}
+
+// mergeOperations merges the ADD operations of the same file in a batch.
+// The refs of a file can come from the multiple chunks of repo.StreamFileEntries,
+// and the indexer can't read the documents added in the same batch.
+func mergeOperations(operations []indexer.FileIndexOperation) []indexer.FileIndexOperation {
+	merged := []indexer.FileIndexOperation{}
+	added := make(map[string]int)
+
+	for _, op := range operations {
+		if op.Method != indexer.ADD && op.Method != indexer.MERGE_REFS {
+			merged = append(merged, op)
+			continue
+		}
+
+		key := op.FileIndex.Blob + ":" + op.FileIndex.Path
+		i, ok := added[key]
+		if !ok {
+			added[key] = len(merged)
+			merged = append(merged, op)
+			continue
+		}
+
+		branches := appendRefs(merged[i].FileIndex.Branches, op.FileIndex.Branches)
+		tags := appendRefs(merged[i].FileIndex.Tags, op.FileIndex.Tags)
+
+		// The refs-only merge takes the content of the ADD operation
+		if merged[i].Method == indexer.MERGE_REFS && op.Method == indexer.ADD {
+			merged[i] = op
+		}
+
+		f := &merged[i].FileIndex
+		f.Branches = branches
+		f.Tags = tags
+	}
+	return merged
+}
+
+func appendRefs(current []string, refs []string) []string {
+	list := append([]string{}, current...)
+	for _, ref := range refs {
+		found := false
+		for _, c := range list {
+			if c == ref {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, ref)
+		}
+	}
+	return list
 }
 
 type ScannedFile struct {
@@ -288,7 +415,39 @@ type ScannedFile struct {
 	GitFile repo.GitFile
 }
 
-func scanFiles(wg *sync.WaitGroup, scanQueue chan ScannedFile, queue chan indexer.FileIndexOperation, g *GitImporter, r *repo.GitRepo, bar *pb.ProgressBar) {
+// ImportStats counts the bytes read from git and the bytes indexed in an import.
+// BytesIndexed is larger than BytesRead if the blobs are shared by the multiple paths.
+// FilesMerged counts the files which were seen in the import before, so only their refs are merged.
+type ImportStats struct {
+	BlobsRead    int64
+	BytesRead    int64
+	FilesIndexed int64
+	BytesIndexed int64
+	FilesMerged  int64
+}
+
+func (s *ImportStats) addRead(size int64) {
+	atomic.AddInt64(&s.BlobsRead, 1)
+	atomic.AddInt64(&s.BytesRead, size)
+}
+
+func (s *ImportStats) addIndexed(size int64) {
+	atomic.AddInt64(&s.FilesIndexed, 1)
+	atomic.AddInt64(&s.BytesIndexed, size)
+}
+
+func (s *ImportStats) addMerged() {
+	atomic.AddInt64(&s.FilesMerged, 1)
+}
+
+func (s *ImportStats) String() string {
+	return fmt.Sprintf("read %d blobs (%d bytes), indexed %d files (%d bytes), merged refs of %d files",
+		atomic.LoadInt64(&s.BlobsRead), atomic.LoadInt64(&s.BytesRead), atomic.LoadInt64(&s.FilesIndexed), atomic.LoadInt64(&s.BytesIndexed), atomic.LoadInt64(&s.FilesMerged))
+}
+
+// scanFiles reads and decodes each blob once, then makes the file indexes for all locations of the blob.
+// The failed blobs are passed to onError and the others are scanned continuously.
+func scanFiles(wg *sync.WaitGroup, pending *sync.WaitGroup, scanQueue chan ScannedFile, queue chan indexer.FileIndexOperation, g *GitImporter, r *repo.GitRepo, bar *pb.ProgressBar, stats *ImportStats, contents *contentCache, onError func(err error)) {
 	defer wg.Done()
 
 	for {
@@ -296,31 +455,27 @@ func scanFiles(wg *sync.WaitGroup, scanQueue chan ScannedFile, queue chan indexe
 		if !ok {
 			return
 		}
+		if err := scanFile(scannedFile, queue, g, r, bar, stats, contents); err != nil {
+			log.Printf("Failed to parse file. [%s] %+v\n", scannedFile.Blob, err)
+			onError(err)
+		}
+		pending.Done()
+	}
+}
 
-		blob := scannedFile.Blob
-		file := scannedFile.GitFile
-
-		for path, loc := range file.Locations {
-			// check contentType and retrive the file content
-			// !! this will be heavy process !!
-			contentType, content, err := g.parseContent(r, blob)
-			if err != nil {
-				log.Printf("Failed to parse file. [%s] - %s %+v\n", blob, path, err)
-				continue
-				// return errors.Wrapf(err, "Failed to parse file. [%s] - %s\n", blob, path)
-			}
-
-			// @TODO Extract text from binary in the future?
-			if !strings.HasPrefix(contentType, "text/") && contentType != "application/octet-stream" {
-				continue
-			}
+func scanFile(scannedFile ScannedFile, queue chan indexer.FileIndexOperation, g *GitImporter, r *repo.GitRepo, bar *pb.ProgressBar, stats *ImportStats, contents *contentCache) error {
+	blob := scannedFile.Blob
+	file := scannedFile.GitFile
 
-			text, encoding, err := readText(content)
-			if err != nil {
-				text = string(content)
-				encoding = "utf8"
-			}
+	// The blob was scanned by a previous chunk of the import, so only the refs are merged without reading it again.
+	// The text kept by the previous chunk is passed for the indexer which needs the content to update the document.
+	if allSeen(file) {
+		var text string
+		if contents != nil {
+			text, _ = contents.Get(blob)
+		}
 
+		for path, loc := range file.Locations {
 			fileIndex := indexer.FileIndex{
 				Metadata: indexer.Metadata{
 					Blob:         blob,
@@ -330,18 +485,76 @@ func scanFiles(wg *sync.WaitGroup, scanQueue chan ScannedFile, queue chan indexe
 					Branches:     loc.Branches,
 					Tags:         loc.Tags,
 					Path:         path,
-					Ext:          indexer.GetExt(path),
-					Encoding:     encoding,
-					Size:         file.Size,
 				},
 				Content: text,
 			}
 
-			bar.Total = bar.Total + 1
+			atomic.AddInt64(&bar.Total, 1)
+			stats.addMerged()
+
+			queue <- indexer.FileIndexOperation{Method: indexer.MERGE_REFS, FileIndex: fileIndex}
+		}
+		return nil
+	}
+
+	// check contentType and retrive the file content
+	// !! this will be heavy process !!
+	contentType, content, err := g.parseContent(r, blob)
+	if err != nil {
+		return err
+	}
+	stats.addRead(int64(len(content)))
+
+	// @TODO Extract text from binary in the future?
+	if !strings.HasPrefix(contentType, "text/") && contentType != "application/octet-stream" {
+		return nil
+	}
+
+	text, encoding, err := readText(content)
+	if err != nil {
+		text = string(content)
+		encoding = "utf8"
+	}
+
+	if contents != nil {
+		if err := contents.Put(blob, text); err != nil {
+			return err
+		}
+	}
+
+	for path, loc := range file.Locations {
+		fileIndex := indexer.FileIndex{
+			Metadata: indexer.Metadata{
+				Blob:         blob,
+				Organization: r.Organization,
+				Project:      r.Project,
+				Repository:   r.Repository,
+				Branches:     loc.Branches,
+				Tags:         loc.Tags,
+				Path:         path,
+				Ext:          indexer.GetExt(path),
+				Encoding:     encoding,
+				Size:         file.Size,
+			},
+			Content: text,
+		}
+
+		atomic.AddInt64(&bar.Total, 1)
+		stats.addIndexed(int64(len(content)))
+
+		queue <- indexer.FileIndexOperation{Method: indexer.ADD, FileIndex: fileIndex}
+	}
+	return nil
+}
 
-			queue <- indexer.FileIndexOperation{Method: indexer.ADD, FileIndex: fileIndex}
+// allSeen reports whether all locations of the file were enumerated by the previous chunks of the import.
+func allSeen(file repo.GitFile) bool {
+	for _, loc := range file.Locations {
+		if !loc.Seen {
+			return false
 		}
 	}
+	return true
 }
 
 // How to detect encoding
@@ -389,7 +602,7 @@ func (g *GitImporter) handleDelFiles(queue chan indexer.FileIndexOperation, bar
 				},
 			}
 
-			bar.Total = bar.Total + 1
+			atomic.AddInt64(&bar.Total, 1)
 
 			// Delete index
 			queue <- indexer.FileIndexOperation{Method: indexer.DELETE, FileIndex: fileIndex}
@@ -0,0 +1,38 @@
+package importer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/wadahiro/gitss/server/indexer"
+)
+
+func TestMergeOperations(t *testing.T) {
+	op := func(method indexer.BatchMethod, path string, tag string, content string) indexer.FileIndexOperation {
+		return indexer.FileIndexOperation{Method: method, FileIndex: indexer.FileIndex{
+			Metadata: indexer.Metadata{Blob: "b1", Path: path, Branches: []string{}, Tags: []string{tag}},
+			Content:  content,
+		}}
+	}
+
+	merged := mergeOperations([]indexer.FileIndexOperation{
+		op(indexer.MERGE_REFS, "a.go", "v1.0", ""),
+		op(indexer.ADD, "a.go", "v2.0", "text"),
+		op(indexer.MERGE_REFS, "a.go", "v3.0", ""),
+		op(indexer.MERGE_REFS, "b.go", "v1.0", ""),
+		op(indexer.MERGE_REFS, "b.go", "v2.0", ""),
+	})
+
+	if len(merged) != 2 {
+		t.Fatalf("got %v operations, want 2", len(merged))
+	}
+	if merged[0].Method != indexer.ADD || merged[0].FileIndex.Content != "text" {
+		t.Errorf("got %v %q, want the ADD with the content", merged[0].Method, merged[0].FileIndex.Content)
+	}
+	if !reflect.DeepEqual(merged[0].FileIndex.Tags, []string{"v1.0", "v2.0", "v3.0"}) {
+		t.Errorf("got %v, want [v1.0 v2.0 v3.0]", merged[0].FileIndex.Tags)
+	}
+	if merged[1].Method != indexer.MERGE_REFS || !reflect.DeepEqual(merged[1].FileIndex.Tags, []string{"v1.0", "v2.0"}) {
+		t.Errorf("got %v %v, want the MERGE_REFS with [v1.0 v2.0]", merged[1].Method, merged[1].FileIndex.Tags)
+	}
+}
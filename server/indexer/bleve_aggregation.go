@@ -0,0 +1,98 @@
+package indexer
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+)
+
+// The max number of the branches and tags in the aggregation
+const REF_AGGREGATION_SIZE = 1000
+
+// AggregateRefs counts the documents matching the query per branch and tag of the repository.
+func (b *BleveIndexer) AggregateRefs(queryString string, organization string, project string, repository string) (RefAggregationResult, error) {
+	result := RefAggregationResult{
+		Query:        queryString,
+		Organization: organization,
+		Project:      project,
+		Repository:   repository,
+		Branches:     []RefCount{},
+		Tags:         []RefCount{},
+	}
+
+	client, err := b.open()
+	if err != nil {
+		return result, err
+	}
+	defer client.Close()
+
+	start := time.Now()
+
+	q, err := b.buildQuery(queryString, FilterParams{
+		Organizations: []string{organization},
+		Projects:      []string{project},
+		Repositories:  []string{repository},
+	})
+	if err != nil {
+		return result, err
+	}
+
+	s := bleve.NewSearchRequest(q)
+	s.Size = 0
+	s.AddFacet("branches", bleve.NewFacetRequest("branches", REF_AGGREGATION_SIZE))
+	s.AddFacet("tags", bleve.NewFacetRequest("tags", REF_AGGREGATION_SIZE))
+
+	searchResults, err := client.Search(s)
+	if err != nil {
+		return result, err
+	}
+
+	indexed := b.config.GetIndexed(organization, project, repository)
+	indexedBranches := []string{}
+	for branch := range indexed.Branches {
+		indexedBranches = append(indexedBranches, branch)
+	}
+	indexedTags := []string{}
+	for tag := range indexed.Tags {
+		indexedTags = append(indexedTags, tag)
+	}
+
+	var branchDates, tagDates map[string]time.Time
+	gitRepo, err := b.reader.GetGitRepo(organization, project, repository)
+	if err == nil {
+		branchDates, tagDates, err = gitRepo.GetRefDates()
+	}
+	if err != nil {
+		// The counts are still useful without the dates
+		log.Printf("Failed to get ref dates of %s:%s/%s. %+v", organization, project, repository, err)
+	}
+
+	branches := buildRefCounts(indexedBranches, facetTermCounts(searchResults.Facets["branches"]), branchDates)
+	sort.Sort(RefCounts(branches))
+
+	tags := buildRefCounts(indexedTags, facetTermCounts(searchResults.Facets["tags"]), tagDates)
+	sort.Sort(RefCountsByDate(tags))
+
+	end := time.Now()
+
+	result.Time = (end.Sub(start)).Seconds()
+	result.Size = int64(searchResults.Total)
+	result.Branches = branches
+	result.Tags = tags
+
+	return result, nil
+}
+
+func facetTermCounts(facetResult *search.FacetResult) map[string]int {
+	counts := make(map[string]int)
+	if facetResult == nil {
+		return counts
+	}
+	for _, term := range facetResult.Terms {
+		counts[term.Term] = term.Count
+	}
+	return counts
+}
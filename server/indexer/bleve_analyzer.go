@@ -27,7 +27,31 @@ func FullRefAnalyzer(config map[string]interface{}, cache *registry.Cache) (*ana
 	return &rv, nil
 }
 
+func BasenameAnalyzer(config map[string]interface{}, cache *registry.Cache) (*analysis.Analyzer, error) {
+	tokenizer, err := cache.TokenizerNamed("basename")
+	if err != nil {
+		return nil, err
+	}
+	rv := analysis.Analyzer{
+		Tokenizer: tokenizer,
+	}
+	return &rv, nil
+}
+
+func IdentifierAnalyzer(config map[string]interface{}, cache *registry.Cache) (*analysis.Analyzer, error) {
+	tokenizer, err := cache.TokenizerNamed("identifier")
+	if err != nil {
+		return nil, err
+	}
+	rv := analysis.Analyzer{
+		Tokenizer: tokenizer,
+	}
+	return &rv, nil
+}
+
 func init() {
 	registry.RegisterAnalyzer("path_hierarchy", PathHierarchyAnalyzer)
 	registry.RegisterAnalyzer("full_ref", FullRefAnalyzer)
+	registry.RegisterAnalyzer("basename", BasenameAnalyzer)
+	registry.RegisterAnalyzer("identifier", IdentifierAnalyzer)
 }
@@ -0,0 +1,288 @@
+package indexer
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// The fingerprint index has a document per blob. The hashes are indexed for the lookup
+// and the fingerprints with the line ranges are stored only.
+var FINGERPRINT_MAPPING = []byte(`{
+	"types": {
+		"fingerprint": {
+			"enabled": true,
+			"dynamic": false,
+			"properties": {
+				"hashes": {
+					"enabled": true,
+					"dynamic": false,
+					"fields": [{
+						"type": "text",
+						"analyzer": "keyword",
+						"store": false,
+						"index": true,
+						"include_term_vectors": false,
+						"include_in_all": false
+					}],
+					"default_analyzer": ""
+				},
+				"lines": {
+					"enabled": true,
+					"dynamic": false,
+					"fields": [{
+						"type": "number",
+						"store": true,
+						"index": false,
+						"include_in_all": false
+					}],
+					"default_analyzer": ""
+				},
+				"fingerprints": {
+					"enabled": true,
+					"dynamic": false,
+					"fields": [{
+						"type": "text",
+						"analyzer": "keyword",
+						"store": true,
+						"index": false,
+						"include_term_vectors": false,
+						"include_in_all": false
+					}],
+					"default_analyzer": ""
+				}
+			},
+			"default_analyzer": ""
+		}
+	},
+	"default_mapping": {
+		"enabled": false
+	},
+	"type_field": "_type",
+	"default_type": "fingerprint",
+	"default_analyzer": "keyword",
+	"store_dynamic": false,
+	"index_dynamic": false,
+	"analysis": {}
+}`)
+
+// The max number of the snippet hashes in the query
+const SNIPPET_MAX_QUERY_HASHES = 1024
+
+// The number of the candidate blobs and the min similarity of the result
+const SNIPPET_CANDIDATE_SIZE = 50
+const SNIPPET_MIN_SIMILARITY = 0.3
+
+// The max number of the locations per blob
+const SNIPPET_LOCATION_SIZE = 100
+
+type fingerprintDoc struct {
+	Hashes       []string `json:"hashes"`
+	Lines        int      `json:"lines"`
+	Fingerprints string   `json:"fingerprints"`
+}
+
+func (b *BleveIndexer) openFingerprint() (bleve.Index, error) {
+	return b.acquire(b.fingerprintIndex)
+}
+
+// indexFingerprints adds the fingerprints of the new blobs.
+// The documents are removed by removeFingerprints when the last document of the blob is removed from the main index.
+func (b *BleveIndexer) indexFingerprints(files []FileIndex) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	client, err := b.openFingerprint()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	batch := client.NewBatch()
+	added := make(map[string]struct{})
+
+	for _, f := range files {
+		if f.Content == "" {
+			continue
+		}
+		if _, ok := added[f.Blob]; ok {
+			continue
+		}
+		doc, _ := client.Document(f.Blob)
+		if doc != nil {
+			continue
+		}
+
+		fingerprints := Winnow(f.Content)
+		hashes := []string{}
+		for _, fp := range fingerprints {
+			hashes = append(hashes, fingerprintHash(fp.Hash))
+		}
+
+		batch.Index(f.Blob, fingerprintDoc{Hashes: hashes, Lines: countLines(f.Content), Fingerprints: encodeFingerprints(fingerprints)})
+		added[f.Blob] = struct{}{}
+	}
+
+	return client.Batch(batch)
+}
+
+// removeFingerprints deletes the fingerprints of the blobs which no longer have any documents in the main index.
+func (b *BleveIndexer) removeFingerprints(blobs map[string]struct{}) error {
+	if len(blobs) == 0 {
+		return nil
+	}
+
+	client, err := b.open()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	fpClient, err := b.openFingerprint()
+	if err != nil {
+		return err
+	}
+	defer fpClient.Close()
+
+	batch := fpClient.NewBatch()
+	for blob := range blobs {
+		tq := bleve.NewTermQuery(blob)
+		tq.SetField("blob")
+
+		s := bleve.NewSearchRequest(tq)
+		s.Size = 0
+
+		searchResults, err := client.Search(s)
+		if err != nil {
+			return err
+		}
+		if searchResults.Total == 0 {
+			batch.Delete(blob)
+		}
+	}
+	return fpClient.Batch(batch)
+}
+
+// blobOfDocID returns the blob of the document ID, "organization:project:repository:blob:path".
+func blobOfDocID(docID string) string {
+	ids := strings.SplitN(docID, ":", 5)
+	if len(ids) < 5 {
+		return ""
+	}
+	return ids[3]
+}
+
+// SearchSnippet finds the files which contain the snippet or its near copy by the fingerprints.
+// The similarity is the ratio of the snippet fingerprints found in the file.
+func (b *BleveIndexer) SearchSnippet(snippet string, filterParams FilterParams) (SnippetResult, error) {
+	result := SnippetResult{
+		FilterParams: filterParams,
+		Hits:         []SnippetHit{},
+	}
+
+	start := time.Now()
+
+	queryHashes := make(map[uint64]struct{})
+	for _, fp := range Winnow(snippet) {
+		if len(queryHashes) >= SNIPPET_MAX_QUERY_HASHES {
+			break
+		}
+		queryHashes[fp.Hash] = struct{}{}
+	}
+	result.Fingerprints = len(queryHashes)
+
+	if len(queryHashes) == 0 {
+		return result, nil
+	}
+
+	fpClient, err := b.openFingerprint()
+	if err != nil {
+		return result, err
+	}
+	defer fpClient.Close()
+
+	queries := []query.Query{}
+	for hash := range queryHashes {
+		tq := bleve.NewTermQuery(fingerprintHash(hash))
+		tq.SetField("hashes")
+		queries = append(queries, tq)
+	}
+
+	s := bleve.NewSearchRequest(bleve.NewDisjunctionQuery(queries...))
+	s.Size = SNIPPET_CANDIDATE_SIZE
+	s.Fields = []string{"fingerprints"}
+
+	candidates, err := fpClient.Search(s)
+	if err != nil {
+		return result, err
+	}
+
+	client, err := b.open()
+	if err != nil {
+		return result, err
+	}
+	defer client.Close()
+
+	hits := SnippetHits{}
+
+	for _, candidate := range candidates.Hits {
+		similarity, lines := matchFingerprints(queryHashes, decodeFingerprints(fieldString(candidate.Fields["fingerprints"])))
+		if similarity < SNIPPET_MIN_SIMILARITY {
+			continue
+		}
+
+		locations, err := searchBlobLocations(client, candidate.ID, filterParams, SNIPPET_LOCATION_SIZE)
+		if err != nil {
+			return result, err
+		}
+
+		for i := range locations {
+			hits = append(hits, SnippetHit{
+				Metadata:   locations[i].Metadata,
+				ID:         getDocId(&locations[i]),
+				Similarity: similarity,
+				Lines:      lines,
+			})
+		}
+	}
+
+	sort.Stable(hits)
+
+	end := time.Now()
+
+	result.Time = (end.Sub(start)).Seconds()
+	result.Size = int64(len(hits))
+	result.Hits = hits
+
+	return result, nil
+}
+
+// searchBlobLocations returns the files of the blob in the main index.
+func searchBlobLocations(client bleve.Index, blob string, filterParams FilterParams, size int) ([]FileIndex, error) {
+	tq := bleve.NewTermQuery(blob)
+	tq.SetField("blob")
+
+	s := bleve.NewSearchRequest(appendFilterParams(tq, filterParams))
+	s.Size = size
+
+	searchResults, err := client.Search(s)
+	if err != nil {
+		return nil, err
+	}
+
+	locations := []FileIndex{}
+	for _, hit := range searchResults.Hits {
+		doc, err := client.Document(hit.ID)
+		if err != nil || doc == nil {
+			log.Println("Already deleted from index? ID:" + hit.ID)
+			continue
+		}
+		locations = append(locations, *docToFileIndex(doc))
+	}
+	return locations, nil
+}
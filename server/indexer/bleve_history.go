@@ -0,0 +1,84 @@
+package indexer
+
+import (
+	"log"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// GetPathHistory finds the versions of the path on every indexed branch and tag of the repository.
+// The path is matched by the keyword term of the path hierarchy, then checked exactly.
+func (b *BleveIndexer) GetPathHistory(organization string, project string, repository string, path string) (PathHistory, error) {
+	result := PathHistory{
+		Organization:    organization,
+		Project:         project,
+		Repository:      repository,
+		Path:            path,
+		Versions:        []PathVersion{},
+		MissingBranches: []string{},
+		MissingTags:     []string{},
+	}
+
+	client, err := b.open()
+	if err != nil {
+		return result, err
+	}
+	defer client.Close()
+
+	start := time.Now()
+
+	pq := bleve.NewTermQuery(path)
+	pq.SetField("path")
+
+	q := appendFilterParams(pq, FilterParams{
+		Organizations: []string{organization},
+		Projects:      []string{project},
+		Repositories:  []string{repository},
+	})
+
+	s := bleve.NewSearchRequest(q)
+	s.Size = 100
+
+	files := []FileIndex{}
+
+	err = b.handleSearch(client, s, func(searchResult *bleve.SearchResult) {
+		for _, hit := range searchResult.Hits {
+			doc, err := client.Document(hit.ID)
+			if err != nil || doc == nil {
+				log.Println("Already deleted from index? ID:" + hit.ID)
+				continue
+			}
+			f := docToFileIndex(doc)
+			// The term of the path hierarchy also matches the files under the directory
+			if f.Path != path {
+				continue
+			}
+			files = append(files, *f)
+		}
+	})
+	if err != nil {
+		return result, err
+	}
+
+	var branchDates, tagDates map[string]time.Time
+	gitRepo, err := b.reader.GetGitRepo(organization, project, repository)
+	if err == nil {
+		branchDates, tagDates, err = gitRepo.GetRefDates()
+	}
+	if err != nil {
+		// The versions are still useful without the dates
+		log.Printf("Failed to get ref dates of %s:%s/%s. %+v", organization, project, repository, err)
+	}
+
+	result.Versions = buildPathVersions(files, branchDates, tagDates)
+
+	indexed := b.config.GetIndexed(organization, project, repository)
+	result.MissingBranches = missingRefs(indexed.Branches, result.Versions, func(v PathVersion) []string { return v.Branches })
+	result.MissingTags = missingRefs(indexed.Tags, result.Versions, func(v PathVersion) []string { return v.Tags })
+
+	end := time.Now()
+	result.Time = (end.Sub(start)).Seconds()
+
+	return result, nil
+}
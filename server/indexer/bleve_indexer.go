@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	// "strconv"
+	"sync"
 	"time"
 
 	"sort"
@@ -17,10 +18,16 @@ import (
 	"github.com/blevesearch/bleve/mapping"
 	"github.com/blevesearch/bleve/search"
 	"github.com/blevesearch/bleve/search/query"
+	"github.com/pkg/errors"
 	"github.com/wadahiro/gitss/server/config"
 	"github.com/wadahiro/gitss/server/repo"
+	"github.com/wadahiro/gitss/server/util"
 )
 
+// The max number of the fullRefs terms to collect the repository groups.
+// All terms are collected under it, and the groups are marked as partial over it.
+const GROUP_FACET_SIZE = 100000
+
 var MAPPING = []byte(`{
 	"types": {
 		"file": {
@@ -128,6 +135,14 @@ var MAPPING = []byte(`{
 						"index": true,
 						"include_term_vectors": true,
 						"include_in_all": false
+					}, {
+						"name": "basename",
+						"type": "text",
+						"analyzer": "basename",
+						"store": false,
+						"index": true,
+						"include_term_vectors": false,
+						"include_in_all": false
 					}],
 					"default_analyzer": ""
 				},
@@ -179,6 +194,27 @@ var MAPPING = []byte(`{
 						"index": true,
 						"include_term_vectors": true,
 						"include_in_all": true
+					}, {
+						"name": "symbols",
+						"type": "text",
+						"analyzer": "identifier",
+						"store": false,
+						"index": true,
+						"include_term_vectors": false,
+						"include_in_all": false
+					}],
+					"default_analyzer": ""
+				},
+				"storedContent": {
+					"enabled": true,
+					"dynamic": true,
+					"fields": [{
+						"type": "text",
+						"analyzer": "keyword",
+						"store": true,
+						"index": false,
+						"include_term_vectors": false,
+						"include_in_all": false
 					}],
 					"default_analyzer": ""
 				}
@@ -202,123 +238,413 @@ var MAPPING = []byte(`{
 }`)
 
 type BleveIndexer struct {
-	config    config.Config
-	reader    *repo.GitRepoReader
-	indexPath string
-	debug     bool
+	config               *config.Config
+	reader               *repo.GitRepoReader
+	indexPath            string
+	fingerprintIndexPath string
+	debug                bool
+	storeContent         bool
+	suggestCache         *util.LRUCache
+	searchCache          *searchCache
+
+	// The indexes are opened once and shared by all requests until Close is called.
+	// bleve.Index is safe for the concurrent use, so the readers don't need any lock.
+	index            bleve.Index
+	fingerprintIndex bleve.Index
+	mutex            sync.Mutex
+	closed           bool
+	inFlight         sync.WaitGroup
+	// The writers are serialized because the upsert reads the current document before updating
+	writeMutex sync.Mutex
+
+	// In the sharded mode, the index is split per organization or per repository instead of the single index
+	shardMode    string
+	shardsPath   string
+	shards       map[string]*bleveShard
+	shardMapping mapping.IndexMapping
 }
 
-func NewBleveIndexer(config *config.Config, reader *repo.GitRepoReader) Indexer {
+// The time to wait for the file lock of the index held by another process, e.g. "gitss sync" while the server is running
+const BLEVE_OPEN_TIMEOUT = "10s"
+
+var ErrIndexClosed = errors.New("The index is already closed")
+
+var ErrNoStoredContentMapping = errors.New("The index was created without the storedContent mapping, so --store-content can't be used. " +
+	"Remove the index and the indexed directory, then run \"gitss --store-content sync --all\" to create the index again")
+
+// NewBleveIndexer opens the indexes, or creates them if they don't exist.
+// It fails after BLEVE_OPEN_TIMEOUT if another process, e.g. the server, is using the indexes.
+func NewBleveIndexer(config *config.Config, reader *repo.GitRepoReader) (Indexer, error) {
 	indexPath := config.DataDir + "/bleve_index"
-	client, err := bleve.Open(indexPath)
+	fingerprintIndexPath := config.DataDir + "/bleve_fingerprint_index"
 
-	if err == bleve.ErrorIndexPathDoesNotExist {
-		var mapping mapping.IndexMappingImpl
-		err = json.Unmarshal(MAPPING, &mapping)
+	shardsPath := config.DataDir + "/bleve_shards"
 
-		if err != nil {
-			log.Println(err)
-			panic("error unmarshalling mapping")
+	i := &BleveIndexer{config: config, indexPath: indexPath, fingerprintIndexPath: fingerprintIndexPath, reader: reader, debug: config.Debug, suggestCache: util.NewLRUCache(SUGGEST_CACHE_SIZE, SUGGEST_CACHE_TTL),
+		searchCache: newSearchCache(SEARCH_CACHE_SIZE), shardMode: config.IndexShard, shardsPath: shardsPath, storeContent: config.StoreContent}
+
+	if err := i.openIndexes(); err != nil {
+		i.closeIndexes()
+		return nil, err
+	}
+	i.checkSuggestMapping()
+
+	return i, nil
+}
+
+func (b *BleveIndexer) openIndexes() error {
+	var err error
+	switch b.shardMode {
+	case "":
+		b.index, err = initIndex(b.indexPath, MAPPING)
+	case SHARD_ORGANIZATION, SHARD_REPOSITORY:
+		err = b.initShards()
+	default:
+		err = errors.Errorf("Unknown shard mode: %s", b.shardMode)
+	}
+	if err != nil {
+		return err
+	}
+
+	b.fingerprintIndex, err = initIndex(b.fingerprintIndexPath, FINGERPRINT_MAPPING)
+	if err != nil {
+		return err
+	}
+
+	if b.storeContent {
+		return b.checkStoredContentMapping()
+	}
+	return nil
+}
+
+// indexesByPath returns the opened content indexes, which are the shards in the sharded mode.
+func (b *BleveIndexer) indexesByPath() map[string]bleve.Index {
+	if b.shardMode == "" {
+		return map[string]bleve.Index{b.indexPath: b.index}
+	}
+	indexes := map[string]bleve.Index{}
+	for _, shard := range b.shards {
+		indexes[shard.path] = shard.index
+	}
+	return indexes
+}
+
+// checkStoredContentMapping refuses the existing indexes created before storedContent was added to the mapping.
+// The default dynamic mapping of them would index the compressed content as text.
+func (b *BleveIndexer) checkStoredContentMapping() error {
+	for path, index := range b.indexesByPath() {
+		if !hasStoredContentMapping(index.Mapping()) {
+			return errors.Wrapf(ErrNoStoredContentMapping, "index: %s", path)
+		}
+	}
+	return nil
+}
+
+// checkSuggestMapping warns about the existing indexes created before the symbols and basename fields were added to the mapping.
+// The mapping of an index can't be changed, so the symbols and the files aren't suggested from them until they're created again.
+func (b *BleveIndexer) checkSuggestMapping() {
+	for path, index := range b.indexesByPath() {
+		if !hasSuggestMapping(index.Mapping()) {
+			log.Printf("The index %s doesn't have the symbols and basename fields, so the symbols and the files aren't suggested. "+
+				"Remove the index and the indexed directory, then run \"gitss sync --all\" to create the index again\n", path)
 		}
+	}
+}
+
+// hasStoredContentMapping reports whether storedContent is mapped to a stored and not indexed field.
+func hasStoredContentMapping(m mapping.IndexMapping) bool {
+	field := findFieldMapping(m, "storedContent", "")
+	return field != nil && field.Store && !field.Index
+}
 
-		client, err = bleve.New(indexPath, &mapping)
+// hasSuggestMapping reports whether the fields for the symbol and the file suggestions are mapped.
+func hasSuggestMapping(m mapping.IndexMapping) bool {
+	return findFieldMapping(m, "content", "symbols") != nil && findFieldMapping(m, "path", "basename") != nil
+}
+
+// findFieldMapping finds the field of the property in the file type. The first field is returned if the name is empty.
+func findFieldMapping(m mapping.IndexMapping, property string, name string) *mapping.FieldMapping {
+	impl, ok := m.(*mapping.IndexMappingImpl)
+	if !ok {
+		return nil
+	}
+	file, ok := impl.TypeMapping["file"]
+	if !ok {
+		return nil
+	}
+	p, ok := file.Properties[property]
+	if !ok {
+		return nil
+	}
+	for i, field := range p.Fields {
+		if field.Name == name || (name == "" && i == 0) {
+			return field
+		}
+	}
+	return nil
+}
+
+// initIndex opens the index, or creates it with the mapping if it doesn't exist.
+func initIndex(indexPath string, mappingJSON []byte) (bleve.Index, error) {
+	client, err := bleve.OpenUsing(indexPath, map[string]interface{}{"bolt_timeout": BLEVE_OPEN_TIMEOUT})
+
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		client, err = newIndex(indexPath, mappingJSON)
 
 		if err != nil {
-			log.Println(err)
-			panic("error init index")
+			return nil, errors.Wrapf(err, "Failed to create the index %s", indexPath)
 		}
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open the index %s. Is another gitss process (e.g. the server) using it?", indexPath)
 	}
 
-	defer client.Close()
+	return client, nil
+}
+
+// newIndex creates the index with the mapping.
+func newIndex(indexPath string, mappingJSON []byte) (bleve.Index, error) {
+	var mapping mapping.IndexMappingImpl
+	err := json.Unmarshal(mappingJSON, &mapping)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error unmarshalling mapping")
+	}
+	return bleve.New(indexPath, &mapping)
+}
 
-	i := &BleveIndexer{indexPath: indexPath, reader: reader, debug: config.Debug}
+// bleveIndex is embedded by sharedIndex. bleve.Index can't be embedded directly since it has the Index method.
+type bleveIndex interface {
+	bleve.Index
+}
+
+// sharedIndex is the handle of the shared index for a request.
+// Close releases the handle only, and the index is closed by BleveIndexer.Close.
+type sharedIndex struct {
+	bleveIndex
+	once    sync.Once
+	release func()
+}
 
-	return i
+func (s *sharedIndex) Close() error {
+	s.once.Do(s.release)
+	return nil
 }
 
 func (b *BleveIndexer) open() (bleve.Index, error) {
-	index, err := bleve.Open(b.indexPath)
-	if err != nil {
-		return nil, err
+	if b.shardMode != "" {
+		return b.openShards()
+	}
+	return b.acquire(b.index)
+}
+
+func (b *BleveIndexer) acquire(index bleve.Index) (bleve.Index, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, ErrIndexClosed
 	}
-	return index, nil
+	b.inFlight.Add(1)
+
+	return &sharedIndex{bleveIndex: index, release: b.inFlight.Done}, nil
+}
+
+// Close waits for the requests in flight, then closes the indexes.
+// The requests after Close get ErrIndexClosed.
+func (b *BleveIndexer) Close() error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mutex.Unlock()
+
+	b.inFlight.Wait()
+
+	return b.closeIndexes()
+}
+
+// closeIndexes closes the opened indexes. Some of them aren't opened if NewBleveIndexer failed.
+func (b *BleveIndexer) closeIndexes() error {
+	var err1, err2 error
+	if b.shardMode != "" {
+		err1 = b.closeShards()
+	} else if b.index != nil {
+		err1 = b.index.Close()
+	}
+	if b.fingerprintIndex != nil {
+		err2 = b.fingerprintIndex.Close()
+	}
+	if err1 != nil {
+		return err1
+	}
+	return err2
 }
 
 func (b *BleveIndexer) CreateFileIndex(requestFileIndex FileIndex) error {
-	client, err := b.open()
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	// The cached search results are invalidated after writing
+	defer b.searchCache.Invalidate()
+
+	m := requestFileIndex.Metadata
+	client, err := b.openWriter(m.Organization, m.Project, m.Repository)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	return b.create(client, requestFileIndex, nil)
+	err = b.create(client, requestFileIndex, nil)
+	if err != nil {
+		return err
+	}
+	return b.indexFingerprints([]FileIndex{requestFileIndex})
 }
 
 func (b *BleveIndexer) UpsertFileIndex(requestFileIndex FileIndex) error {
-	client, err := b.open()
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	defer b.searchCache.Invalidate()
+
+	m := requestFileIndex.Metadata
+	client, err := b.openWriter(m.Organization, m.Project, m.Repository)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	return b.upsert(client, requestFileIndex, nil)
+	err = b.upsert(client, requestFileIndex, nil)
+	if err != nil {
+		return err
+	}
+	return b.indexFingerprints([]FileIndex{requestFileIndex})
 }
 
 func (b *BleveIndexer) BatchFileIndex(requestBatch []FileIndexOperation) error {
-	client, err := b.open()
-	if err != nil {
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	defer b.searchCache.Invalidate()
+
+	added := []FileIndex{}
+	removed := make(map[string]struct{})
+	failures := &batchErrors{}
+	for _, operations := range b.groupByShard(requestBatch) {
+		if len(operations) == 0 {
+			continue
+		}
+		m := operations[0].FileIndex.Metadata
+		client, err := b.openWriter(m.Organization, m.Project, m.Repository)
+		if err != nil {
+			return err
+		}
+
+		batch := client.NewBatch()
+		for i := range operations {
+			op := operations[i]
+			f := op.FileIndex
+
+			switch op.Method {
+			case ADD:
+				failures.add(b.upsert(client, f, batch), getDocId(&f))
+				added = append(added, f)
+			case DELETE:
+				failures.add(b.delete(client, f, batch), getDocId(&f))
+				batch.Delete(f.Blob)
+				removed[f.Blob] = struct{}{}
+			case MERGE_REFS:
+				failures.add(b.mergeRefs(client, f, batch), getDocId(&f))
+			}
+		}
+		err = client.Batch(batch)
+		client.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to index the batch of %s:%s/%s", m.Organization, m.Project, m.Repository)
+		}
+	}
+
+	if err := b.indexFingerprints(added); err != nil {
 		return err
 	}
-	defer client.Close()
+	if err := b.removeFingerprints(removed); err != nil {
+		return err
+	}
+	return failures.err()
+}
 
-	batch := client.NewBatch()
-	for i := range requestBatch {
-		op := requestBatch[i]
-		f := op.FileIndex
+// batchErrors keeps the first error and the number of the failed documents in a batch.
+// The other documents are written, and the error is returned after the batch.
+type batchErrors struct {
+	first error
+	count int
+}
 
-		switch op.Method {
-		case ADD:
-			b.upsert(client, f, batch)
-		case DELETE:
-			b.delete(client, f, batch)
-			batch.Delete(f.Blob)
-		}
+func (e *batchErrors) add(err error, docID string) {
+	if err == nil {
+		return
 	}
-	client.Batch(batch)
-	return nil
+	if e.first == nil {
+		e.first = errors.Wrapf(err, "Failed to index %s", docID)
+	}
+	e.count++
+}
+
+func (e *batchErrors) err() error {
+	if e.first == nil {
+		return nil
+	}
+	return errors.Wrapf(e.first, "Failed to index %d documents. The first failure", e.count)
 }
 
 func (b *BleveIndexer) DeleteIndexByRefs(organization string, project string, repository string, branches []string, tags []string) error {
-	client, err := b.open()
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	defer b.searchCache.Invalidate()
+
+	client, err := b.openWriter(organization, project, repository)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	b.searchByRefs(client, organization, project, repository, branches, tags, func(searchResult *bleve.SearchResult) {
+	// The pages are collected before the update, since the updated documents don't match the query and shift the next pages
+	pages := [][]string{}
+	err = b.searchByRefs(client, organization, project, repository, branches, tags, func(searchResult *bleve.SearchResult) {
+		ids := []string{}
+		for _, hit := range searchResult.Hits {
+			ids = append(ids, hit.ID)
+		}
+		pages = append(pages, ids)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to search the documents of %s:%s/%s. branches: %v tags: %v", organization, project, repository, branches, tags)
+	}
+
+	removed := make(map[string]struct{})
+	failures := &batchErrors{}
+
+	for _, ids := range pages {
 		batch := client.NewBatch()
 
-		for i := range searchResult.Hits {
-			hit := searchResult.Hits[i]
-			doc, err := client.Document(hit.ID)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-			err = b.deleteByDoc(client, doc, branches, tags, batch)
+		for _, id := range ids {
+			removed[blobOfDocID(id)] = struct{}{}
+
+			doc, err := client.Document(id)
 			if err != nil {
-				fmt.Println(err)
+				failures.add(err, id)
 				continue
 			}
+			failures.add(b.deleteByDoc(client, doc, branches, tags, batch), id)
 		}
 
-		err := client.Batch(batch)
-		if err != nil {
-			fmt.Println(err)
+		if err := client.Batch(batch); err != nil {
+			return errors.Wrapf(err, "Failed to update the documents of %s:%s/%s", organization, project, repository)
 		}
-	})
+	}
 
-	return nil
+	if err := b.removeFingerprints(removed); err != nil {
+		return err
+	}
+	return failures.err()
 }
 
 func (b *BleveIndexer) create(client bleve.Index, requestFileIndex FileIndex, batch *bleve.Batch) error {
@@ -351,6 +677,10 @@ func (b *BleveIndexer) upsert(client bleve.Index, requestFileIndex FileIndex, ba
 	// Restore fileIndex from index
 	fileIndex := docToFileIndex(doc)
 
+	// The content isn't stored in the index, so it's taken from the request.
+	// The refs of a blob can be merged over the multiple imports (see repo.StreamFileEntries).
+	fileIndex.Content = requestFileIndex.Content
+
 	// Merge ref
 	same := mergeRef(fileIndex, requestFileIndex.Metadata.Branches, requestFileIndex.Metadata.Tags)
 
@@ -374,6 +704,53 @@ func (b *BleveIndexer) upsert(client bleve.Index, requestFileIndex FileIndex, ba
 	return nil
 }
 
+// mergeRefs merges the refs into the existing document.
+// The content isn't stored in the index, so it's restored from the stored content, taken from the request,
+// or read from the git repository when the refs are changed.
+func (b *BleveIndexer) mergeRefs(client bleve.Index, requestFileIndex FileIndex, batch *bleve.Batch) error {
+	doc, _ := client.Document(getDocId(&requestFileIndex))
+
+	// The blob wasn't indexed, e.g. a binary file
+	if doc == nil {
+		return nil
+	}
+
+	fileIndex := docToFileIndex(doc)
+
+	same := mergeRef(fileIndex, requestFileIndex.Metadata.Branches, requestFileIndex.Metadata.Tags)
+	if same {
+		if b.debug {
+			log.Println("Skipped index")
+		}
+		return nil
+	}
+
+	if fileIndex.StoredContent == "" && requestFileIndex.Content != "" {
+		fileIndex.Content = requestFileIndex.Content
+	} else if fileIndex.StoredContent == "" {
+		gitRepo, err := getGitRepo(b.reader, fileIndex)
+		if err != nil {
+			log.Println("Merge refs error", err)
+			return err
+		}
+		fileIndex.Content, err = gitRepo.GetBlobText(fileIndex.Blob, fileIndex.Encoding)
+		if err != nil {
+			log.Println("Merge refs error", err)
+			return err
+		}
+	}
+
+	err := b._index(client, fileIndex, batch)
+	if err != nil {
+		log.Println("Merge refs error", err)
+		return err
+	}
+	if b.debug {
+		log.Println("Merged refs")
+	}
+	return nil
+}
+
 func (b *BleveIndexer) delete(client bleve.Index, requestFileIndex FileIndex, batch *bleve.Batch) error {
 	doc, err := client.Document(getDocId(&requestFileIndex))
 	if err != nil {
@@ -401,6 +778,9 @@ func (b *BleveIndexer) deleteByDoc(client bleve.Index, doc *document.Document, b
 				log.Println("Deleted index")
 			}
 		} else {
+			// Remake the fullRefs from the remaining refs
+			fillFileIndex(fileIndex)
+
 			err := b._index(client, fileIndex, batch)
 
 			if err != nil {
@@ -416,6 +796,8 @@ func (b *BleveIndexer) deleteByDoc(client bleve.Index, doc *document.Document, b
 }
 
 func (b *BleveIndexer) _index(client bleve.Index, f *FileIndex, batch *bleve.Batch) error {
+	b.prepareContent(f)
+
 	if batch == nil {
 		return client.Index(getDocId(f), f)
 	} else {
@@ -426,6 +808,27 @@ func (b *BleveIndexer) _index(client bleve.Index, f *FileIndex, batch *bleve.Bat
 	}
 }
 
+// prepareContent compresses the content to store it, and restores the content from the stored one.
+// The content isn't stored in the index, so the stored content is used when updating the restored document.
+func (b *BleveIndexer) prepareContent(f *FileIndex) {
+	if f.Content == "" && f.StoredContent != "" {
+		content, err := util.DecompressText(f.StoredContent)
+		if err != nil {
+			log.Printf("Failed to decompress the stored content of %s. %+v", getDocId(f), err)
+		} else {
+			f.Content = content
+		}
+	}
+	if b.storeContent && f.StoredContent == "" && f.Content != "" {
+		storedContent, err := util.CompressText(f.Content)
+		if err != nil {
+			log.Printf("Failed to compress the content of %s. %+v", getDocId(f), err)
+		} else {
+			f.StoredContent = storedContent
+		}
+	}
+}
+
 func (b *BleveIndexer) _delete(client bleve.Index, docID string, batch *bleve.Batch) error {
 	if batch == nil {
 		return client.Delete(docID)
@@ -444,21 +847,263 @@ func (b *BleveIndexer) Count() (uint64, error) {
 	return client.DocCount()
 }
 
-func (b *BleveIndexer) SearchQuery(query string, filterParams FilterParams, page int) (SearchResult, error) {
+func (b *BleveIndexer) SearchQuery(query string, filterParams FilterParams, page int, options SearchOptions) (SearchResult, error) {
+	start := time.Now()
+
+	cacheKey := b.searchCache.key(query, filterParams, page, options)
+	if cached, ok := b.searchCache.Get(cacheKey); ok {
+		cached.Time = time.Now().Sub(start).Seconds()
+		return cached, nil
+	}
+
 	client, err := b.open()
 	if err != nil {
 		return SearchResult{}, err
 	}
 	defer client.Close()
 
-	start := time.Now()
-	result := b.search(client, query, filterParams, page)
+	result, err := b.search(client, query, filterParams, page, options)
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	if result.Size == 0 {
+		result.Suggestions = b.suggest(client, query)
+
+		if options.AutoCorrect && len(result.Suggestions) > 0 {
+			corrected, err := b.search(client, result.Suggestions[0].Query, filterParams, page, options)
+			if err != nil {
+				return SearchResult{}, err
+			}
+			corrected.Suggestions = result.Suggestions
+			corrected.OriginalQuery = query
+			result = corrected
+		}
+	}
 	end := time.Now()
 
 	result.Time = (end.Sub(start)).Seconds()
+
+	// only the successful results are cached, the failed search is tried again by the next request
+	b.searchCache.Add(cacheKey, result)
+
 	return result, nil
 }
 
+func (b *BleveIndexer) Explain(query string, filterParams FilterParams, page int) (ExplainResult, error) {
+	client, err := b.open()
+	if err != nil {
+		return ExplainResult{}, err
+	}
+	defer client.Close()
+
+	start := time.Now()
+
+	q, err := b.buildQuery(query, filterParams)
+	if err != nil {
+		return ExplainResult{}, err
+	}
+
+	s := bleve.NewSearchRequestOptions(q, 10, page*10, true)
+
+	searchResults, err := b.searchRanked(client, s, query, page*10, 10)
+	if err != nil {
+		return ExplainResult{}, err
+	}
+
+	hits := []ExplainHit{}
+	for _, hit := range searchResults.Hits {
+		h := ExplainHit{ID: hit.ID, Score: hit.Score, Explanation: toExplanation(hit.Expl)}
+
+		doc, err := client.Document(hit.ID)
+		if err == nil && doc != nil {
+			h.Metadata = docToFileIndex(doc).Metadata
+		}
+		hits = append(hits, h)
+	}
+
+	end := time.Now()
+
+	return ExplainResult{
+		Query:        query,
+		FilterParams: filterParams,
+		ParsedQuery:  q,
+		Time:         (end.Sub(start)).Seconds(),
+		Size:         int64(searchResults.Total),
+		Current:      page,
+		Hits:         hits,
+	}, nil
+}
+
+// searchRanked runs the search request for the hits from the offset.
+// The hits in the top RANKING_WINDOW are re-ranked by the ranking boosts of their organization,
+// so the pages beyond the window keep the original order.
+func (b *BleveIndexer) searchRanked(client bleve.Index, s *bleve.SearchRequest, queryString string, from int, size int) (*bleve.SearchResult, error) {
+	if from+size > RANKING_WINDOW {
+		s.From = from
+		s.Size = size
+		return client.Search(s)
+	}
+
+	window := *s
+	window.From = 0
+	window.Size = RANKING_WINDOW
+	window.Fields = RANKING_FIELDS
+	window.Highlight = nil
+
+	searchResults, err := client.Search(&window)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := []string{}
+	for _, term := range extractQueryTerms(queryString) {
+		terms = append(terms, term.Term)
+	}
+
+	settings := make(map[string]config.RankingSetting)
+	defaultBranches := make(map[string]string)
+
+	for _, hit := range searchResults.Hits {
+		organization := fieldString(hit.Fields["organization"])
+		project := fieldString(hit.Fields["project"])
+		repository := fieldString(hit.Fields["repository"])
+
+		setting, ok := settings[organization]
+		if !ok {
+			setting = b.config.GetRanking(organization)
+			settings[organization] = setting
+		}
+
+		key := organization + ":" + project + "/" + repository
+		defaultBranch, ok := defaultBranches[key]
+		if !ok && setting.DefaultBranch == "" {
+			defaultBranch = b.config.GetIndexed(organization, project, repository).DefaultBranch
+			defaultBranches[key] = defaultBranch
+		}
+
+		boosts := rankingBoosts(setting, defaultBranch, fieldStrings(hit.Fields["branches"]), fieldString(hit.Fields["path"]), terms)
+		if len(boosts) == 0 {
+			continue
+		}
+
+		score := hit.Score
+		children := []*search.Explanation{hit.Expl}
+		for _, boost := range boosts {
+			score *= boost.Boost
+			children = append(children, &search.Explanation{Value: boost.Boost, Message: boost.Name})
+		}
+		hit.Score = score
+
+		if hit.Expl != nil {
+			hit.Expl = &search.Explanation{Value: score, Message: "product of ranking boosts:", Children: children}
+		}
+	}
+
+	sort.Stable(scoreSortableHits(searchResults.Hits))
+
+	searchResults.MaxScore = 0
+	for _, hit := range searchResults.Hits {
+		if hit.Score > searchResults.MaxScore {
+			searchResults.MaxScore = hit.Score
+		}
+	}
+
+	searchResults.Hits = pageHits(searchResults.Hits, from, size)
+	searchResults.Request = s
+
+	if err := loadPageHits(client, s, searchResults.Hits); err != nil {
+		return nil, err
+	}
+
+	return searchResults, nil
+}
+
+// loadPageHits loads the fields, the locations and the highlights of the hits by the request restricted to them.
+// The scores and the explanations of the re-ranking are kept.
+func loadPageHits(client bleve.Index, s *bleve.SearchRequest, hits search.DocumentMatchCollection) error {
+	if len(hits) == 0 {
+		return nil
+	}
+
+	ids := []string{}
+	for _, hit := range hits {
+		ids = append(ids, hit.ID)
+	}
+
+	req := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(s.Query, bleve.NewDocIDQuery(ids)), len(ids), 0, false)
+	req.Fields = s.Fields
+	req.Highlight = s.Highlight
+	req.IncludeLocations = s.IncludeLocations
+
+	result, err := client.Search(req)
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]*search.DocumentMatch)
+	for _, hit := range result.Hits {
+		loaded[hit.ID] = hit
+	}
+	for _, hit := range hits {
+		if l, ok := loaded[hit.ID]; ok {
+			hit.Fields = l.Fields
+			hit.Locations = l.Locations
+			hit.Fragments = l.Fragments
+		}
+	}
+	return nil
+}
+
+func pageHits(hits search.DocumentMatchCollection, from int, size int) search.DocumentMatchCollection {
+	if from >= len(hits) {
+		return search.DocumentMatchCollection{}
+	} else if from+size < len(hits) {
+		return hits[from : from+size]
+	}
+	return hits[from:]
+}
+
+type scoreSortableHits search.DocumentMatchCollection
+
+func (s scoreSortableHits) Len() int           { return len(s) }
+func (s scoreSortableHits) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s scoreSortableHits) Less(i, j int) bool { return s[i].Score > s[j].Score }
+
+func fieldString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return ""
+}
+
+func fieldStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := []string{}
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return []string{}
+}
+
+func toExplanation(expl *search.Explanation) *Explanation {
+	if expl == nil {
+		return nil
+	}
+	e := &Explanation{Value: expl.Value, Message: expl.Message}
+	for _, child := range expl.Children {
+		e.Children = append(e.Children, toExplanation(child))
+	}
+	return e
+}
+
 func (b *BleveIndexer) Exists(fileIndex FileIndex) (bool, error) {
 	client, err := b.open()
 	if err != nil {
@@ -473,6 +1118,46 @@ func (b *BleveIndexer) Exists(fileIndex FileIndex) (bool, error) {
 	return false, err
 }
 
+// FindBlob lists all indexed files of the blob by the keyword query on the blob field.
+func (b *BleveIndexer) FindBlob(blob string) (BlobResult, error) {
+	result := BlobResult{Blob: blob, Locations: []Metadata{}}
+
+	client, err := b.open()
+	if err != nil {
+		return result, err
+	}
+	defer client.Close()
+
+	start := time.Now()
+
+	q := bleve.NewTermQuery(blob)
+	q.SetField("blob")
+
+	s := bleve.NewSearchRequest(q)
+	s.Size = 100
+
+	err = b.handleSearch(client, s, func(searchResult *bleve.SearchResult) {
+		for _, hit := range searchResult.Hits {
+			doc, err := client.Document(hit.ID)
+			if err != nil || doc == nil {
+				log.Println("Already deleted from index? ID:" + hit.ID)
+				continue
+			}
+			result.Locations = append(result.Locations, docToFileIndex(doc).Metadata)
+		}
+	})
+	if err != nil {
+		return result, err
+	}
+
+	end := time.Now()
+
+	result.Time = (end.Sub(start)).Seconds()
+	result.Size = int64(len(result.Locations))
+
+	return result, nil
+}
+
 func (b *BleveIndexer) searchByRefs(client bleve.Index, organization string, project string, repository string, branches []string, tags []string, callback func(searchResult *bleve.SearchResult)) error {
 	oq := bleve.NewQueryStringQuery("organization:" + organization)
 	pq := bleve.NewQueryStringQuery("project:" + project)
@@ -551,47 +1236,39 @@ func (b *BleveIndexer) handleSearch(client bleve.Index, searchRequest *bleve.Sea
 	return nil
 }
 
-func (b *BleveIndexer) search(client bleve.Index, queryString string, filterParams FilterParams, page int) SearchResult {
-	p := qs.Parser{DefaultOp: qs.AND}
-	q, err := p.Parse(queryString)
+// search returns the page of the hits and the facets. The query which can't be parsed results in ErrInvalidQuery.
+func (b *BleveIndexer) search(client bleve.Index, queryString string, filterParams FilterParams, page int, options SearchOptions) (SearchResult, error) {
+	q, err := b.buildQuery(queryString, filterParams)
 
 	if err != nil {
-		log.Printf("Query parse error. %+v", err)
-		return SearchResult{
-			Query:         queryString,
-			FilterParams:  filterParams,
-			Hits:          []Hit{},
-			Size:          0,
-			Current:       0,
-			Limit:         10,
-			Facets:        nil,
-			FullRefsFacet: nil,
-		}
-	}
-
-	if b.debug {
-		log.Printf("ParsedQuery: %v\n", q)
+		return SearchResult{}, errors.Wrapf(ErrInvalidQuery, "%v. query: %s", err, queryString)
 	}
 
-	q = appendFilters(q, filterParams.Exts, "ext", true)
-	q = appendFilters(q, filterParams.Organizations, "organization", false)
-	q = appendFilters(q, filterParams.Projects, "project", false)
-	q = appendFilters(q, filterParams.Repositories, "repository", false)
-	q = appendFilters(q, filterParams.Branches, "branches", false)
-	q = appendFilters(q, filterParams.Tags, "tags", false)
-
 	s := bleve.NewSearchRequest(q)
 
 	//
 	// organizationFacet := bleve.NewFacetRequest("organization", 5)
 	// s.AddFacet("organization", organizationFacet)
-	fullRefsFacet := bleve.NewFacetRequest("fullRefs", 100)
+	grouped := options.Group == GROUP_REPOSITORY
+
+	fullRefsFacetSize := 100
+	if grouped {
+		// the groups are collected from the repository terms of fullRefs, which are mixed with the other levels.
+		// The facet collects the counts of all terms anyway, so all terms are requested not to drop any repository.
+		fullRefsFacetSize = countFieldTerms(client, "fullRefs", GROUP_FACET_SIZE)
+	}
+	fullRefsFacet := bleve.NewFacetRequest("fullRefs", fullRefsFacetSize)
 	extFacet := bleve.NewFacetRequest("ext", 100)
 	organizationFacet := bleve.NewFacetRequest("organization", 100)
 	projectFacet := bleve.NewFacetRequest("project", 100)
 	repositoryFacet := bleve.NewFacetRequest("repository", 100)
 	branchesFacet := bleve.NewFacetRequest("branches", 100)
 	tagsFacet := bleve.NewFacetRequest("tags", 100)
+	encodingFacet := bleve.NewFacetRequest("encoding", 100)
+	sizeFacet := bleve.NewFacetRequest("size", len(SIZE_FACET_RANGES))
+	for _, r := range SIZE_FACET_RANGES {
+		sizeFacet.AddNumericRange(r.Name, r.Min, r.Max)
+	}
 
 	s.AddFacet("fullRefs", fullRefsFacet)
 	s.AddFacet("ext", extFacet)
@@ -600,37 +1277,112 @@ func (b *BleveIndexer) search(client bleve.Index, queryString string, filterPara
 	s.AddFacet("repository", repositoryFacet)
 	s.AddFacet("branches", branchesFacet)
 	s.AddFacet("tags", tagsFacet)
+	s.AddFacet("encoding", encodingFacet)
+	s.AddFacet("size", sizeFacet)
 
 	s.Fields = []string{"blob", "fullRefs", "organization", "project", "repository", "refs", "path", "ext"}
 	s.Highlight = bleve.NewHighlight()
 
-	s.From = page * 10
-	s.Size = 10 // @TODO
-
-	searchResults, err := client.Search(s)
+	var searchResults *bleve.SearchResult
+	var occurrences int64
+	var occurrencesPartial bool
+
+	if grouped {
+		s.Size = 0
+		searchResults, err = client.Search(s)
+	} else if options.Sort == SORT_OCCURRENCES {
+		// the facets and total by the first search, then the hits by the occurrences
+		s.Size = 0
+		searchResults, err = client.Search(s)
+		if err == nil {
+			var hits search.DocumentMatchCollection
+			hits, occurrences, occurrencesPartial, err = scanOccurrences(client, q)
+			searchResults.Hits = pageHits(hits, page*10, 10)
+		}
+	} else {
+		searchResults, err = b.searchRanked(client, s, queryString, page*10, 10)
+		if err == nil && options.CountOccurrences {
+			_, occurrences, occurrencesPartial, err = scanOccurrences(client, q)
+		}
+	}
 
 	if err != nil {
-		log.Printf("Query error. %+v", err)
-		return SearchResult{
-			Query:         queryString,
-			FilterParams:  filterParams,
-			Hits:          []Hit{},
-			Size:          0,
-			Current:       0,
-			Limit:         10,
-			Facets:        nil,
-			FullRefsFacet: nil,
+		return SearchResult{}, errors.Wrapf(err, "Failed to search. query: %s", queryString)
+	}
+
+	list := b.toHits(client, searchResults.Hits)
+
+	facets := FacetResults{}
+
+	for k, v := range searchResults.Facets {
+		sort.Sort(&v.Terms)
+
+		tf := TermFacets{}
+		for _, term := range v.Terms {
+			tf = append(tf, TermFacet{Term: term.Term, Count: term.Count})
+		}
+
+		var rf RangeFacets
+		for _, r := range v.NumericRanges {
+			rf = append(rf, RangeFacet{Name: r.Name, Min: r.Min, Max: r.Max, Count: r.Count})
+		}
+		sort.Sort(rf)
+
+		facets[k] = FacetResult{
+			Field:   v.Field,
+			Missing: v.Missing,
+			Other:   v.Other,
+			Terms:   tf,
+			Ranges:  rf,
+			Total:   v.Total,
 		}
 	}
 
-	list := []Hit{}
+	// fullRefs
+	fullRefsFacetResult := facetResultToFullRefsFacet(searchResults.Facets["fullRefs"])
+
+	if grouped {
+		groups, size, err := b.searchGroups(client, q, queryString, searchResults.Facets["fullRefs"], page, options.GroupSize)
+		if err != nil {
+			return SearchResult{}, errors.Wrapf(err, "Failed to search the groups. query: %s", queryString)
+		}
+		return SearchResult{
+			Query:             queryString,
+			FilterParams:      filterParams,
+			Hits:              list,
+			Size:              size,
+			Limit:             10,
+			Current:           page,
+			Facets:            facets,
+			FullRefsFacet:     fullRefsFacetResult,
+			Group:             options.Group,
+			Groups:            groups,
+			GroupsPartial:     isFacetPartial(searchResults.Facets["fullRefs"]),
+			FacetsApproximate: isFacetsApproximate(client, searchResults.Facets),
+		}, nil
+	}
 
-	// log.Println(searchResults)
-	// // f := searchResults.Facets
-	// j, _ := json.MarshalIndent(searchResults, "", "  ")
-	// fmt.Printf("facets: %s\n", string(j))
+	// log.Println(searchResults.Total)
+	return SearchResult{
+		Query:              queryString,
+		FilterParams:       filterParams,
+		Hits:               list,
+		Size:               int64(searchResults.Total),
+		Limit:              10,
+		Current:            page,
+		Facets:             facets,
+		FullRefsFacet:      fullRefsFacetResult,
+		Occurrences:        occurrences,
+		OccurrencesPartial: occurrencesPartial,
+		FacetsApproximate:  isFacetsApproximate(client, searchResults.Facets),
+	}, nil
+}
 
-	for _, hit := range searchResults.Hits {
+// toHits loads the metadata of the hits and makes the previews from the git repositories.
+func (b *BleveIndexer) toHits(client bleve.Index, hits search.DocumentMatchCollection) []Hit {
+	list := []Hit{}
+
+	for _, hit := range hits {
 		doc, err := client.Document(hit.ID)
 		if err != nil {
 			log.Println("Already deleted from index? ID:" + hit.ID)
@@ -645,22 +1397,25 @@ func (b *BleveIndexer) search(client bleve.Index, queryString string, filterPara
 			hitWordSet[hitWord] = struct{}{}
 		}
 
-		// get the file text
-		gitRepo, err := getGitRepo(b.reader, fileIndex)
-		if err != nil {
-			log.Println("Already deleted from git repository? ID:" + hit.ID)
-			continue
-		}
-
-		// make preview
-		preview := gitRepo.FilterBlob(fileIndex.Blob, fileIndex.Encoding, func(line string) bool {
+		filter := func(line string) bool {
 			for k, _ := range hitWordSet {
 				if strings.Contains(strings.ToLower(line), strings.ToLower(k)) {
 					return true
 				}
 			}
 			return false
-		}, 3, 3)
+		}
+
+		// make preview from the stored content, or the file text in the git repository
+		preview, ok := storedPreview(fileIndex, filter)
+		if !ok {
+			gitRepo, err := getGitRepo(b.reader, fileIndex)
+			if err != nil {
+				log.Println("Already deleted from git repository? ID:" + hit.ID)
+				continue
+			}
+			preview = gitRepo.FilterBlob(fileIndex.Blob, fileIndex.Encoding, filter, 3, 3)
+		}
 
 		// // wrap hit words with \u0000
 		// for i := range preview {
@@ -674,42 +1429,163 @@ func (b *BleveIndexer) search(client bleve.Index, queryString string, filterPara
 		}
 		// log.Println(preview)
 
-		h := Hit{Metadata: fileIndex.Metadata, Preview: preview, Keyword: keyword}
+		h := Hit{Metadata: fileIndex.Metadata, ID: hit.ID, Preview: preview, Keyword: keyword, Occurrences: countOccurrences(hit)}
 		list = append(list, h)
 	}
 
-	facets := FacetResults{}
+	return list
+}
 
-	for k, v := range searchResults.Facets {
-		sort.Sort(&v.Terms)
+// storedPreview makes the preview from the stored content. It returns false if the content isn't stored.
+func storedPreview(fileIndex *FileIndex, filter func(line string) bool) ([]util.TextPreview, bool) {
+	if fileIndex.StoredContent == "" {
+		return nil, false
+	}
+	content, err := util.DecompressText(fileIndex.StoredContent)
+	if err != nil {
+		log.Printf("Failed to decompress the stored content of %s. %+v", getDocId(fileIndex), err)
+		return nil, false
+	}
+	return util.FilterTextPreview(strings.NewReader(content), filter, 3, 3), true
+}
 
-		tf := TermFacets{}
-		for _, term := range v.Terms {
-			tf = append(tf, TermFacet{Term: term.Term, Count: term.Count})
+// searchGroups collects the repositories from the fullRefs facet, then searches the best hits of each repository in the page.
+// It returns the number of all groups as the size.
+func (b *BleveIndexer) searchGroups(client bleve.Index, q query.Query, queryString string, fullRefsFacet *search.FacetResult, page int, groupSize int) ([]GroupResult, int64, error) {
+	groups := []GroupResult{}
+	if fullRefsFacet == nil {
+		return groups, 0, nil
+	}
+
+	if groupSize <= 0 {
+		groupSize = DEFAULT_GROUP_SIZE
+	}
+	if groupSize > MAX_GROUP_SIZE {
+		groupSize = MAX_GROUP_SIZE
+	}
+
+	candidates := repositoryGroups{}
+	for _, term := range fullRefsFacet.Terms {
+		if ok, _ := isRepository(term.Term); ok {
+			candidates = append(candidates, repositoryGroup{Term: term.Term, Count: term.Count})
 		}
-		facets[k] = FacetResult{
-			Field:   v.Field,
-			Missing: v.Missing,
-			Other:   v.Other,
-			Terms:   tf,
-			Total:   v.Total,
+	}
+	sort.Sort(candidates)
+
+	from := page * 10
+	to := from + 10
+	if to > len(candidates) {
+		to = len(candidates)
+	}
+
+	for i := from; i < to; i++ {
+		term := candidates[i].Term
+
+		tq := bleve.NewTermQuery(term)
+		tq.SetField("fullRefs")
+
+		s := bleve.NewSearchRequest(bleve.NewConjunctionQuery(q, tq))
+		s.Fields = []string{"blob", "fullRefs", "organization", "project", "repository", "refs", "path", "ext"}
+		s.Highlight = bleve.NewHighlight()
+
+		searchResults, err := b.searchRanked(client, s, queryString, 0, groupSize)
+		if err != nil {
+			return groups, int64(len(candidates)), err
 		}
+
+		organization := term[0:strings.Index(term, ":")]
+		projectAndRepository := strings.SplitN(term[len(organization)+1:], "/", 2)
+
+		groups = append(groups, GroupResult{
+			Organization: organization,
+			Project:      projectAndRepository[0],
+			Repository:   projectAndRepository[1],
+			Size:         int64(searchResults.Total),
+			Hits:         b.toHits(client, searchResults.Hits),
+		})
 	}
 
-	// fullRefs
-	fullRefsFacetResult := facetResultToFullRefsFacet(searchResults.Facets["fullRefs"])
+	return groups, int64(len(candidates)), nil
+}
 
-	// log.Println(searchResults.Total)
-	return SearchResult{
-		Query:         queryString,
-		FilterParams:  filterParams,
-		Hits:          list,
-		Size:          int64(searchResults.Total),
-		Limit:         10,
-		Current:       page,
-		Facets:        facets,
-		FullRefsFacet: fullRefsFacetResult,
+// countFieldTerms counts the terms of the field up to max.
+func countFieldTerms(client bleve.Index, field string, max int) int {
+	dict, err := client.FieldDict(field)
+	if err != nil {
+		log.Printf("Failed to read the terms of %s. %+v", field, err)
+		return max
+	}
+	defer dict.Close()
+
+	count := 0
+	for entry, err := dict.Next(); err == nil && entry != nil && count < max; entry, err = dict.Next() {
+		count++
+	}
+	if count == 0 {
+		return 1
+	}
+	return count
+}
+
+// isFacetPartial reports whether some terms were dropped from the facet result.
+func isFacetPartial(facet *search.FacetResult) bool {
+	return facet != nil && facet.Other > 0
+}
+
+type repositoryGroup struct {
+	Term  string
+	Count int
+}
+
+type repositoryGroups []repositoryGroup
+
+func (r repositoryGroups) Len() int      { return len(r) }
+func (r repositoryGroups) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r repositoryGroups) Less(i, j int) bool {
+	if r[i].Count != r[j].Count {
+		return r[i].Count > r[j].Count
+	}
+	return r[i].Term < r[j].Term
+}
+
+// buildQuery makes the query from the query string, then appends the filters.
+func (b *BleveIndexer) buildQuery(queryString string, filterParams FilterParams) (query.Query, error) {
+	// "size:" and "encoding:" are handled as filters
+	fullTextQuery, fieldFilterParams := ExtractFieldFilters(queryString, filterParams)
+
+	var q query.Query
+	if fullTextQuery == "" {
+		q = bleve.NewMatchAllQuery()
+	} else {
+		p := qs.Parser{DefaultOp: qs.AND}
+		parsed, err := p.Parse(fullTextQuery)
+		if err != nil {
+			return nil, err
+		}
+		q = parsed
+	}
+
+	if b.debug {
+		log.Printf("ParsedQuery: %v\n", q)
+	}
+
+	q, err := appendSizeFilters(q, fieldFilterParams.Sizes)
+	if err != nil {
+		return nil, err
 	}
+
+	return appendFilterParams(q, fieldFilterParams), nil
+}
+
+func appendFilterParams(q query.Query, filterParams FilterParams) query.Query {
+	q = appendFilters(q, filterParams.Exts, "ext", true)
+	q = appendFilters(q, filterParams.Organizations, "organization", false)
+	q = appendFilters(q, filterParams.Projects, "project", false)
+	q = appendFilters(q, filterParams.Repositories, "repository", false)
+	q = appendFilters(q, filterParams.Branches, "branches", false)
+	q = appendFilters(q, filterParams.Tags, "tags", false)
+	q = appendKeywordFilters(q, filterParams.Encodings, "encoding")
+	return q
 }
 
 func appendFilters(q query.Query, list []string, key string, shouldWrap bool) query.Query {
@@ -731,6 +1607,46 @@ func appendFilters(q query.Query, list []string, key string, shouldWrap bool) qu
 	return q
 }
 
+// appendKeywordFilters is same as appendFilters, but it uses term query for the keyword fields.
+// The values are lower-cased because they are indexed so (e.g. "Shift_JIS" -> "shift_jis").
+func appendKeywordFilters(q query.Query, list []string, key string) query.Query {
+	filters := []query.Query{}
+	for i := range list {
+		val := strings.ToLower(list[i])
+		if val != "" {
+			filter := bleve.NewTermQuery(val)
+			filter.SetField(key)
+			filters = append(filters, filter)
+		}
+	}
+	if len(filters) > 0 {
+		return bleve.NewConjunctionQuery(q, bleve.NewDisjunctionQuery(filters...))
+	}
+	return q
+}
+
+// appendSizeFilters appends the numeric range queries for the size field.
+// Unlike the other filters, all size filters must match (e.g. ">1k" and "<10k").
+func appendSizeFilters(q query.Query, list []string) (query.Query, error) {
+	filters := []query.Query{q}
+	for i := range list {
+		if list[i] == "" {
+			continue
+		}
+		r, err := ParseSizeRange(list[i])
+		if err != nil {
+			return nil, err
+		}
+		filter := bleve.NewNumericRangeInclusiveQuery(r.Min, r.Max, &r.InclusiveMin, &r.InclusiveMax)
+		filter.SetField("size")
+		filters = append(filters, filter)
+	}
+	if len(filters) > 1 {
+		return bleve.NewConjunctionQuery(filters...), nil
+	}
+	return q, nil
+}
+
 func facetResultToFullRefsFacet(facetResult *search.FacetResult) []OrganizationFacet {
 	organizationsMap := make(map[string]*OrganizationFacet)
 	projectsMap := make(map[string]*ProjectFacet)
@@ -835,6 +1751,9 @@ func docToFileIndex(doc *document.Document) *FileIndex {
 		case "content":
 			fileIndex.Content = value
 
+		case "storedContent":
+			fileIndex.StoredContent = value
+
 		case "organization":
 			fileIndex.Metadata.Organization = value
 
@@ -853,9 +1772,9 @@ func docToFileIndex(doc *document.Document) *FileIndex {
 
 		case "tags":
 			pos := f.ArrayPositions()[0]
-			_, ok := branchesMap[pos]
+			_, ok := tagsMap[pos]
 			if !ok {
-				branchesMap[pos] = value
+				tagsMap[pos] = value
 			}
 
 		case "path":
@@ -0,0 +1,255 @@
+package indexer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/wadahiro/gitss/server/config"
+	"github.com/wadahiro/gitss/server/repo"
+)
+
+const BENCHMARK_DOCS = 1000
+
+// newBenchmarkIndexer makes the indexer with the generated documents in a temporary directory.
+// The previews can't be made without the git repository, so the log is discarded.
+func newBenchmarkIndexer(tb testing.TB) (*BleveIndexer, func()) {
+	dir, err := ioutil.TempDir("", "gitss-bench")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	log.SetOutput(ioutil.Discard)
+
+	c := &config.Config{DataDir: dir, GitDataDir: dir + "/git"}
+	idx, err := NewBleveIndexer(c, repo.NewGitRepoReader(c))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	i := idx.(*BleveIndexer)
+
+	operations := []FileIndexOperation{}
+	for n := 0; n < BENCHMARK_DOCS; n++ {
+		f := NewFileIndex(fmt.Sprintf("%040x", n), "org", "proj", "repo", "master", fmt.Sprintf("src/pkg%d/file%d.go", n%10, n),
+			fmt.Sprintf("package pkg%d\n\nfunc Func%d() string {\n\treturn \"keyword%d\"\n}\n", n%10, n, n%100))
+		operations = append(operations, FileIndexOperation{Method: ADD, FileIndex: f})
+	}
+	if err := i.BatchFileIndex(operations); err != nil {
+		tb.Fatal(err)
+	}
+
+	return i, func() {
+		i.Close()
+		os.RemoveAll(dir)
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// BenchmarkSearchQuery searches with the shared index handle.
+func BenchmarkSearchQuery(b *testing.B) {
+	i, cleanup := newBenchmarkIndexer(b)
+	defer cleanup()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := i.SearchQuery("keyword42", FilterParams{}, 0, SearchOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSearchQueryOpenPerRequest opens and closes the index for each search like the previous implementation.
+func BenchmarkSearchQueryOpenPerRequest(b *testing.B) {
+	i, cleanup := newBenchmarkIndexer(b)
+	defer cleanup()
+
+	// release the file lock of the shared handle
+	i.Close()
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		client, err := bleve.Open(i.indexPath)
+		if err != nil {
+			b.Fatal(err)
+		}
+		i.search(client, "keyword42", FilterParams{}, 0, SearchOptions{})
+		client.Close()
+	}
+}
+
+// BenchmarkSearchQueryParallel searches concurrently with the shared index handle.
+func BenchmarkSearchQueryParallel(b *testing.B) {
+	i, cleanup := newBenchmarkIndexer(b)
+	defer cleanup()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := i.SearchQuery("keyword42", FilterParams{}, 0, SearchOptions{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestRemoveFingerprints checks the fingerprints are removed with the last document of the blob.
+func TestRemoveFingerprints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitss-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{DataDir: dir, GitDataDir: dir + "/git"}
+	idx, err := NewBleveIndexer(c, repo.NewGitRepoReader(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := idx.(*BleveIndexer)
+	defer i.Close()
+
+	content := "package main\n\nfunc main() {\n}\n"
+	operations := []FileIndexOperation{
+		{Method: ADD, FileIndex: NewFileIndex("blob1", "org", "proj", "repo", "master", "main.go", content)},
+		{Method: ADD, FileIndex: NewFileIndex("blob1", "org", "proj", "repo", "master", "copy/main.go", content)},
+		{Method: ADD, FileIndex: NewFileIndex("blob2", "org", "proj", "repo", "develop", "main.go", content+"\n")},
+	}
+	if err := i.BatchFileIndex(operations); err != nil {
+		t.Fatal(err)
+	}
+
+	exists := func(blob string) bool {
+		doc, err := i.fingerprintIndex.Document(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doc != nil
+	}
+
+	err = i.BatchFileIndex([]FileIndexOperation{
+		{Method: DELETE, FileIndex: NewFileIndex("blob1", "org", "proj", "repo", "master", "main.go", "")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists("blob1") {
+		t.Errorf("got removed, want kept while blob1 has a document")
+	}
+
+	if err := i.DeleteIndexByRefs("org", "proj", "repo", []string{"master"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if exists("blob1") {
+		t.Errorf("got kept, want removed after the last document of blob1")
+	}
+	if !exists("blob2") {
+		t.Errorf("got removed, want kept for blob2")
+	}
+}
+
+// TestDeleteIndexByTags checks only the requested tags are removed from the documents.
+func TestDeleteIndexByTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitss-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{DataDir: dir, GitDataDir: dir + "/git"}
+	idx, err := NewBleveIndexer(c, repo.NewGitRepoReader(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := idx.(*BleveIndexer)
+	defer i.Close()
+
+	f := NewFileIndex("blob1", "org", "proj", "repo", "master", "main.go", "package main\n")
+	f.Metadata.Tags = []string{"master", "v1"}
+	if err := i.BatchFileIndex([]FileIndexOperation{{Method: ADD, FileIndex: f}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := i.DeleteIndexByRefs("org", "proj", "repo", []string{}, []string{"v1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := i.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	doc, err := client.Document(getDocId(&f))
+	if err != nil || doc == nil {
+		t.Fatalf("got %v %v, want the document", doc, err)
+	}
+	got := docToFileIndex(doc)
+	if len(got.Metadata.Branches) != 1 || got.Metadata.Branches[0] != "master" {
+		t.Errorf("got %v, want [master]", got.Metadata.Branches)
+	}
+	if len(got.Metadata.Tags) != 1 || got.Metadata.Tags[0] != "master" {
+		t.Errorf("got %v, want [master]", got.Metadata.Tags)
+	}
+	// The fullRefs of the removed tag aren't left for the facets
+	wantFullRefs := []string{"org:proj/repo:branch:master", "org:proj/repo:tag:master"}
+	if !reflect.DeepEqual(got.FullRefs, wantFullRefs) {
+		t.Errorf("got %v, want %v", got.FullRefs, wantFullRefs)
+	}
+}
+
+func TestHasStoredContentMapping(t *testing.T) {
+	newMapping := func(storedContent *mapping.DocumentMapping) *mapping.IndexMappingImpl {
+		file := &mapping.DocumentMapping{Properties: map[string]*mapping.DocumentMapping{}}
+		if storedContent != nil {
+			file.Properties["storedContent"] = storedContent
+		}
+		return &mapping.IndexMappingImpl{TypeMapping: map[string]*mapping.DocumentMapping{"file": file}}
+	}
+
+	tests := []struct {
+		name    string
+		mapping *mapping.IndexMappingImpl
+		want    bool
+	}{
+		{"stored", newMapping(&mapping.DocumentMapping{Fields: []*mapping.FieldMapping{{Type: "text", Store: true}}}), true},
+		{"indexed", newMapping(&mapping.DocumentMapping{Fields: []*mapping.FieldMapping{{Type: "text", Store: true, Index: true}}}), false},
+		{"no fields", newMapping(&mapping.DocumentMapping{}), false},
+		{"missing", newMapping(nil), false},
+		{"no file type", &mapping.IndexMappingImpl{}, false},
+	}
+	for _, test := range tests {
+		if got := hasStoredContentMapping(test.mapping); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHasSuggestMapping(t *testing.T) {
+	newMapping := func(contentFields []*mapping.FieldMapping, pathFields []*mapping.FieldMapping) *mapping.IndexMappingImpl {
+		file := &mapping.DocumentMapping{Properties: map[string]*mapping.DocumentMapping{
+			"content": {Fields: contentFields},
+			"path":    {Fields: pathFields},
+		}}
+		return &mapping.IndexMappingImpl{TypeMapping: map[string]*mapping.DocumentMapping{"file": file}}
+	}
+
+	content := &mapping.FieldMapping{Type: "text"}
+	symbols := &mapping.FieldMapping{Name: "symbols", Type: "text"}
+	path := &mapping.FieldMapping{Type: "text"}
+	basename := &mapping.FieldMapping{Name: "basename", Type: "text"}
+
+	if !hasSuggestMapping(newMapping([]*mapping.FieldMapping{content, symbols}, []*mapping.FieldMapping{path, basename})) {
+		t.Errorf("got false, want true for the current mapping")
+	}
+	if hasSuggestMapping(newMapping([]*mapping.FieldMapping{content}, []*mapping.FieldMapping{path})) {
+		t.Errorf("got true, want false for the old mapping")
+	}
+	if hasSuggestMapping(newMapping([]*mapping.FieldMapping{content, symbols}, []*mapping.FieldMapping{path})) {
+		t.Errorf("got true, want false without basename")
+	}
+}
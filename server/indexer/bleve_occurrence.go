@@ -0,0 +1,59 @@
+package indexer
+
+import (
+	"sort"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// The max number of the documents to count the occurrences
+const OCCURRENCE_SCAN_SIZE = 10000
+
+// scanOccurrences searches the documents up to OCCURRENCE_SCAN_SIZE with the term locations,
+// then returns the hits ordered by the occurrences and the total occurrences.
+// It returns true as the third value if there were more documents than the scan size.
+func scanOccurrences(client bleve.Index, q query.Query) (search.DocumentMatchCollection, int64, bool, error) {
+	s := bleve.NewSearchRequest(q)
+	s.Size = OCCURRENCE_SCAN_SIZE
+	s.IncludeLocations = true
+
+	searchResults, err := client.Search(s)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	var total int64
+	counts := make([]int, len(searchResults.Hits))
+	for i, hit := range searchResults.Hits {
+		counts[i] = countOccurrences(hit)
+		total += int64(counts[i])
+	}
+
+	// Keep the relevance order for the same occurrences
+	sort.Stable(&occurrenceSortableHits{hits: searchResults.Hits, counts: counts})
+
+	return searchResults.Hits, total, searchResults.Total > uint64(len(searchResults.Hits)), nil
+}
+
+// countOccurrences counts the locations of the matched terms in the content.
+func countOccurrences(hit *search.DocumentMatch) int {
+	count := 0
+	for _, locations := range hit.Locations["content"] {
+		count += len(locations)
+	}
+	return count
+}
+
+type occurrenceSortableHits struct {
+	hits   search.DocumentMatchCollection
+	counts []int
+}
+
+func (o *occurrenceSortableHits) Len() int { return len(o.hits) }
+func (o *occurrenceSortableHits) Swap(i, j int) {
+	o.hits[i], o.hits[j] = o.hits[j], o.hits[i]
+	o.counts[i], o.counts[j] = o.counts[j], o.counts[i]
+}
+func (o *occurrenceSortableHits) Less(i, j int) bool { return o.counts[i] > o.counts[j] }
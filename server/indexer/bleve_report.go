@@ -0,0 +1,286 @@
+package indexer
+
+import (
+	"sort"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// The hashes shared by too many blobs are boilerplate like the license headers, so they are ignored
+const REPORT_MAX_HASH_FREQ = 20
+
+// The min number of the shared hashes to report the duplicated blocks
+const REPORT_MIN_SHARED_HASHES = 5
+
+// The number of the locations per blob in the report
+const REPORT_LOCATION_SIZE = 10
+
+// The number of the documents per request to scan the fingerprint index
+const REPORT_SCAN_SIZE = 1000
+
+// ReportDuplicates makes the report of the identical files and the duplicated blocks across all repositories.
+// The identical files are found by the blob dictionary of the main index,
+// and the duplicated blocks are found by the fingerprints shared by the different blobs.
+func (b *BleveIndexer) ReportDuplicates(size int) (DuplicateReport, error) {
+	report := DuplicateReport{
+		IdenticalFiles:   []IdenticalFile{},
+		DuplicatedBlocks: []DuplicatedBlock{},
+	}
+
+	if size <= 0 {
+		size = DEFAULT_REPORT_SIZE
+	}
+
+	client, err := b.open()
+	if err != nil {
+		return report, err
+	}
+	defer client.Close()
+
+	fpClient, err := b.openFingerprint()
+	if err != nil {
+		return report, err
+	}
+	defer fpClient.Close()
+
+	start := time.Now()
+
+	report.IdenticalFiles, err = reportIdenticalFiles(client, fpClient, size)
+	if err != nil {
+		return report, err
+	}
+
+	report.DuplicatedBlocks, err = b.reportDuplicatedBlocks(client, fpClient, size)
+	if err != nil {
+		return report, err
+	}
+
+	end := time.Now()
+	report.Time = (end.Sub(start)).Seconds()
+
+	return report, nil
+}
+
+func reportIdenticalFiles(client bleve.Index, fpClient bleve.Index, size int) ([]IdenticalFile, error) {
+	dict, err := client.FieldDict("blob")
+	if err != nil {
+		return nil, err
+	}
+
+	// The count of the blob term is the number of the files having the blob
+	files := IdenticalFiles{}
+	for entry, err := dict.Next(); err == nil && entry != nil; entry, err = dict.Next() {
+		if entry.Count >= 2 {
+			files = append(files, IdenticalFile{Blob: entry.Term, Copies: int(entry.Count)})
+		}
+	}
+	dict.Close()
+
+	for i := 0; i < len(files); i += REPORT_SCAN_SIZE {
+		end := i + REPORT_SCAN_SIZE
+		if end > len(files) {
+			end = len(files)
+		}
+
+		ids := []string{}
+		for _, f := range files[i:end] {
+			ids = append(ids, f.Blob)
+		}
+
+		s := bleve.NewSearchRequest(bleve.NewDocIDQuery(ids))
+		s.Size = len(ids)
+		s.Fields = []string{"lines"}
+
+		searchResults, err := fpClient.Search(s)
+		if err != nil {
+			return nil, err
+		}
+
+		lines := make(map[string]int)
+		for _, hit := range searchResults.Hits {
+			if v, ok := hit.Fields["lines"].(float64); ok {
+				lines[hit.ID] = int(v)
+			}
+		}
+
+		for j := i; j < end; j++ {
+			files[j].Lines = lines[files[j].Blob]
+			files[j].DuplicatedLines = files[j].Lines * (files[j].Copies - 1)
+		}
+	}
+
+	sort.Sort(files)
+
+	if len(files) > size {
+		files = files[:size]
+	}
+
+	for i := range files {
+		locations, err := searchBlobLocations(client, files[i].Blob, FilterParams{}, REPORT_LOCATION_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		files[i].Locations = toMetadataList(locations)
+	}
+
+	return files, nil
+}
+
+func (b *BleveIndexer) reportDuplicatedBlocks(client bleve.Index, fpClient bleve.Index, size int) ([]DuplicatedBlock, error) {
+	dict, err := fpClient.FieldDict("hashes")
+	if err != nil {
+		return nil, err
+	}
+
+	shared := make(map[string]struct{})
+	for entry, err := dict.Next(); err == nil && entry != nil; entry, err = dict.Next() {
+		if entry.Count >= 2 && entry.Count <= REPORT_MAX_HASH_FREQ {
+			shared[entry.Term] = struct{}{}
+		}
+	}
+	dict.Close()
+
+	if len(shared) == 0 {
+		return []DuplicatedBlock{}, nil
+	}
+
+	// Keep the shared fingerprints only, so the memory depends on the amount of the duplicated code
+	blobFingerprints := make(map[string][]Fingerprint)
+	hashBlobs := make(map[uint64][]string)
+
+	s := bleve.NewSearchRequest(bleve.NewMatchAllQuery())
+	s.Size = REPORT_SCAN_SIZE
+	s.Fields = []string{"fingerprints"}
+
+	err = b.handleSearch(fpClient, s, func(searchResult *bleve.SearchResult) {
+		for _, hit := range searchResult.Hits {
+			fingerprints := []Fingerprint{}
+			hashes := make(map[uint64]struct{})
+
+			for _, f := range decodeFingerprints(fieldString(hit.Fields["fingerprints"])) {
+				if _, ok := shared[fingerprintHash(f.Hash)]; !ok {
+					continue
+				}
+				fingerprints = append(fingerprints, f)
+				if _, ok := hashes[f.Hash]; !ok {
+					hashes[f.Hash] = struct{}{}
+					hashBlobs[f.Hash] = append(hashBlobs[f.Hash], hit.ID)
+				}
+			}
+
+			if len(fingerprints) > 0 {
+				blobFingerprints[hit.ID] = fingerprints
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make(map[[2]string]int)
+	for _, blobs := range hashBlobs {
+		for i := range blobs {
+			for j := i + 1; j < len(blobs); j++ {
+				pairs[blobPair(blobs[i], blobs[j])]++
+			}
+		}
+	}
+
+	// The locations are resolved before pairing, so the versions of the same file,
+	// e.g. on the other branches, and the stale blobs without locations aren't reported.
+	blobLocations := make(map[string][]Metadata)
+	locationsOf := func(blob string) ([]Metadata, error) {
+		if locations, ok := blobLocations[blob]; ok {
+			return locations, nil
+		}
+		files, err := searchBlobLocations(client, blob, FilterParams{}, REPORT_LOCATION_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		locations := toMetadataList(files)
+		blobLocations[blob] = locations
+		return locations, nil
+	}
+
+	blocks := DuplicatedBlocks{}
+	for pair, count := range pairs {
+		if count < REPORT_MIN_SHARED_HASHES {
+			continue
+		}
+
+		locationsA, err := locationsOf(pair[0])
+		if err != nil {
+			return nil, err
+		}
+		locationsB, err := locationsOf(pair[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(locationsA) == 0 || len(locationsB) == 0 || isSameFile(locationsA, locationsB) {
+			continue
+		}
+
+		hashesA := make(map[uint64]struct{})
+		for _, f := range blobFingerprints[pair[0]] {
+			hashesA[f.Hash] = struct{}{}
+		}
+		common := make(map[uint64]struct{})
+		for _, f := range blobFingerprints[pair[1]] {
+			if _, ok := hashesA[f.Hash]; ok {
+				common[f.Hash] = struct{}{}
+			}
+		}
+
+		_, linesA := matchFingerprints(common, blobFingerprints[pair[0]])
+		_, linesB := matchFingerprints(common, blobFingerprints[pair[1]])
+
+		duplicatedLines := countRangeLines(linesA)
+		if l := countRangeLines(linesB); l < duplicatedLines {
+			duplicatedLines = l
+		}
+
+		blocks = append(blocks, DuplicatedBlock{
+			DuplicatedLines: duplicatedLines,
+			Files: []DuplicatedFile{
+				{Blob: pair[0], Lines: linesA, Locations: locationsA},
+				{Blob: pair[1], Lines: linesB, Locations: locationsB},
+			},
+		})
+	}
+
+	sort.Sort(blocks)
+
+	if len(blocks) > size {
+		blocks = blocks[:size]
+	}
+
+	return blocks, nil
+}
+
+// isSameFile reports whether all locations are the same path of the same repository.
+func isSameFile(locationsA []Metadata, locationsB []Metadata) bool {
+	first := locationsA[0]
+	for _, l := range append(append([]Metadata{}, locationsA...), locationsB...) {
+		if l.Organization != first.Organization || l.Project != first.Project ||
+			l.Repository != first.Repository || l.Path != first.Path {
+			return false
+		}
+	}
+	return true
+}
+
+func blobPair(a, b string) [2]string {
+	if a < b {
+		return [2]string{a, b}
+	}
+	return [2]string{b, a}
+}
+
+func toMetadataList(files []FileIndex) []Metadata {
+	list := []Metadata{}
+	for _, f := range files {
+		list = append(list, f.Metadata)
+	}
+	return list
+}
@@ -0,0 +1,92 @@
+package indexer
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/wadahiro/gitss/server/util"
+)
+
+// The max number of the search results in the cache
+const SEARCH_CACHE_SIZE = 256
+
+// searchCache caches the search results with the previews.
+// The key has the generation of the index, and the generation is incremented after each write.
+// So the results of the old generation are never returned even if they remain in the cache.
+type searchCache struct {
+	cache      *util.LRUCache
+	capacity   int
+	generation uint64
+	updated    int64
+	hits       uint64
+	misses     uint64
+}
+
+func newSearchCache(capacity int) *searchCache {
+	return &searchCache{cache: util.NewLRUCache(capacity, 0), capacity: capacity}
+}
+
+type searchCacheKey struct {
+	Generation   uint64        `json:"generation"`
+	Query        string        `json:"query"`
+	FilterParams FilterParams  `json:"filterParams"`
+	Page         int           `json:"page"`
+	Options      SearchOptions `json:"options"`
+}
+
+// key makes the cache key with the current generation.
+func (s *searchCache) key(query string, filterParams FilterParams, page int, options SearchOptions) string {
+	key, _ := json.Marshal(searchCacheKey{Generation: atomic.LoadUint64(&s.generation), Query: query, FilterParams: filterParams, Page: page, Options: options})
+	return string(key)
+}
+
+func (s *searchCache) Get(key string) (SearchResult, bool) {
+	cached, ok := s.cache.Get(key)
+	if !ok {
+		atomic.AddUint64(&s.misses, 1)
+		return SearchResult{}, false
+	}
+	atomic.AddUint64(&s.hits, 1)
+
+	// Copy the hits since the caller can append to them
+	result := cached.(SearchResult)
+	result.Hits = append([]Hit{}, result.Hits...)
+	return result, true
+}
+
+func (s *searchCache) Add(key string, result SearchResult) {
+	s.cache.Add(key, result)
+}
+
+// Invalidate increments the generation. The cached results are purged to release the memory.
+func (s *searchCache) Invalidate() {
+	atomic.AddUint64(&s.generation, 1)
+	atomic.StoreInt64(&s.updated, time.Now().UnixNano())
+	s.cache.Purge()
+}
+
+func (s *searchCache) Stats() SearchCacheStats {
+	hits := atomic.LoadUint64(&s.hits)
+	misses := atomic.LoadUint64(&s.misses)
+
+	stats := SearchCacheStats{
+		Generation: atomic.LoadUint64(&s.generation),
+		Size:       s.cache.Len(),
+		Capacity:   s.capacity,
+		Hits:       hits,
+		Misses:     misses,
+	}
+	if updated := atomic.LoadInt64(&s.updated); updated > 0 {
+		t := time.Unix(0, updated)
+		stats.Updated = &t
+	}
+	if hits+misses > 0 {
+		stats.HitRate = float64(hits) / float64(hits+misses)
+	}
+	return stats
+}
+
+func (b *BleveIndexer) SearchCacheStats() SearchCacheStats {
+	return b.searchCache.Stats()
+}
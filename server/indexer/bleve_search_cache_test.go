@@ -0,0 +1,48 @@
+package indexer
+
+import (
+	"testing"
+)
+
+func TestSearchCache(t *testing.T) {
+	s := newSearchCache(10)
+
+	key := s.key("foo", FilterParams{Organizations: []string{"org"}}, 0, SearchOptions{})
+	if _, ok := s.Get(key); ok {
+		t.Errorf("got cached, want missing")
+	}
+
+	s.Add(key, SearchResult{Query: "foo", Hits: []Hit{Hit{ID: "a"}}})
+
+	result, ok := s.Get(s.key("foo", FilterParams{Organizations: []string{"org"}}, 0, SearchOptions{}))
+	if !ok || result.Query != "foo" {
+		t.Errorf("got %v, want cached", result)
+	}
+
+	// The cached hits aren't changed by the caller
+	result.Hits = append(result.Hits, Hit{ID: "b"})
+	result, _ = s.Get(key)
+	if len(result.Hits) != 1 {
+		t.Errorf("got %v, want %v", len(result.Hits), 1)
+	}
+
+	if _, ok := s.Get(s.key("foo", FilterParams{}, 0, SearchOptions{})); ok {
+		t.Errorf("got cached, want missing for the other filter")
+	}
+	if _, ok := s.Get(s.key("foo", FilterParams{Organizations: []string{"org"}}, 1, SearchOptions{})); ok {
+		t.Errorf("got cached, want missing for the other page")
+	}
+
+	s.Invalidate()
+	if _, ok := s.Get(s.key("foo", FilterParams{Organizations: []string{"org"}}, 0, SearchOptions{})); ok {
+		t.Errorf("got cached, want missing after invalidation")
+	}
+
+	stats := s.Stats()
+	if stats.Generation != 1 || stats.Hits != 2 || stats.Misses != 4 || stats.Size != 0 {
+		t.Errorf("got %+v, want generation 1, 2 hits and 4 misses", stats)
+	}
+	if stats.HitRate != float64(2)/6 {
+		t.Errorf("got %v, want %v", stats.HitRate, float64(2)/6)
+	}
+}
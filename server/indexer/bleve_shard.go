@@ -0,0 +1,461 @@
+package indexer
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/document"
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search"
+	"github.com/pkg/errors"
+)
+
+// The shard modes. The index is split per organization or per repository.
+const SHARD_ORGANIZATION = "organization"
+const SHARD_REPOSITORY = "repository"
+
+var ErrIndexNotSharded = errors.New("The index isn't sharded. Set --shard option to use the sharded index")
+
+// COMPLETE_FACET_FIELDS are the fields of the facets used for the repository groups and the hierarchy.
+// All terms of them are collected from each shard, so the merged counts are exact.
+// The other facets are merged from the top terms of each shard, so their counts can be approximate.
+var COMPLETE_FACET_FIELDS = map[string]bool{"fullRefs": true, "organization": true, "project": true, "repository": true}
+
+// bleveShard is the index of an organization or a repository in the sharded mode.
+// A dropped shard is closed and removed when the last request using it is done.
+type bleveShard struct {
+	key     string
+	path    string
+	index   bleve.Index
+	refs    int
+	dropped bool
+}
+
+func (b *BleveIndexer) shardKey(organization string, project string, repository string) string {
+	if b.shardMode == SHARD_ORGANIZATION {
+		return organization
+	}
+	return organization + "/" + project + "/" + repository
+}
+
+// shardKeyOfDocID finds the shard from the document ID, "organization:project:repository:blob:path".
+func (b *BleveIndexer) shardKeyOfDocID(docID string) string {
+	ids := strings.SplitN(docID, ":", 4)
+	if len(ids) < 4 {
+		return ""
+	}
+	return b.shardKey(ids[0], ids[1], ids[2])
+}
+
+// initShards opens the existing shards under the shards directory.
+func (b *BleveIndexer) initShards() error {
+	var m mapping.IndexMappingImpl
+	if err := json.Unmarshal(MAPPING, &m); err != nil {
+		return errors.Wrapf(err, "error unmarshalling mapping")
+	}
+	b.shardMapping = &m
+	b.shards = make(map[string]*bleveShard)
+
+	pattern := "*"
+	if b.shardMode == SHARD_REPOSITORY {
+		pattern = "*/*/*"
+	}
+	metas, err := filepath.Glob(filepath.Join(b.shardsPath, pattern, "index_meta.json"))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to find the shards in %s", b.shardsPath)
+	}
+
+	for _, meta := range metas {
+		path := filepath.Dir(meta)
+		key, err := filepath.Rel(b.shardsPath, path)
+		if err != nil {
+			continue
+		}
+		key = filepath.ToSlash(key)
+		index, err := initIndex(path, MAPPING)
+		if err != nil {
+			return err
+		}
+		b.shards[key] = &bleveShard{key: key, path: path, index: index}
+	}
+	return nil
+}
+
+// openShards makes the alias of the all shards for a request. The shards are kept open until the alias is closed.
+func (b *BleveIndexer) openShards() (bleve.Index, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, ErrIndexClosed
+	}
+
+	shards := map[string]*bleveShard{}
+	keys := []string{}
+	for key, shard := range b.shards {
+		shard.refs++
+		shards[key] = shard
+		keys = append(keys, key)
+	}
+	sort.Sort(sort.StringSlice(keys))
+
+	indexes := []bleve.Index{}
+	for _, key := range keys {
+		indexes = append(indexes, shards[key].index)
+	}
+	b.inFlight.Add(1)
+
+	s := &shardedIndex{bleveIndex: bleve.NewIndexAlias(indexes...), shards: shards, keyOf: b.shardKeyOfDocID, mapping: b.shardMapping}
+	s.release = func() {
+		b.releaseShards(shards)
+		b.inFlight.Done()
+	}
+	return s, nil
+}
+
+// openWriter opens the index to write the documents of the repository. The shard is created if it doesn't exist.
+func (b *BleveIndexer) openWriter(organization string, project string, repository string) (bleve.Index, error) {
+	if b.shardMode == "" {
+		return b.open()
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, ErrIndexClosed
+	}
+
+	key := b.shardKey(organization, project, repository)
+	shard, ok := b.shards[key]
+	if !ok {
+		path := filepath.Join(b.shardsPath, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, errors.Wrapf(err, "Failed to make the shard directory %s", path)
+		}
+		index, err := newIndex(path, MAPPING)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create the shard %s", key)
+		}
+		shard = &bleveShard{key: key, path: path, index: index}
+		b.shards[key] = shard
+	}
+	shard.refs++
+	b.inFlight.Add(1)
+
+	return &sharedIndex{bleveIndex: shard.index, release: func() {
+		b.releaseShards(map[string]*bleveShard{key: shard})
+		b.inFlight.Done()
+	}}, nil
+}
+
+func (b *BleveIndexer) releaseShards(shards map[string]*bleveShard) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, shard := range shards {
+		shard.refs--
+		if shard.dropped && shard.refs == 0 {
+			if err := removeShard(shard); err != nil {
+				log.Printf("Failed to remove the shard %s. %+v", shard.key, err)
+			}
+		}
+	}
+}
+
+func removeShard(shard *bleveShard) error {
+	if err := shard.index.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(shard.path)
+}
+
+// groupByShard splits the operations per shard keeping the order. All operations are in a group if the index isn't sharded.
+func (b *BleveIndexer) groupByShard(operations []FileIndexOperation) [][]FileIndexOperation {
+	if b.shardMode == "" {
+		return [][]FileIndexOperation{operations}
+	}
+
+	groups := [][]FileIndexOperation{}
+	positions := map[string]int{}
+	for _, op := range operations {
+		m := op.FileIndex.Metadata
+		key := b.shardKey(m.Organization, m.Project, m.Repository)
+		pos, ok := positions[key]
+		if !ok {
+			pos = len(groups)
+			positions[key] = pos
+			groups = append(groups, []FileIndexOperation{})
+		}
+		groups[pos] = append(groups[pos], op)
+	}
+	return groups
+}
+
+// DropShard removes the shard of the repository, or of the organization in the organization mode.
+// The requests using the shard can finish, and the shard is removed after them.
+func (b *BleveIndexer) DropShard(organization string, project string, repository string) error {
+	if b.shardMode == "" {
+		return ErrIndexNotSharded
+	}
+
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	defer b.searchCache.Invalidate()
+
+	blobs, err := b.dropShard(b.shardKey(organization, project, repository))
+	if err != nil {
+		return err
+	}
+
+	// The fingerprint index isn't sharded, so the fingerprints of the blobs only in the dropped shard are removed
+	return b.removeFingerprints(blobs)
+}
+
+// dropShard detaches the shard and returns its blobs.
+func (b *BleveIndexer) dropShard(key string) (map[string]struct{}, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, ErrIndexClosed
+	}
+
+	shard, ok := b.shards[key]
+	if !ok {
+		return nil, nil
+	}
+
+	blobs := make(map[string]struct{})
+	dict, err := shard.index.FieldDict("blob")
+	if err != nil {
+		return nil, err
+	}
+	for entry, err := dict.Next(); err == nil && entry != nil; entry, err = dict.Next() {
+		blobs[entry.Term] = struct{}{}
+	}
+	dict.Close()
+
+	delete(b.shards, key)
+	shard.dropped = true
+
+	if shard.refs == 0 {
+		return blobs, removeShard(shard)
+	}
+	return blobs, nil
+}
+
+func (b *BleveIndexer) closeShards() error {
+	var closeErr error
+	for _, shard := range b.shards {
+		if err := shard.index.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+// shardedIndex is the alias of the shards for a request.
+// The searches run on the shards in parallel and the results are merged by bleve.IndexAlias.
+// The methods which bleve.IndexAlias supports for a single index only are routed or merged here.
+type shardedIndex struct {
+	bleveIndex
+	shards  map[string]*bleveShard
+	keyOf   func(docID string) string
+	mapping mapping.IndexMapping
+	once    sync.Once
+	release func()
+}
+
+func (s *shardedIndex) Close() error {
+	s.once.Do(s.release)
+	return nil
+}
+
+// shardIndex returns the shard having the document, or nil.
+func (s *shardedIndex) shardIndex(docID string) bleve.Index {
+	shard, ok := s.shards[s.keyOf(docID)]
+	if !ok {
+		return nil
+	}
+	return shard.index
+}
+
+func (s *shardedIndex) Document(id string) (*document.Document, error) {
+	i := s.shardIndex(id)
+	if i == nil {
+		return nil, nil
+	}
+	return i.Document(id)
+}
+
+func (s *shardedIndex) DocCount() (uint64, error) {
+	var count uint64
+	for _, shard := range s.shards {
+		c, err := shard.index.DocCount()
+		if err != nil {
+			return 0, err
+		}
+		count += c
+	}
+	return count, nil
+}
+
+func (s *shardedIndex) Mapping() mapping.IndexMapping {
+	return s.mapping
+}
+
+func (s *shardedIndex) Search(req *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	if len(s.shards) == 0 {
+		return emptySearchResult(req), nil
+	}
+	if len(s.shards) == 1 || len(req.Facets) == 0 {
+		return s.bleveIndex.Search(req)
+	}
+
+	// Collect more facet terms from each shard, then trim the merged facets to the requested size
+	shardReq := *req
+	shardReq.Facets = bleve.FacetsRequest{}
+	for name, facet := range req.Facets {
+		f := *facet
+		if COMPLETE_FACET_FIELDS[facet.Field] {
+			// The number of the merged terms covers the terms of any shard
+			f.Size = countFieldTerms(s, facet.Field, GROUP_FACET_SIZE)
+		} else {
+			f.Size = shardFacetSize(facet.Size)
+		}
+		shardReq.Facets[name] = &f
+	}
+
+	result, err := s.bleveIndex.Search(&shardReq)
+	if err != nil {
+		return nil, err
+	}
+	for name, facet := range req.Facets {
+		result.Facets.Fixup(name, facet.Size)
+	}
+	result.Request = req
+
+	return result, nil
+}
+
+// shardFacetSize is the number of the facet terms collected from a shard.
+// A term out of the top terms of a shard can be in the top terms of the merged facet, so it's larger than the requested size.
+func shardFacetSize(size int) int {
+	return size + size/2 + 10
+}
+
+// isFacetsApproximate reports whether the merged facets can have approximate counts.
+// It's true if a facet out of COMPLETE_FACET_FIELDS had more terms than collected from the shards.
+func isFacetsApproximate(client bleve.Index, facets search.FacetResults) bool {
+	s, ok := client.(*shardedIndex)
+	if !ok || len(s.shards) < 2 {
+		return false
+	}
+	for _, facet := range facets {
+		if !COMPLETE_FACET_FIELDS[facet.Field] && len(facet.Terms) > 0 && facet.Other > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func emptySearchResult(req *bleve.SearchRequest) *bleve.SearchResult {
+	facets := search.FacetResults{}
+	for name, facet := range req.Facets {
+		facets[name] = &search.FacetResult{Field: facet.Field, Terms: search.TermFacets{}}
+	}
+	return &bleve.SearchResult{Status: &bleve.SearchStatus{}, Request: req, Hits: search.DocumentMatchCollection{}, Facets: facets}
+}
+
+func (s *shardedIndex) FieldDict(field string) (index.FieldDict, error) {
+	return s.mergeFieldDicts(func(i bleve.Index) (index.FieldDict, error) {
+		return i.FieldDict(field)
+	})
+}
+
+func (s *shardedIndex) FieldDictPrefix(field string, termPrefix []byte) (index.FieldDict, error) {
+	return s.mergeFieldDicts(func(i bleve.Index) (index.FieldDict, error) {
+		return i.FieldDictPrefix(field, termPrefix)
+	})
+}
+
+func (s *shardedIndex) mergeFieldDicts(open func(i bleve.Index) (index.FieldDict, error)) (index.FieldDict, error) {
+	m := &mergedFieldDict{}
+	for _, shard := range s.shards {
+		dict, err := open(shard.index)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		entry, err := dict.Next()
+		if err != nil {
+			dict.Close()
+			m.Close()
+			return nil, err
+		}
+		m.dicts = append(m.dicts, dict)
+		m.current = append(m.current, entry)
+	}
+	return m, nil
+}
+
+// mergedFieldDict merges the sorted term dictionaries of the shards. The counts of the same term are summed.
+type mergedFieldDict struct {
+	dicts   []index.FieldDict
+	current []*index.DictEntry
+}
+
+func (m *mergedFieldDict) Next() (*index.DictEntry, error) {
+	var min *index.DictEntry
+	for _, entry := range m.current {
+		if entry != nil && (min == nil || entry.Term < min.Term) {
+			min = entry
+		}
+	}
+	if min == nil {
+		return nil, nil
+	}
+
+	merged := &index.DictEntry{Term: min.Term}
+	for i, entry := range m.current {
+		if entry != nil && entry.Term == merged.Term {
+			merged.Count += entry.Count
+
+			next, err := m.dicts[i].Next()
+			if err != nil {
+				return nil, err
+			}
+			m.current[i] = next
+		}
+	}
+	return merged, nil
+}
+
+func (m *mergedFieldDict) Close() error {
+	var closeErr error
+	for _, dict := range m.dicts {
+		if err := dict.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+// documentIndex returns the index having the document, which is the shard in the sharded mode.
+// It's used for the index level statistics of a document since bleve.IndexAlias doesn't support Advanced.
+func documentIndex(client bleve.Index, docID string) bleve.Index {
+	if s, ok := client.(*shardedIndex); ok {
+		if i := s.shardIndex(docID); i != nil {
+			return i
+		}
+	}
+	return client
+}
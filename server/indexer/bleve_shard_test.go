@@ -0,0 +1,107 @@
+package indexer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve/index"
+)
+
+type sliceFieldDict struct {
+	entries []*index.DictEntry
+}
+
+func (s *sliceFieldDict) Next() (*index.DictEntry, error) {
+	if len(s.entries) == 0 {
+		return nil, nil
+	}
+	entry := s.entries[0]
+	s.entries = s.entries[1:]
+	return entry, nil
+}
+
+func (s *sliceFieldDict) Close() error {
+	return nil
+}
+
+func TestMergedFieldDict(t *testing.T) {
+	dicts := []index.FieldDict{
+		&sliceFieldDict{entries: []*index.DictEntry{{Term: "a", Count: 1}, {Term: "c", Count: 2}}},
+		&sliceFieldDict{entries: []*index.DictEntry{}},
+		&sliceFieldDict{entries: []*index.DictEntry{{Term: "b", Count: 3}, {Term: "c", Count: 4}}},
+	}
+
+	m := &mergedFieldDict{}
+	for _, dict := range dicts {
+		entry, _ := dict.Next()
+		m.dicts = append(m.dicts, dict)
+		m.current = append(m.current, entry)
+	}
+
+	got := []index.DictEntry{}
+	for {
+		entry, err := m.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			break
+		}
+		got = append(got, *entry)
+	}
+
+	want := []index.DictEntry{{Term: "a", Count: 1}, {Term: "b", Count: 3}, {Term: "c", Count: 6}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	b := &BleveIndexer{shardMode: SHARD_REPOSITORY}
+	if got := b.shardKeyOfDocID("org:proj:repo:0123:src/a:b.go"); got != "org/proj/repo" {
+		t.Errorf("got %v, want %v", got, "org/proj/repo")
+	}
+
+	b = &BleveIndexer{shardMode: SHARD_ORGANIZATION}
+	if got := b.shardKeyOfDocID("org:proj:repo:0123:src/a.go"); got != "org" {
+		t.Errorf("got %v, want %v", got, "org")
+	}
+	if got := b.shardKeyOfDocID("0123"); got != "" {
+		t.Errorf("got %v, want empty", got)
+	}
+}
+
+func TestGroupByShard(t *testing.T) {
+	op := func(organization, project, repository, path string) FileIndexOperation {
+		f := FileIndex{}
+		f.Metadata.Organization = organization
+		f.Metadata.Project = project
+		f.Metadata.Repository = repository
+		f.Metadata.Path = path
+		return FileIndexOperation{Method: ADD, FileIndex: f}
+	}
+	operations := []FileIndexOperation{
+		op("org", "p", "r1", "a"),
+		op("org", "p", "r2", "b"),
+		op("org", "p", "r1", "c"),
+	}
+
+	b := &BleveIndexer{}
+	if got := b.groupByShard(operations); len(got) != 1 || len(got[0]) != 3 {
+		t.Errorf("got %v, want a group", got)
+	}
+
+	b = &BleveIndexer{shardMode: SHARD_REPOSITORY}
+	got := b.groupByShard(operations)
+	if len(got) != 2 || len(got[0]) != 2 || len(got[1]) != 1 {
+		t.Fatalf("got %v, want 2 groups", got)
+	}
+	if got[0][1].FileIndex.Metadata.Path != "c" {
+		t.Errorf("got %v, want %v", got[0][1].FileIndex.Metadata.Path, "c")
+	}
+
+	b = &BleveIndexer{shardMode: SHARD_ORGANIZATION}
+	if got := b.groupByShard(operations); len(got) != 1 {
+		t.Errorf("got %v, want a group", got)
+	}
+}
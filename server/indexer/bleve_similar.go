@@ -0,0 +1,179 @@
+package indexer
+
+import (
+	"math"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/pkg/errors"
+)
+
+// The parameters to select the characteristic terms of the document
+const SIMILAR_MAX_QUERY_TERMS = 25
+const SIMILAR_MIN_TERM_FREQ = 2
+const SIMILAR_MIN_DOC_FREQ = 2
+const SIMILAR_MIN_TERM_LENGTH = 3
+
+// The ratio of the query terms which the similar documents should have
+const SIMILAR_MIN_SHOULD_MATCH = 0.3
+
+type similarTerm struct {
+	Term  string
+	Score float64
+}
+
+type similarTerms []similarTerm
+
+func (s similarTerms) Len() int      { return len(s) }
+func (s similarTerms) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s similarTerms) Less(i, j int) bool {
+	if s[i].Score != s[j].Score {
+		return s[i].Score > s[j].Score
+	}
+	return s[i].Term < s[j].Term
+}
+
+// SearchSimilar finds the documents which have the similar content to the document.
+// The query is built from the content terms of the document weighted by tf-idf, and the documents of the same blob are excluded.
+func (b *BleveIndexer) SearchSimilar(docID string, filterParams FilterParams, page int) (SimilarResult, error) {
+	result := SimilarResult{
+		Doc:          docID,
+		FilterParams: filterParams,
+		Terms:        []string{},
+		Hits:         []Hit{},
+		Limit:        10,
+		Current:      page,
+	}
+
+	client, err := b.open()
+	if err != nil {
+		return result, err
+	}
+	defer client.Close()
+
+	start := time.Now()
+
+	doc, err := client.Document(docID)
+	if err != nil {
+		return result, err
+	}
+	if doc == nil {
+		return result, errors.Errorf("Not found document: %s", docID)
+	}
+	fileIndex := docToFileIndex(doc)
+
+	terms, err := selectSimilarTerms(documentIndex(client, docID), docID)
+	if err != nil {
+		return result, err
+	}
+
+	if len(terms) > 0 {
+		queries := []query.Query{}
+		for _, term := range terms {
+			tq := bleve.NewTermQuery(term.Term)
+			tq.SetField("content")
+			tq.SetBoost(term.Score / terms[0].Score)
+			queries = append(queries, tq)
+
+			result.Terms = append(result.Terms, term.Term)
+		}
+
+		dq := bleve.NewDisjunctionQuery(queries...)
+		dq.SetMin(math.Ceil(float64(len(queries)) * SIMILAR_MIN_SHOULD_MATCH))
+
+		sameBlob := bleve.NewTermQuery(fileIndex.Blob)
+		sameBlob.SetField("blob")
+
+		q := bleve.NewBooleanQuery()
+		q.AddMust(appendFilterParams(dq, filterParams))
+		q.AddMustNot(sameBlob)
+
+		s := bleve.NewSearchRequestOptions(q, 10, page*10, false)
+		s.IncludeLocations = true
+
+		searchResults, err := client.Search(s)
+		if err != nil {
+			return result, err
+		}
+
+		result.Hits = b.toHits(client, searchResults.Hits)
+		result.Size = int64(searchResults.Total)
+	}
+
+	end := time.Now()
+	result.Time = (end.Sub(start)).Seconds()
+
+	return result, nil
+}
+
+// selectSimilarTerms selects the characteristic content terms of the document from the term vectors.
+// The terms are scored by tf-idf, and the rare terms in the document or the unique terms in the index are ignored.
+func selectSimilarTerms(client bleve.Index, docID string) (similarTerms, error) {
+	i, _, err := client.Advanced()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := i.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	internalID, err := reader.InternalID(docID)
+	if err != nil {
+		return nil, err
+	}
+	if internalID == nil {
+		return nil, errors.Errorf("Not found document: %s", docID)
+	}
+
+	fieldTerms, err := reader.DocumentFieldTerms(internalID, []string{"content"})
+	if err != nil {
+		return nil, err
+	}
+
+	docCount, err := reader.DocCount()
+	if err != nil {
+		return nil, err
+	}
+
+	terms := similarTerms{}
+
+	for _, term := range fieldTerms["content"] {
+		if utf8.RuneCountInString(term) < SIMILAR_MIN_TERM_LENGTH {
+			continue
+		}
+
+		tfr, err := reader.TermFieldReader([]byte(term), "content", true, false, false)
+		if err != nil {
+			return nil, err
+		}
+		docFreq := tfr.Count()
+		tfd, err := tfr.Advance(internalID, nil)
+		tfr.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if tfd == nil || !tfd.ID.Equals(internalID) {
+			continue
+		}
+		if tfd.Freq < SIMILAR_MIN_TERM_FREQ || docFreq < SIMILAR_MIN_DOC_FREQ {
+			continue
+		}
+
+		idf := 1 + math.Log(float64(docCount)/float64(docFreq+1))
+		terms = append(terms, similarTerm{Term: term, Score: float64(tfd.Freq) * idf})
+	}
+
+	sort.Sort(terms)
+
+	if len(terms) > SIMILAR_MAX_QUERY_TERMS {
+		terms = terms[:SIMILAR_MAX_QUERY_TERMS]
+	}
+	return terms, nil
+}
@@ -0,0 +1,331 @@
+package indexer
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve"
+	"github.com/wadahiro/gitss/server/util"
+)
+
+const SUGGESTION_SIZE = 5
+const SUGGESTION_CANDIDATE_SIZE = 5
+
+const SUGGEST_SIZE = 10
+
+// The number of the facet terms collected for the scoped suggestions.
+// The facet counts all terms of the matched documents, so it's large enough to include the terms by the prefix.
+const SUGGEST_FACET_SIZE = 100000
+const SUGGEST_CACHE_SIZE = 256
+const SUGGEST_CACHE_TTL = time.Minute
+
+var QUERY_CHUNK_PATTERN = regexp.MustCompile(`\S+`)
+var QUERY_WORD_PATTERN = regexp.MustCompile(`[\p{L}\p{N}_]+`)
+
+type queryTerm struct {
+	Start int
+	End   int
+	Term  string
+}
+
+type termCandidate struct {
+	Term     string
+	Distance int
+	Count    uint64
+}
+
+type termCandidates []termCandidate
+
+func (t termCandidates) Len() int      { return len(t) }
+func (t termCandidates) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t termCandidates) Less(i, j int) bool {
+	if t[i].Distance != t[j].Distance {
+		return t[i].Distance < t[j].Distance
+	}
+	return t[i].Count > t[j].Count
+}
+
+// suggest finds the near terms of the misspelled query terms from the content field dictionary,
+// then returns the corrected query strings ranked by edit distance and frequency.
+func (b *BleveIndexer) suggest(client bleve.Index, queryString string) []Suggestion {
+	terms := extractQueryTerms(queryString)
+
+	candidatesList := make([]termCandidates, len(terms))
+	misspelled := false
+
+	for i := range terms {
+		term := analyzeTerm(client, "content", terms[i].Term)
+		if term == "" {
+			continue
+		}
+
+		candidates, exists, err := findNearTerms(client, "content", term)
+		if err != nil {
+			log.Printf("Failed to find near terms. %+v", err)
+			return nil
+		}
+		if exists || len(candidates) == 0 {
+			continue
+		}
+
+		candidatesList[i] = candidates
+		misspelled = true
+	}
+
+	if !misspelled {
+		return nil
+	}
+
+	suggestions := Suggestions{}
+	added := make(map[string]struct{})
+
+	addSuggestion := func(choices []int) {
+		s := Suggestion{}
+		replaced := make([]string, len(terms))
+		for i := range terms {
+			if candidatesList[i] == nil {
+				continue
+			}
+			c := candidatesList[i][choices[i]]
+			replaced[i] = c.Term
+			s.Distance += c.Distance
+			s.Count += c.Count
+		}
+		s.Query = replaceQueryTerms(queryString, terms, replaced)
+
+		if _, ok := added[s.Query]; !ok {
+			added[s.Query] = struct{}{}
+			suggestions = append(suggestions, s)
+		}
+	}
+
+	// The best candidates for all misspelled terms, then vary one term at a time
+	best := make([]int, len(terms))
+	addSuggestion(best)
+
+	for i := range terms {
+		for j := 1; j < len(candidatesList[i]); j++ {
+			choices := make([]int, len(terms))
+			choices[i] = j
+			addSuggestion(choices)
+		}
+	}
+
+	sort.Stable(suggestions)
+
+	if len(suggestions) > SUGGESTION_SIZE {
+		suggestions = suggestions[:SUGGESTION_SIZE]
+	}
+	return suggestions
+}
+
+// extractQueryTerms returns the plain terms in the query string.
+// Terms with field name (e.g. "path:foo") and operators are ignored.
+func extractQueryTerms(queryString string) []queryTerm {
+	terms := []queryTerm{}
+
+	for _, chunk := range QUERY_CHUNK_PATTERN.FindAllStringIndex(queryString, -1) {
+		text := queryString[chunk[0]:chunk[1]]
+		if strings.Contains(text, ":") {
+			continue
+		}
+		switch text {
+		case "AND", "OR", "NOT", "&&", "||":
+			continue
+		}
+
+		for _, word := range QUERY_WORD_PATTERN.FindAllStringIndex(text, -1) {
+			terms = append(terms, queryTerm{
+				Start: chunk[0] + word[0],
+				End:   chunk[0] + word[1],
+				Term:  text[word[0]:word[1]],
+			})
+		}
+	}
+	return terms
+}
+
+// replaceQueryTerms replaces the query terms which have non-empty replacement.
+func replaceQueryTerms(queryString string, terms []queryTerm, replaced []string) string {
+	var buf []string
+	pos := 0
+	for i := range terms {
+		if replaced[i] == "" {
+			continue
+		}
+		buf = append(buf, queryString[pos:terms[i].Start], replaced[i])
+		pos = terms[i].End
+	}
+	buf = append(buf, queryString[pos:])
+
+	return strings.Join(buf, "")
+}
+
+// analyzeTerm converts the query term to the indexed form using the analyzer of the field.
+// It returns empty string for the stop words.
+func analyzeTerm(client bleve.Index, field string, term string) string {
+	m := client.Mapping()
+	analyzer := m.AnalyzerNamed(m.AnalyzerNameForPath(field))
+	if analyzer == nil {
+		return strings.ToLower(term)
+	}
+
+	tokens := analyzer.Analyze([]byte(term))
+	if len(tokens) != 1 {
+		return ""
+	}
+	return string(tokens[0].Term)
+}
+
+// findNearTerms scans the field dictionary for the terms within the edit distance.
+// To keep the scan small, only the terms which start with the same character are checked.
+// It returns true as the second value if the term itself exists in the dictionary.
+func findNearTerms(client bleve.Index, field string, term string) (termCandidates, bool, error) {
+	length := utf8.RuneCountInString(term)
+	maxDistance := 2
+	if length <= 4 {
+		maxDistance = 1
+	}
+
+	first, _ := utf8.DecodeRuneInString(term)
+
+	dict, err := client.FieldDictPrefix(field, []byte(string(first)))
+	if err != nil {
+		return nil, false, err
+	}
+	defer dict.Close()
+
+	candidates := termCandidates{}
+
+	for entry, err := dict.Next(); err == nil && entry != nil; entry, err = dict.Next() {
+		if entry.Term == term {
+			return nil, true, nil
+		}
+
+		diff := utf8.RuneCountInString(entry.Term) - length
+		if diff > maxDistance || -diff > maxDistance {
+			continue
+		}
+
+		distance := util.LevenshteinDistance(term, entry.Term)
+		if distance <= maxDistance {
+			candidates = append(candidates, termCandidate{Term: entry.Term, Distance: distance, Count: entry.Count})
+		}
+	}
+
+	sort.Sort(candidates)
+
+	if len(candidates) > SUGGESTION_CANDIDATE_SIZE {
+		candidates = candidates[:SUGGESTION_CANDIDATE_SIZE]
+	}
+	return candidates, false, nil
+}
+
+// SuggestTerms returns the most frequent content terms, symbols and file basenames which start with the prefix.
+// The symbols and basenames are case-sensitive.
+func (b *BleveIndexer) SuggestTerms(prefix string, filterParams FilterParams) (SuggestResult, error) {
+	result := SuggestResult{
+		Prefix:       prefix,
+		FilterParams: filterParams,
+		Terms:        []SuggestTerm{},
+		Symbols:      []SuggestTerm{},
+		Files:        []SuggestTerm{},
+	}
+
+	if prefix == "" {
+		return result, nil
+	}
+
+	key, _ := json.Marshal(filterParams)
+	cacheKey := prefix + "\u0000" + string(key)
+
+	if cached, ok := b.suggestCache.Get(cacheKey); ok {
+		return cached.(SuggestResult), nil
+	}
+
+	client, err := b.open()
+	if err != nil {
+		return result, err
+	}
+	defer client.Close()
+
+	result.Terms, err = suggestFieldTerms(client, "content", strings.ToLower(prefix), filterParams)
+	if err != nil {
+		return result, err
+	}
+	result.Symbols, err = suggestFieldTerms(client, "symbols", prefix, filterParams)
+	if err != nil {
+		return result, err
+	}
+	result.Files, err = suggestFieldTerms(client, "basename", prefix, filterParams)
+	if err != nil {
+		return result, err
+	}
+
+	b.suggestCache.Add(cacheKey, result)
+
+	return result, nil
+}
+
+// suggestFieldTerms collects the terms from the field dictionary by the prefix.
+// The field dictionary is shared by all repositories, so the terms are counted by a search in the scope if it's specified.
+func suggestFieldTerms(client bleve.Index, field string, prefix string, filterParams FilterParams) (SuggestTerms, error) {
+	if filterParams.hasScope() {
+		return suggestScopedTerms(client, field, prefix, filterParams)
+	}
+
+	dict, err := client.FieldDictPrefix(field, []byte(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := SuggestTerms{}
+	for entry, err := dict.Next(); err == nil && entry != nil; entry, err = dict.Next() {
+		candidates = append(candidates, SuggestTerm{Term: entry.Term, Count: int(entry.Count)})
+	}
+	dict.Close()
+
+	sort.Sort(candidates)
+
+	if len(candidates) > SUGGEST_SIZE {
+		candidates = candidates[:SUGGEST_SIZE]
+	}
+	return candidates, nil
+}
+
+// suggestScopedTerms counts the terms by the prefix in the scope by a search with a terms facet on the field.
+// The facet has the other terms of the matched documents too, so they're skipped.
+func suggestScopedTerms(client bleve.Index, field string, prefix string, filterParams FilterParams) (SuggestTerms, error) {
+	pq := bleve.NewPrefixQuery(prefix)
+	pq.SetField(field)
+
+	s := bleve.NewSearchRequest(appendFilterParams(pq, filterParams))
+	s.Size = 0
+	s.AddFacet(field, bleve.NewFacetRequest(field, SUGGEST_FACET_SIZE))
+
+	searchResult, err := client.Search(s)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := SuggestTerms{}
+	if facet, ok := searchResult.Facets[field]; ok {
+		for _, term := range facet.Terms {
+			if strings.HasPrefix(term.Term, prefix) {
+				terms = append(terms, SuggestTerm{Term: term.Term, Count: term.Count})
+			}
+		}
+	}
+
+	sort.Sort(terms)
+
+	if len(terms) > SUGGEST_SIZE {
+		terms = terms[:SUGGEST_SIZE]
+	}
+	return terms, nil
+}
@@ -2,6 +2,7 @@ package indexer
 
 import (
 	"bytes"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/blevesearch/bleve/analysis"
@@ -93,6 +94,78 @@ func notFullRefToken(r rune, phase int) bool {
 	return true
 }
 
+// BasenameTokenizer makes one token of the last element of the path.
+type BasenameTokenizer struct {
+}
+
+func (t *BasenameTokenizer) Tokenize(input []byte) analysis.TokenStream {
+	start := bytes.LastIndex(input, []byte("/")) + 1
+	if start >= len(input) {
+		return analysis.TokenStream{}
+	}
+
+	return analysis.TokenStream{
+		&analysis.Token{
+			Term:     input[start:],
+			Position: 1,
+			Start:    start,
+			End:      len(input),
+			Type:     analysis.AlphaNumeric,
+		},
+	}
+}
+
+// IdentifierTokenizer splits the input into identifiers, which consist of letters, digits, '_' and '$'.
+// Unlike the standard analyzers, the case of the identifier is kept.
+type IdentifierTokenizer struct {
+}
+
+func (t *IdentifierTokenizer) Tokenize(input []byte) analysis.TokenStream {
+	rv := make(analysis.TokenStream, 0, 1024)
+
+	offset := 0
+	start := -1
+	count := 0
+
+	appendToken := func(end int) {
+		// ignore one character identifiers and numbers
+		r, _ := utf8.DecodeRune(input[start:])
+		if end-start > 1 && !unicode.IsDigit(r) {
+			rv = append(rv, &analysis.Token{
+				Term:     input[start:end],
+				Start:    start,
+				End:      end,
+				Position: count + 1,
+				Type:     analysis.AlphaNumeric,
+			})
+			count++
+		}
+		start = -1
+	}
+
+	for offset < len(input) {
+		currRune, size := utf8.DecodeRune(input[offset:])
+		if isIdentifierRune(currRune) {
+			if start < 0 {
+				start = offset
+			}
+		} else if start >= 0 {
+			appendToken(offset)
+		}
+		offset += size
+	}
+	// if we ended in the middle of a token, finish it
+	if start >= 0 {
+		appendToken(len(input))
+	}
+
+	return rv
+}
+
+func isIdentifierRune(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
 func PathHierarchyTokenizerConstructor(config map[string]interface{}, cache *registry.Cache) (analysis.Tokenizer, error) {
 	return &PathHierarchyTokenizer{}, nil
 }
@@ -101,7 +174,17 @@ func FullRefTokenizerConstructor(config map[string]interface{}, cache *registry.
 	return &FullRefTokenizer{}, nil
 }
 
+func BasenameTokenizerConstructor(config map[string]interface{}, cache *registry.Cache) (analysis.Tokenizer, error) {
+	return &BasenameTokenizer{}, nil
+}
+
+func IdentifierTokenizerConstructor(config map[string]interface{}, cache *registry.Cache) (analysis.Tokenizer, error) {
+	return &IdentifierTokenizer{}, nil
+}
+
 func init() {
 	registry.RegisterTokenizer("path_hierarchy", PathHierarchyTokenizerConstructor)
 	registry.RegisterTokenizer("full_ref", FullRefTokenizerConstructor)
+	registry.RegisterTokenizer("basename", BasenameTokenizerConstructor)
+	registry.RegisterTokenizer("identifier", IdentifierTokenizerConstructor)
 }
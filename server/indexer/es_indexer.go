@@ -1,18 +1,18 @@
 package indexer
 
 import (
-	// "bytes"
 	"encoding/json"
+	"fmt"
+	"log"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
-	// "fmt"
-	"log"
-	// "strings"
+
+	"github.com/pkg/errors"
 	"github.com/wadahiro/gitss/server/config"
 	"github.com/wadahiro/gitss/server/repo"
-
-	// "fmt"
+	"github.com/wadahiro/gitss/server/util"
 
 	"gopkg.in/olivere/elastic.v3"
 )
@@ -23,16 +23,36 @@ type ESIndexer struct {
 	debug  bool
 }
 
-// var LINE_TAG = regexp.MustCompile(`^\[([0-9]+)\]\s(.*)`)
+const ES_INDEX = "gosource"
+const ES_TYPE = "file"
+
+// The number of the documents updated by a bulk request when deleting the refs
+const ES_SCAN_SIZE = 100
+
+// The name of the aggregation for the fullRefs facet.
+// It has the nested terms aggregations of organization, project, repository and fullRefs.
+const ES_FULL_REFS_AGGREGATION = "fullRefsHierarchy"
+
+// ES_FACET_FIELDS are the fields of the terms aggregations for the facets. The keys are same as the bleve facets.
+var ES_FACET_FIELDS = map[string]string{
+	"fullRefs":     "fullRefs",
+	"ext":          "ext",
+	"organization": "organization.full",
+	"project":      "project.full",
+	"repository":   "repository.full",
+	"branches":     "branches",
+	"tags":         "tags",
+	"encoding":     "encoding",
+}
 
-func NewESIndexer(config *config.Config, reader *repo.GitRepoReader) Indexer {
-	client, err := elastic.NewClient(elastic.SetURL())
+func NewESIndexer(config *config.Config, reader *repo.GitRepoReader) (Indexer, error) {
+	client, err := elastic.NewClient(elastic.SetURL(config.ESURL))
 	if err != nil {
-		panic(err)
+		return nil, errors.Wrapf(err, "Failed to connect to Elasticsearch %s", config.ESURL)
 	}
 	i := &ESIndexer{client: client, reader: reader, debug: config.Debug}
 	i.Init()
-	return i
+	return i, nil
 }
 
 const PRE_TAG = "\u0001"
@@ -45,7 +65,7 @@ var CRLF_PATTERN = regexp.MustCompile(`\r?\n|\r`)
 func (esi *ESIndexer) Init() {
 
 	// esi.client.DeleteIndex("gosource").Do()
-	_, err := esi.client.CreateIndex("gosource").BodyString(`
+	_, err := esi.client.CreateIndex(ES_INDEX).BodyString(`
 {
 	settings: {
 		analysis: {
@@ -72,6 +92,11 @@ func (esi *ESIndexer) Init() {
 					type: "custom",
 					tokenizer: "path_tokenizer"
 				},
+				lowercase_keyword_analyzer: {
+					type: "custom",
+					tokenizer: "keyword",
+					filter: ["lowercase"]
+				},
 				kuromoji_analyzer: {
 					type: "custom",
 					tokenizer: "kuromoji_tokenizer",
@@ -95,12 +120,9 @@ func (esi *ESIndexer) Init() {
 					index: "not_analyzed"
 				},
 				organization: {
-					type: "multi_field",
+					type: "string",
+					index: "analyzed",
 					fields: {
-						organization: {
-							type: "string",
-							index: "analyzed"
-						},
 						full: {
 							type: "string",
 							index: "not_analyzed"
@@ -108,12 +130,9 @@ func (esi *ESIndexer) Init() {
 					}
 				},
 				project: {
-					type: "multi_field",
+					type: "string",
+					index: "analyzed",
 					fields: {
-						project: {
-							type: "string",
-							index: "analyzed"
-						},
 						full: {
 							type: "string",
 							index: "not_analyzed"
@@ -121,30 +140,26 @@ func (esi *ESIndexer) Init() {
 					}
 				},
 				repository: {
-					type: "multi_field",
+					type: "string",
+					index: "analyzed",
 					fields: {
-						repository: {
-							type: "string",
-							index: "analyzed"
-						},
 						full: {
 							type: "string",
 							index: "not_analyzed"
 						}
 					}
 				},
-				refs: {
-					type: "multi_field",
-					fields: {
-						refs: {
-							type: "string",
-							index: "analyzed"
-						},
-						full: {
-							type: "string",
-							index: "not_analyzed"
-						}
-					}
+				branches: {
+					type: "string",
+					index: "not_analyzed"
+				},
+				tags: {
+					type: "string",
+					index: "not_analyzed"
+				},
+				fullRefs: {
+					type: "string",
+					index: "not_analyzed"
 				},
 				path: {
 					type: "string",
@@ -154,10 +169,21 @@ func (esi *ESIndexer) Init() {
 					type: "string",
 					index: "not_analyzed"
 				},
+				size: {
+					type: "long"
+				},
+				encoding: {
+					type: "string",
+					analyzer: "lowercase_keyword_analyzer"
+				},
 				content: {
 					type: "string",
 					index_options: "offsets",
 					analyzer: "kuromoji_analyzer"
+				},
+				storedContent: {
+					type: "string",
+					index: "no"
 				}
 			}
 		}
@@ -174,9 +200,9 @@ func (e *ESIndexer) CreateFileIndex(requestFileIndex FileIndex) error {
 	fillFileIndex(&requestFileIndex)
 
 	_, err := e.client.Index().
-		Index("gosource").
-		Type("file").
-		Id(requestFileIndex.Blob).
+		Index(ES_INDEX).
+		Type(ES_TYPE).
+		Id(getDocId(&requestFileIndex)).
 		BodyJson(&requestFileIndex).
 		Refresh(true).
 		Do()
@@ -187,160 +213,603 @@ func (e *ESIndexer) CreateFileIndex(requestFileIndex FileIndex) error {
 	return nil
 }
 
-func (e *ESIndexer) BatchFileIndex(requestBatch []FileIndexOperation) error {
-	return nil
+func (e *ESIndexer) UpsertFileIndex(requestFileIndex FileIndex) error {
+	return e.BatchFileIndex([]FileIndexOperation{{Method: ADD, FileIndex: requestFileIndex}})
 }
 
-func (e *ESIndexer) DeleteIndexByRefs(organization string, project string, repository string, branches []string, tags []string) error {
-	return nil
+// esDoc is the state of a document while applying the operations of a batch.
+// The documents are loaded from the index without the content, so only their refs are updated.
+type esDoc struct {
+	fileIndex *FileIndex
+	// The document is in the index
+	found bool
+	// fileIndex is loaded from the index. It's false if fileIndex is from the request.
+	loaded  bool
+	changed bool
 }
 
-func (e *ESIndexer) UpsertFileIndex(requestFileIndex FileIndex) error {
-	fillFileIndex(&requestFileIndex)
+// BatchFileIndex merges the refs of the operations into the existing documents, then writes them by a bulk request.
+func (e *ESIndexer) BatchFileIndex(requestBatch []FileIndexOperation) error {
+	ids, docs, err := e.loadDocs(requestBatch)
+	if err != nil {
+		return err
+	}
 
-	get, err := e.client.Get().
-		Index("gosource").
-		Type("file").
-		Id(requestFileIndex.Blob).
-		Do()
+	for i := range requestBatch {
+		op := requestBatch[i]
+		f := op.FileIndex
+		doc := docs[getDocId(&f)]
+
+		switch op.Method {
+		case ADD:
+			if doc.fileIndex == nil {
+				fillFileIndex(&f)
+				doc.fileIndex = &f
+				doc.loaded = false
+				doc.changed = true
+				continue
+			}
+			same := mergeRef(doc.fileIndex, f.Metadata.Branches, f.Metadata.Tags)
+			if same {
+				if e.debug {
+					log.Println("Skipped index")
+				}
+				continue
+			}
+			doc.changed = true
+
+		case MERGE_REFS:
+			if doc.fileIndex == nil {
+				continue
+			}
+			if !mergeRef(doc.fileIndex, f.Metadata.Branches, f.Metadata.Tags) {
+				doc.changed = true
+			}
+
+		case DELETE:
+			if doc.fileIndex == nil {
+				continue
+			}
+			e.removeRef(doc, f.Metadata.Branches, f.Metadata.Tags)
+		}
+	}
+
+	return e.bulk(ids, docs)
+}
+
+// loadDocs gets the existing documents of the operations without the content.
+// It returns the document IDs in the order of the operations.
+func (e *ESIndexer) loadDocs(operations []FileIndexOperation) ([]string, map[string]*esDoc, error) {
+	ids := []string{}
+	docs := make(map[string]*esDoc)
+
+	mget := e.client.MultiGet()
+	for i := range operations {
+		id := getDocId(&operations[i].FileIndex)
+		if _, ok := docs[id]; ok {
+			continue
+		}
+		docs[id] = &esDoc{}
+		ids = append(ids, id)
+
+		mget.Add(elastic.NewMultiGetItem().
+			Index(ES_INDEX).
+			Type(ES_TYPE).
+			Id(id).
+			FetchSource(elastic.NewFetchSourceContext(true).Exclude("content")))
+	}
+
+	if len(ids) == 0 {
+		return ids, docs, nil
+	}
 
-	if err == nil && get.Found {
+	res, err := mget.Do()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to get the documents")
+	}
+
+	for _, got := range res.Docs {
+		doc, ok := docs[got.Id]
+		if !ok || !got.Found || got.Source == nil {
+			continue
+		}
 		var fileIndex FileIndex
-		if err := json.Unmarshal(*get.Source, &fileIndex); err != nil {
-			return err
+		if err := json.Unmarshal(*got.Source, &fileIndex); err != nil {
+			return nil, nil, errors.Wrapf(err, "Failed to read the document %s", got.Id)
 		}
+		doc.fileIndex = &fileIndex
+		doc.found = true
+		doc.loaded = true
+	}
+
+	return ids, docs, nil
+}
+
+// removeRef removes the refs from the document. The document is deleted if it doesn't have any refs.
+func (e *ESIndexer) removeRef(doc *esDoc, branches []string, tags []string) {
+	allRemoved := removeRef(doc.fileIndex, branches, tags)
+	if allRemoved {
+		doc.fileIndex = nil
+	} else {
+		fillFileIndex(doc.fileIndex)
+	}
+	doc.changed = true
+}
+
+// bulk writes the changed documents. The new documents are indexed, and the loaded documents are updated partially
+// because they don't have the content.
+// The index isn't refreshed. The documents are read by the realtime multi get, and they're searchable after the refresh interval.
+func (e *ESIndexer) bulk(ids []string, docs map[string]*esDoc) error {
+	bulk := e.client.Bulk().Index(ES_INDEX).Type(ES_TYPE)
 
-		same := mergeRef(&fileIndex, requestFileIndex.Metadata.Branches, requestFileIndex.Metadata.Tags)
+	for _, id := range ids {
+		doc := docs[id]
+		if !doc.changed {
+			continue
+		}
 
-		if same {
-			if e.debug {
-				log.Println("Skipped index")
+		switch {
+		case doc.fileIndex == nil:
+			if doc.found {
+				bulk.Add(elastic.NewBulkDeleteRequest().Id(id))
 			}
-			return nil
+		case doc.loaded:
+			bulk.Add(elastic.NewBulkUpdateRequest().Id(id).Doc(map[string]interface{}{
+				"branches": doc.fileIndex.Metadata.Branches,
+				"tags":     doc.fileIndex.Metadata.Tags,
+				"fullRefs": doc.fileIndex.FullRefs,
+			}))
+		default:
+			bulk.Add(elastic.NewBulkIndexRequest().Id(id).Doc(doc.fileIndex))
 		}
+	}
 
-		_, err := e.client.Update().
-			Index("gosource").
-			Type("file").
-			Id(requestFileIndex.Blob).
-			Doc(fileIndex).
-			Do()
+	if bulk.NumberOfActions() == 0 {
+		return nil
+	}
 
+	res, err := bulk.Do()
+	if err != nil {
+		return errors.Wrap(err, "Failed to call the bulk API")
+	}
+
+	failed := res.Failed()
+	if len(failed) > 0 {
+		reason := fmt.Sprintf("status: %d", failed[0].Status)
+		if failed[0].Error != nil {
+			reason = failed[0].Error.Type + ": " + failed[0].Error.Reason
+		}
+		return errors.Errorf("Failed to write %d documents. The first failure is %s (%s)", len(failed), failed[0].Id, reason)
+	}
+	if e.debug {
+		log.Printf("Wrote %d documents\n", len(res.Items))
+	}
+
+	return nil
+}
+
+// DeleteIndexByRefs removes the refs from the documents of the repository, and deletes the documents which don't have any refs.
+// The updated documents don't match the query anymore, so the first page is searched repeatedly after refreshing the index
+// until no documents are found. The number of the rounds is limited by the total hits of the first search.
+func (e *ESIndexer) DeleteIndexByRefs(organization string, project string, repository string, branches []string, tags []string) error {
+	refs := []elastic.Query{}
+	if len(branches) > 0 {
+		refs = append(refs, elastic.NewTermsQuery("branches", toInterfaces(branches)...))
+	}
+	if len(tags) > 0 {
+		refs = append(refs, elastic.NewTermsQuery("tags", toInterfaces(tags)...))
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	q := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("organization.full", organization),
+		elastic.NewTermQuery("project.full", project),
+		elastic.NewTermQuery("repository.full", repository),
+		elastic.NewBoolQuery().Should(refs...),
+	)
+
+	var rounds int64 = -1
+	for round := int64(0); rounds < 0 || round < rounds; round++ {
+		searchResult, err := e.client.Search().
+			Index(ES_INDEX).
+			Query(q).
+			FetchSourceContext(elastic.NewFetchSourceContext(true).Exclude("content")).
+			From(0).Size(ES_SCAN_SIZE).
+			Do()
 		if err != nil {
-			log.Println("Upsert Doc error", err)
-			return err
+			return errors.Wrapf(err, "Failed to search the documents of %s:%s/%s", organization, project, repository)
 		}
-		if e.debug {
-			log.Println("Updated index")
+		if searchResult.Hits == nil || len(searchResult.Hits.Hits) == 0 {
+			return nil
+		}
+		if rounds < 0 {
+			// one more round to confirm no documents are left
+			rounds = (searchResult.Hits.TotalHits+ES_SCAN_SIZE-1)/ES_SCAN_SIZE + 1
 		}
 
-	} else {
-		_, err := e.client.Index().
-			Index("gosource").
-			Type("file").
-			Id(requestFileIndex.Blob).
-			BodyJson(&requestFileIndex).
-			Refresh(true).
-			Do()
+		ids := []string{}
+		docs := make(map[string]*esDoc)
+		for _, hit := range searchResult.Hits.Hits {
+			var fileIndex FileIndex
+			if hit.Source == nil {
+				return errors.Errorf("The document %s doesn't have the source", hit.Id)
+			}
+			if err := json.Unmarshal(*hit.Source, &fileIndex); err != nil {
+				return errors.Wrapf(err, "Failed to read the document %s", hit.Id)
+			}
 
-		if err != nil {
-			log.Println("Add Doc error", err)
+			doc := &esDoc{fileIndex: &fileIndex, found: true, loaded: true}
+			e.removeRef(doc, branches, tags)
+
+			ids = append(ids, hit.Id)
+			docs[hit.Id] = doc
+		}
+
+		if err := e.bulk(ids, docs); err != nil {
 			return err
 		}
-		if e.debug {
-			log.Println("Added index")
+		if _, err := e.client.Refresh(ES_INDEX).Do(); err != nil {
+			return errors.Wrapf(err, "Failed to refresh the index")
 		}
 	}
 
-	return nil
+	return errors.Errorf("The documents of %s:%s/%s still have the refs after %d rounds", organization, project, repository, rounds)
 }
 
 func (e *ESIndexer) Count() (uint64, error) {
-	return 0, nil
+	count, err := e.client.Count(ES_INDEX).Do()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(count), nil
 }
 
-func (e *ESIndexer) SearchQuery(query string, filterParams FilterParams, page int) (SearchResult, error) {
+func (e *ESIndexer) SearchQuery(query string, filterParams FilterParams, page int, options SearchOptions) (SearchResult, error) {
+	if options.Group != "" {
+		return SearchResult{}, errors.New("Grouping is not supported by the elasticsearch indexer")
+	}
+	if options.Sort != "" {
+		return SearchResult{}, errors.New("Sorting is not supported by the elasticsearch indexer")
+	}
 	start := time.Now()
-	result := e.search(query)
+	result, err := e.search(query, filterParams, page)
+	if err != nil {
+		return SearchResult{}, err
+	}
 	end := time.Now()
 
 	result.Time = (end.Sub(start)).Seconds()
 	return result, nil
 }
 
+func (e *ESIndexer) SuggestTerms(prefix string, filterParams FilterParams) (SuggestResult, error) {
+	return SuggestResult{Prefix: prefix, FilterParams: filterParams, Terms: []SuggestTerm{}, Symbols: []SuggestTerm{}, Files: []SuggestTerm{}}, nil
+}
+
+func (e *ESIndexer) Explain(query string, filterParams FilterParams, page int) (ExplainResult, error) {
+	return ExplainResult{}, errors.New("Explain is not supported by the elasticsearch indexer")
+}
+
+func (e *ESIndexer) AggregateRefs(query string, organization string, project string, repository string) (RefAggregationResult, error) {
+	return RefAggregationResult{}, errors.New("AggregateRefs is not supported by the elasticsearch indexer")
+}
+
+func (e *ESIndexer) SearchSimilar(docID string, filterParams FilterParams, page int) (SimilarResult, error) {
+	return SimilarResult{}, errors.New("SearchSimilar is not supported by the elasticsearch indexer")
+}
+
+func (e *ESIndexer) SearchSnippet(snippet string, filterParams FilterParams) (SnippetResult, error) {
+	return SnippetResult{}, errors.New("SearchSnippet is not supported by the elasticsearch indexer")
+}
+
+func (e *ESIndexer) ReportDuplicates(size int) (DuplicateReport, error) {
+	return DuplicateReport{}, errors.New("ReportDuplicates is not supported by the elasticsearch indexer")
+}
+
+func (e *ESIndexer) FindBlob(blob string) (BlobResult, error) {
+	return BlobResult{}, errors.New("FindBlob is not supported by the elasticsearch indexer")
+}
+
+func (e *ESIndexer) GetPathHistory(organization string, project string, repository string, path string) (PathHistory, error) {
+	return PathHistory{}, errors.New("GetPathHistory is not supported by the elasticsearch indexer")
+}
+
+func (e *ESIndexer) Close() error {
+	e.client.Stop()
+	return nil
+}
+
+// SearchCacheStats returns the empty statistics since the elasticsearch indexer doesn't cache the search results.
+func (e *ESIndexer) SearchCacheStats() SearchCacheStats {
+	return SearchCacheStats{}
+}
+
+func (e *ESIndexer) DropShard(organization string, project string, repository string) error {
+	return errors.New("Sharding is not supported by the elasticsearch indexer")
+}
+
 func (e *ESIndexer) Exists(requestFileIndex FileIndex) (bool, error) {
-	return false, nil
+	return e.client.Exists().
+		Index(ES_INDEX).
+		Type(ES_TYPE).
+		Id(getDocId(&requestFileIndex)).
+		Do()
 }
 
-func (e *ESIndexer) search(query string) SearchResult {
-	// termQuery := elastic.NewTermsQuery("content", strings.Split(query, " "))
-	q := elastic.NewQueryStringQuery(query).DefaultField("content").DefaultOperator("AND")
-	searchResult, err := e.client.Search().
-		Index("gosource"). // search in index "twitter"
-		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("blob", "organization", "project", "repository", "refs", "path", "ext")).
-		Query(q). // specify the query
+// search returns the page of the hits and the facets. The query which can't be parsed results in ErrInvalidQuery.
+func (e *ESIndexer) search(queryString string, filterParams FilterParams, page int) (SearchResult, error) {
+	q, err := buildESQuery(queryString, filterParams)
+	if err != nil {
+		return SearchResult{}, errors.Wrapf(ErrInvalidQuery, "%v. query: %s", err, queryString)
+	}
+
+	s := e.client.Search().
+		Index(ES_INDEX).
+		Query(q).
 		Highlight(elastic.NewHighlight().Field("content").PreTags(PRE_TAG).PostTags(POST_TAG)).
-		Sort("path", true). // sort by "user" field, ascending
-		From(0).Size(10).   // take documents 0-9
-		Pretty(true).       // pretty print request and response JSON
-		Do()                // execute
+		From(page * 10).Size(10)
+
+	for name, agg := range esAggregations() {
+		s = s.Aggregation(name, agg)
+	}
 
+	searchResult, err := s.Do()
 	if err != nil {
-		log.Println("error", err)
-		return SearchResult{}
+		return SearchResult{}, errors.Wrapf(err, "Failed to search. query: %s", queryString)
 	}
 
-	list := []Hit{}
-	hitWordsSet := make(map[string]struct{})
+	return SearchResult{
+		Query:         queryString,
+		FilterParams:  filterParams,
+		Hits:          e.toHits(searchResult.Hits.Hits),
+		Size:          searchResult.Hits.TotalHits,
+		Limit:         10,
+		Current:       page,
+		Facets:        toESFacets(searchResult.Aggregations),
+		FullRefsFacet: toESFullRefsFacet(searchResult.Aggregations),
+	}, nil
+}
 
-	if searchResult.Hits.TotalHits > 0 {
-		for _, hit := range searchResult.Hits.Hits {
-			// hit.Index contains the name of the index
+// toHits makes the previews from the content in the source, or the file text in the git repository.
+func (e *ESIndexer) toHits(hits []*elastic.SearchHit) []Hit {
+	list := []Hit{}
 
-			// Deserialize hit.Source into a Tweet (could also be just a map[string]interface{}).
-			var s FileIndex
-			json.Unmarshal(*hit.Source, &s)
+	for _, hit := range hits {
+		var fileIndex FileIndex
+		if hit.Source == nil {
+			log.Println("No source? ID:" + hit.Id)
+			continue
+		}
+		if err := json.Unmarshal(*hit.Source, &fileIndex); err != nil {
+			log.Printf("Failed to read the document %s. %+v", hit.Id, err)
+			continue
+		}
 
-			// find highlighted words
-			hitWordsSet = mergeSet(hitWordsSet, getHitWords(ES_HIT_TAG, hit.Highlight["content"]))
+		// find highlighted words
+		hitWordSet := getHitWords(ES_HIT_TAG, hit.Highlight["content"])
 
-			// log.Println("hitWords", hitWordsSet)
+		filter := func(line string) bool {
+			for k := range hitWordSet {
+				if strings.Contains(strings.ToLower(line), strings.ToLower(k)) {
+					return true
+				}
+			}
+			return false
+		}
 
-			// get the file text
-			gitRepo, err := getGitRepo(e.reader, &s)
+		var preview []util.TextPreview
+		if fileIndex.Content != "" {
+			preview = util.FilterTextPreview(strings.NewReader(fileIndex.Content), filter, 3, 3)
+		} else {
+			gitRepo, err := getGitRepo(e.reader, &fileIndex)
 			if err != nil {
-				log.Println("Already deleted from git repository? blob:" + hit.Id)
+				log.Println("Already deleted from git repository? ID:" + hit.Id)
 				continue
 			}
+			preview = gitRepo.FilterBlob(fileIndex.Blob, fileIndex.Encoding, filter, 3, 3)
+		}
 
-			// make preview
-			preview := gitRepo.FilterBlob(s.Blob, s.Encoding, func(line string) bool {
-				for k, _ := range hitWordsSet {
-					if strings.Contains(line, k) {
-						log.Println(k)
-						return true
-					}
-				}
-				return false
-			}, 3, 3)
+		keyword := []string{}
+		for k := range hitWordSet {
+			keyword = append(keyword, k)
+		}
+		sort.Sort(sort.StringSlice(keyword))
+
+		h := Hit{Metadata: fileIndex.Metadata, ID: hit.Id, Preview: preview, Keyword: keyword}
+		list = append(list, h)
+	}
+
+	return list
+}
+
+// buildESQuery makes the query from the query string, then appends the filters which don't affect the scores.
+func buildESQuery(queryString string, filterParams FilterParams) (elastic.Query, error) {
+	// "size:" and "encoding:" are handled as filters
+	fullTextQuery, fieldFilterParams := ExtractFieldFilters(queryString, filterParams)
+
+	q := elastic.NewBoolQuery()
+	if fullTextQuery == "" {
+		q.Must(elastic.NewMatchAllQuery())
+	} else {
+		q.Must(elastic.NewQueryStringQuery(fullTextQuery).DefaultField("content").DefaultOperator("AND"))
+	}
+
+	appendESFilters(q, fieldFilterParams.Exts, "ext")
+	appendESFilters(q, fieldFilterParams.Organizations, "organization.full")
+	appendESFilters(q, fieldFilterParams.Projects, "project.full")
+	appendESFilters(q, fieldFilterParams.Repositories, "repository.full")
+	appendESFilters(q, fieldFilterParams.Branches, "branches")
+	appendESFilters(q, fieldFilterParams.Tags, "tags")
+
+	// The encodings are indexed in lower case
+	encodings := []string{}
+	for _, encoding := range fieldFilterParams.Encodings {
+		encodings = append(encodings, strings.ToLower(encoding))
+	}
+	appendESFilters(q, encodings, "encoding")
+
+	// All size filters must match
+	for _, size := range fieldFilterParams.Sizes {
+		if size == "" {
+			continue
+		}
+		r, err := ParseSizeRange(size)
+		if err != nil {
+			return nil, err
+		}
+		rq := elastic.NewRangeQuery("size")
+		if r.Min != nil {
+			if r.InclusiveMin {
+				rq.Gte(*r.Min)
+			} else {
+				rq.Gt(*r.Min)
+			}
+		}
+		if r.Max != nil {
+			if r.InclusiveMax {
+				rq.Lte(*r.Max)
+			} else {
+				rq.Lt(*r.Max)
+			}
+		}
+		q.Filter(rq)
+	}
+
+	return q, nil
+}
+
+// appendESFilters appends the terms filter. The document matches if it has any of the values.
+func appendESFilters(q *elastic.BoolQuery, list []string, field string) {
+	values := []string{}
+	for _, val := range list {
+		if val != "" {
+			values = append(values, val)
+		}
+	}
+	if len(values) > 0 {
+		q.Filter(elastic.NewTermsQuery(field, toInterfaces(values)...))
+	}
+}
+
+func toInterfaces(list []string) []interface{} {
+	values := make([]interface{}, 0, len(list))
+	for _, v := range list {
+		values = append(values, v)
+	}
+	return values
+}
+
+// esAggregations makes the aggregations for the same facets as the bleve indexer.
+func esAggregations() map[string]elastic.Aggregation {
+	aggs := make(map[string]elastic.Aggregation)
+	for name, field := range ES_FACET_FIELDS {
+		aggs[name] = elastic.NewTermsAggregation().Field(field).Size(100)
+	}
+
+	size := elastic.NewRangeAggregation().Field("size")
+	for _, r := range SIZE_FACET_RANGES {
+		size.AddRangeWithKey(r.Name, rangeValue(r.Min), rangeValue(r.Max))
+	}
+	aggs["size"] = size
+
+	refs := elastic.NewTermsAggregation().Field("fullRefs").Size(100)
+	repositories := elastic.NewTermsAggregation().Field("repository.full").Size(100).SubAggregation("refs", refs)
+	projects := elastic.NewTermsAggregation().Field("project.full").Size(100).SubAggregation("repositories", repositories)
+	aggs[ES_FULL_REFS_AGGREGATION] = elastic.NewTermsAggregation().Field("organization.full").Size(100).SubAggregation("projects", projects)
 
-			// log.Println(preview)
+	return aggs
+}
+
+// rangeValue converts the bound to the untyped nil if it's unbounded, so the range aggregation omits it.
+func rangeValue(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func toESFacets(aggs elastic.Aggregations) FacetResults {
+	facets := FacetResults{}
+
+	for name := range ES_FACET_FIELDS {
+		items, ok := aggs.Terms(name)
+		if !ok {
+			continue
+		}
+
+		tf := TermFacets{}
+		total := int(items.SumOfOtherDocCount)
+		for _, bucket := range items.Buckets {
+			tf = append(tf, TermFacet{Term: bucketKey(bucket), Count: int(bucket.DocCount)})
+			total += int(bucket.DocCount)
+		}
+
+		facets[name] = FacetResult{
+			Field: name,
+			Other: int(items.SumOfOtherDocCount),
+			Terms: tf,
+			Total: total,
+		}
+	}
+
+	if items, ok := aggs.Range("size"); ok {
+		rf := RangeFacets{}
+		total := 0
+		for _, bucket := range items.Buckets {
+			rf = append(rf, RangeFacet{Name: bucket.Key, Min: bucket.From, Max: bucket.To, Count: int(bucket.DocCount)})
+			total += int(bucket.DocCount)
+		}
+		sort.Sort(rf)
 
-			// hsList := []HighlightSource{}
+		facets["size"] = FacetResult{
+			Field:  "size",
+			Terms:  TermFacets{},
+			Ranges: rf,
+			Total:  total,
+		}
+	}
+
+	return facets
+}
+
+// toESFullRefsFacet makes the hierarchy of the fullRefs facet from the nested aggregations.
+// The refs are the fullRefs terms like "organization:project/repository:branch:master", and the last part is used as the term.
+func toESFullRefsFacet(aggs elastic.Aggregations) []OrganizationFacet {
+	organizations := []OrganizationFacet{}
+
+	for _, o := range termBuckets(aggs, ES_FULL_REFS_AGGREGATION) {
+		organization := OrganizationFacet{Term: bucketKey(o), Count: int(o.DocCount), Projects: []ProjectFacet{}}
+
+		for _, p := range termBuckets(o.Aggregations, "projects") {
+			project := ProjectFacet{Term: bucketKey(p), Count: int(p.DocCount), Repositories: []RepositoryFacet{}}
 
-			// for _, hc := range hit.Highlight["content"] {
-			// 	groups := HIT_TAG.FindAllStringSubmatch(l, -1)
-			// 	for _, group := range groups {
-			// 		hitWordsSet[group[1]] = struct{}{}
-			// 	}
-			// 	// hs := HighlightSource{Offset: first, Content: strings.Join(list, "\n")}
-			// 	// hsList = append(hsList, hs)
-			// }
+			for _, r := range termBuckets(p.Aggregations, "repositories") {
+				repository := RepositoryFacet{Term: bucketKey(r), Count: int(r.DocCount), Refs: []RefFacet{}}
 
-			h := Hit{Metadata: s.Metadata, Preview: preview}
-			list = append(list, h)
+				for _, ref := range termBuckets(r.Aggregations, "refs") {
+					fullRef := bucketKey(ref)
+					repository.Refs = append(repository.Refs, RefFacet{Term: fullRef[strings.LastIndex(fullRef, ":")+1:], Count: int(ref.DocCount)})
+				}
+				project.Repositories = append(project.Repositories, repository)
+			}
+			organization.Projects = append(organization.Projects, project)
 		}
+		organizations = append(organizations, organization)
 	}
 
-	return SearchResult{Hits: list, Size: searchResult.Hits.TotalHits}
+	return organizations
+}
+
+func termBuckets(aggs elastic.Aggregations, name string) []*elastic.AggregationBucketKeyItem {
+	items, ok := aggs.Terms(name)
+	if !ok {
+		return nil
+	}
+	return items.Buckets
+}
+
+func bucketKey(bucket *elastic.AggregationBucketKeyItem) string {
+	return fmt.Sprint(bucket.Key)
 }
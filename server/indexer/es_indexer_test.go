@@ -0,0 +1,668 @@
+package indexer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// fakeES is the in-process elasticsearch which supports the APIs and the queries used by ESIndexer.
+type fakeES struct {
+	mutex sync.Mutex
+	docs  map[string]map[string]interface{}
+	// The number of the bulk requests by the action
+	actions map[string]int
+	// The number of the refresh requests and the bulk requests with refresh
+	refreshes int
+}
+
+func newFakeES() *fakeES {
+	return &fakeES{docs: make(map[string]map[string]interface{}), actions: make(map[string]int)}
+}
+
+func newTestESIndexer(t *testing.T) (*ESIndexer, *fakeES, func()) {
+	es := newFakeES()
+	server := httptest.NewServer(es)
+
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	i := &ESIndexer{client: client}
+	i.Init()
+
+	return i, es, server.Close
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	paths := []string{}
+	for _, p := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		unescaped, err := url.QueryUnescape(p)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		paths = append(paths, unescaped)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if r.URL.Query().Get("refresh") == "true" {
+		f.refreshes++
+	}
+
+	last := paths[len(paths)-1]
+	switch {
+	case r.Method == "PUT" && len(paths) == 1 && paths[0] != "":
+		f.reply(w, 200, map[string]interface{}{"acknowledged": true})
+	case last == "_refresh":
+		f.refreshes++
+		f.reply(w, 200, map[string]interface{}{})
+	case last == "_bulk":
+		f.bulk(w, body)
+	case last == "_mget":
+		f.mget(w, body)
+	case last == "_count":
+		f.reply(w, 200, map[string]interface{}{"count": len(f.docs)})
+	case last == "_search":
+		f.search(w, body)
+	case len(paths) == 3 && r.Method == "HEAD":
+		if _, ok := f.docs[paths[2]]; ok {
+			w.WriteHeader(200)
+		} else {
+			w.WriteHeader(404)
+		}
+	case len(paths) == 3 && (r.Method == "PUT" || r.Method == "POST"):
+		var doc map[string]interface{}
+		json.Unmarshal(body, &doc)
+		f.docs[paths[2]] = doc
+		f.reply(w, 201, map[string]interface{}{"_index": paths[0], "_type": paths[1], "_id": paths[2], "created": true})
+	default:
+		f.reply(w, 200, map[string]interface{}{})
+	}
+}
+
+func (f *fakeES) reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeES) bulk(w http.ResponseWriter, body []byte) {
+	items := []map[string]interface{}{}
+	errors := false
+
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var action map[string]map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &action)
+
+		for name, meta := range action {
+			id := fmt.Sprint(meta["_id"])
+			item := map[string]interface{}{"_index": ES_INDEX, "_type": ES_TYPE, "_id": id, "status": 200}
+			f.actions[name]++
+
+			switch name {
+			case "index":
+				scanner.Scan()
+				var doc map[string]interface{}
+				json.Unmarshal(scanner.Bytes(), &doc)
+				f.docs[id] = doc
+				item["status"] = 201
+			case "update":
+				scanner.Scan()
+				var update struct {
+					Doc map[string]interface{} `json:"doc"`
+				}
+				json.Unmarshal(scanner.Bytes(), &update)
+				doc, ok := f.docs[id]
+				if !ok {
+					item["status"] = 404
+					item["error"] = map[string]interface{}{"type": "document_missing_exception", "reason": "document missing"}
+					errors = true
+					break
+				}
+				for k, v := range update.Doc {
+					doc[k] = v
+				}
+			case "delete":
+				if _, ok := f.docs[id]; !ok {
+					item["status"] = 404
+					errors = true
+					break
+				}
+				delete(f.docs, id)
+				item["found"] = true
+			}
+			items = append(items, map[string]interface{}{name: item})
+		}
+	}
+
+	f.reply(w, 200, map[string]interface{}{"took": 1, "errors": errors, "items": items})
+}
+
+func (f *fakeES) mget(w http.ResponseWriter, body []byte) {
+	var req struct {
+		Docs []struct {
+			Id     string      `json:"_id"`
+			Source interface{} `json:"_source"`
+		} `json:"docs"`
+	}
+	json.Unmarshal(body, &req)
+
+	docs := []map[string]interface{}{}
+	for _, d := range req.Docs {
+		got := map[string]interface{}{"_index": ES_INDEX, "_type": ES_TYPE, "_id": d.Id, "found": false}
+		if doc, ok := f.docs[d.Id]; ok {
+			got["found"] = true
+			got["_source"] = filterSource(doc, d.Source)
+		}
+		docs = append(docs, got)
+	}
+	f.reply(w, 200, map[string]interface{}{"docs": docs})
+}
+
+func (f *fakeES) search(w http.ResponseWriter, body []byte) {
+	var req map[string]interface{}
+	json.Unmarshal(body, &req)
+
+	query, _ := req["query"].(map[string]interface{})
+
+	ids := []string{}
+	for id, doc := range f.docs {
+		if query == nil || matchQuery(query, doc) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(sort.StringSlice(ids))
+
+	matched := []map[string]interface{}{}
+	for _, id := range ids {
+		matched = append(matched, f.docs[id])
+	}
+
+	from, size := 0, 10
+	if v, ok := req["from"].(float64); ok {
+		from = int(v)
+	}
+	if v, ok := req["size"].(float64); ok {
+		size = int(v)
+	}
+
+	hits := []map[string]interface{}{}
+	for i := from; i < len(ids) && i < from+size; i++ {
+		hit := map[string]interface{}{"_index": ES_INDEX, "_type": ES_TYPE, "_id": ids[i], "_score": 1.0, "_source": filterSource(f.docs[ids[i]], req["_source"])}
+		if _, ok := req["highlight"]; ok {
+			hit["highlight"] = map[string]interface{}{"content": highlightContent(query, f.docs[ids[i]])}
+		}
+		hits = append(hits, hit)
+	}
+
+	res := map[string]interface{}{"took": 1, "hits": map[string]interface{}{"total": len(ids), "max_score": 1.0, "hits": hits}}
+	if aggs, ok := req["aggregations"].(map[string]interface{}); ok {
+		res["aggregations"] = aggregate(aggs, matched)
+	}
+	f.reply(w, 200, res)
+}
+
+func filterSource(doc map[string]interface{}, source interface{}) map[string]interface{} {
+	excludes := map[string]bool{}
+	if s, ok := source.(map[string]interface{}); ok {
+		if list, ok := s["excludes"].([]interface{}); ok {
+			for _, v := range list {
+				excludes[fmt.Sprint(v)] = true
+			}
+		}
+	}
+	filtered := map[string]interface{}{}
+	for k, v := range doc {
+		if !excludes[k] {
+			filtered[k] = v
+		}
+	}
+	return filtered
+}
+
+// fieldValues returns the values of the field. The multi fields like "organization.full" are same as the main field.
+func fieldValues(doc map[string]interface{}, field string) []string {
+	field = strings.TrimSuffix(field, ".full")
+
+	values := []string{}
+	switch v := doc[field].(type) {
+	case nil:
+	case []interface{}:
+		for _, e := range v {
+			values = append(values, fmt.Sprint(e))
+		}
+	default:
+		values = append(values, fmt.Sprint(v))
+	}
+
+	// The encoding is analyzed by the lowercase keyword analyzer
+	if field == "encoding" {
+		for i := range values {
+			values[i] = strings.ToLower(values[i])
+		}
+	}
+	return values
+}
+
+func clauses(v interface{}) []map[string]interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{c}
+	case []interface{}:
+		list := []map[string]interface{}{}
+		for _, e := range c {
+			list = append(list, e.(map[string]interface{}))
+		}
+		return list
+	}
+	return nil
+}
+
+func queryStringTerms(query map[string]interface{}) []string {
+	terms := []string{}
+	if qs, ok := query["query_string"].(map[string]interface{}); ok {
+		return strings.Fields(strings.ToLower(fmt.Sprint(qs["query"])))
+	}
+	if b, ok := query["bool"].(map[string]interface{}); ok {
+		for _, c := range clauses(b["must"]) {
+			terms = append(terms, queryStringTerms(c)...)
+		}
+	}
+	return terms
+}
+
+func matchQuery(query map[string]interface{}, doc map[string]interface{}) bool {
+	for kind, v := range query {
+		body, _ := v.(map[string]interface{})
+
+		switch kind {
+		case "match_all":
+		case "query_string":
+			content := strings.ToLower(fmt.Sprint(doc["content"]))
+			for _, term := range queryStringTerms(query) {
+				if !strings.Contains(content, term) {
+					return false
+				}
+			}
+		case "bool":
+			for _, c := range append(clauses(body["must"]), clauses(body["filter"])...) {
+				if !matchQuery(c, doc) {
+					return false
+				}
+			}
+			if should := clauses(body["should"]); len(should) > 0 {
+				found := false
+				for _, c := range should {
+					if matchQuery(c, doc) {
+						found = true
+					}
+				}
+				if !found {
+					return false
+				}
+			}
+		case "term":
+			for field, value := range body {
+				if !containsValue(fieldValues(doc, field), fmt.Sprint(value)) {
+					return false
+				}
+			}
+		case "terms":
+			for field, values := range body {
+				found := false
+				for _, value := range values.([]interface{}) {
+					if containsValue(fieldValues(doc, field), fmt.Sprint(value)) {
+						found = true
+					}
+				}
+				if !found {
+					return false
+				}
+			}
+		case "range":
+			for field, params := range body {
+				p := params.(map[string]interface{})
+				size, _ := doc[field].(float64)
+				if from, ok := p["from"].(float64); ok {
+					if size < from || (size == from && p["include_lower"] == false) {
+						return false
+					}
+				}
+				if to, ok := p["to"].(float64); ok {
+					if size > to || (size == to && p["include_upper"] == false) {
+						return false
+					}
+				}
+			}
+		default:
+			panic("unsupported query: " + kind)
+		}
+	}
+	return true
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func highlightContent(query map[string]interface{}, doc map[string]interface{}) []string {
+	fragments := []string{}
+	content := strings.ToLower(fmt.Sprint(doc["content"]))
+	for _, term := range queryStringTerms(query) {
+		if strings.Contains(content, term) {
+			fragments = append(fragments, PRE_TAG+term+POST_TAG)
+		}
+	}
+	return fragments
+}
+
+func aggregate(aggs map[string]interface{}, docs []map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+
+	for name, v := range aggs {
+		agg := v.(map[string]interface{})
+		sub, _ := agg["aggregations"].(map[string]interface{})
+
+		if terms, ok := agg["terms"].(map[string]interface{}); ok {
+			field := fmt.Sprint(terms["field"])
+			size := int(terms["size"].(float64))
+
+			groups := map[string][]map[string]interface{}{}
+			for _, doc := range docs {
+				for _, value := range fieldValues(doc, field) {
+					groups[value] = append(groups[value], doc)
+				}
+			}
+			// Sort by count, then by term
+			keys := SuggestTerms{}
+			for k, list := range groups {
+				keys = append(keys, SuggestTerm{Term: k, Count: len(list)})
+			}
+			sort.Sort(keys)
+
+			buckets := []map[string]interface{}{}
+			other := 0
+			for i, key := range keys {
+				k := key.Term
+				if i >= size {
+					other += len(groups[k])
+					continue
+				}
+				bucket := map[string]interface{}{"key": k, "doc_count": len(groups[k])}
+				for subName, subResult := range aggregate(sub, groups[k]) {
+					bucket[subName] = subResult
+				}
+				buckets = append(buckets, bucket)
+			}
+			result[name] = map[string]interface{}{"doc_count_error_upper_bound": 0, "sum_other_doc_count": other, "buckets": buckets}
+		}
+
+		if r, ok := agg["range"].(map[string]interface{}); ok {
+			field := fmt.Sprint(r["field"])
+			buckets := []map[string]interface{}{}
+			for _, e := range r["ranges"].([]interface{}) {
+				rng := e.(map[string]interface{})
+				bucket := map[string]interface{}{"key": rng["key"]}
+				count := 0
+				for _, doc := range docs {
+					size, _ := doc[field].(float64)
+					if from, ok := rng["from"].(float64); ok {
+						bucket["from"] = from
+						if size < from {
+							continue
+						}
+					}
+					if to, ok := rng["to"].(float64); ok {
+						bucket["to"] = to
+						if size >= to {
+							continue
+						}
+					}
+					count++
+				}
+				bucket["doc_count"] = count
+				buckets = append(buckets, bucket)
+			}
+			result[name] = map[string]interface{}{"buckets": buckets}
+		}
+	}
+	return result
+}
+
+func testESFileIndex(repository string, blob string, path string, branches []string, tags []string, content string) FileIndex {
+	f := FileIndex{Content: content}
+	f.Metadata = Metadata{Blob: blob, Organization: "org", Project: "proj", Repository: repository, Path: path, Branches: branches, Tags: tags, Size: int64(len(content)), Encoding: "utf8"}
+	return f
+}
+
+func TestESIndexerBatchFileIndex(t *testing.T) {
+	i, es, closeServer := newTestESIndexer(t)
+	defer closeServer()
+
+	a := testESFileIndex("repo", "0001", "src/a.go", []string{"master"}, []string{}, "hello a")
+	b := testESFileIndex("repo", "0002", "src/b.go", []string{"master"}, []string{}, "hello b")
+
+	err := i.BatchFileIndex([]FileIndexOperation{{Method: ADD, FileIndex: a}, {Method: ADD, FileIndex: b}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Merge the refs into the existing document, and delete the document without any refs
+	a2 := a
+	a2.Metadata.Branches = []string{"develop"}
+	a2.Content = ""
+	err = i.BatchFileIndex([]FileIndexOperation{{Method: ADD, FileIndex: a2}, {Method: DELETE, FileIndex: b}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, ok := es.docs["org:proj:repo:0001:src/a.go"]
+	if !ok {
+		t.Fatalf("got %v, want the document of a.go", es.docs)
+	}
+	if got := fieldValues(doc, "branches"); !reflect.DeepEqual(got, []string{"master", "develop"}) {
+		t.Errorf("got %v, want %v", got, []string{"master", "develop"})
+	}
+	wantFullRefs := []string{"org:proj/repo:branch:master", "org:proj/repo:branch:develop"}
+	if got := fieldValues(doc, "fullRefs"); !reflect.DeepEqual(got, wantFullRefs) {
+		t.Errorf("got %v, want %v", got, wantFullRefs)
+	}
+	// The content isn't lost by the partial update
+	if doc["content"] != "hello a" {
+		t.Errorf("got %v, want %v", doc["content"], "hello a")
+	}
+	if es.actions["index"] != 2 || es.actions["update"] != 1 || es.actions["delete"] != 1 {
+		t.Errorf("got %v, want 2 index, 1 update and 1 delete", es.actions)
+	}
+
+	// The same refs don't make any requests
+	if err := i.UpsertFileIndex(a2); err != nil {
+		t.Fatal(err)
+	}
+	if es.actions["update"] != 1 {
+		t.Errorf("got %v, want no more updates", es.actions)
+	}
+
+	count, err := i.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("got %v, want %v", count, 1)
+	}
+
+	if exists, err := i.Exists(a); err != nil || !exists {
+		t.Errorf("got %v %v, want exists", exists, err)
+	}
+	if exists, err := i.Exists(b); err != nil || exists {
+		t.Errorf("got %v %v, want not exists", exists, err)
+	}
+
+	// The batches don't refresh the index
+	if es.refreshes != 0 {
+		t.Errorf("got %v, want no refreshes", es.refreshes)
+	}
+}
+
+func TestESIndexerDeleteIndexByRefs(t *testing.T) {
+	i, es, closeServer := newTestESIndexer(t)
+	defer closeServer()
+
+	err := i.BatchFileIndex([]FileIndexOperation{
+		{Method: ADD, FileIndex: testESFileIndex("repo", "0001", "a.go", []string{"master", "develop"}, []string{}, "a")},
+		{Method: ADD, FileIndex: testESFileIndex("repo", "0002", "b.go", []string{"master"}, []string{}, "b")},
+		{Method: ADD, FileIndex: testESFileIndex("repo", "0003", "c.go", []string{}, []string{"v1"}, "c")},
+		{Method: ADD, FileIndex: testESFileIndex("other", "0002", "b.go", []string{"master"}, []string{}, "b")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = i.DeleteIndexByRefs("org", "proj", "repo", []string{"master"}, []string{"v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for id := range es.docs {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.StringSlice(ids))
+
+	want := []string{"org:proj:other:0002:b.go", "org:proj:repo:0001:a.go"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got %v, want %v", ids, want)
+	}
+	if got := fieldValues(es.docs["org:proj:repo:0001:a.go"], "fullRefs"); !reflect.DeepEqual(got, []string{"org:proj/repo:branch:develop"}) {
+		t.Errorf("got %v, want %v", got, []string{"org:proj/repo:branch:develop"})
+	}
+	// The index is refreshed before searching the next round
+	if es.refreshes != 1 {
+		t.Errorf("got %v, want %v", es.refreshes, 1)
+	}
+}
+
+func TestESIndexerSearchQuery(t *testing.T) {
+	i, _, closeServer := newTestESIndexer(t)
+	defer closeServer()
+
+	operations := []FileIndexOperation{}
+	for n := 0; n < 12; n++ {
+		f := testESFileIndex("repo", fmt.Sprintf("%04d", n), fmt.Sprintf("src/%02d.go", n), []string{"master"}, []string{}, "package main\n// hello\n")
+		operations = append(operations, FileIndexOperation{Method: ADD, FileIndex: f})
+	}
+	large := testESFileIndex("other", "1000", "README.md", []string{"master"}, []string{"v1"}, "hello "+strings.Repeat("x", 2048))
+	large.Metadata.Encoding = "Shift_JIS"
+	operations = append(operations, FileIndexOperation{Method: ADD, FileIndex: large})
+	operations = append(operations, FileIndexOperation{Method: ADD, FileIndex: testESFileIndex("repo", "2000", "bye.go", []string{"master"}, []string{}, "bye")})
+
+	if err := i.BatchFileIndex(operations); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := i.SearchQuery("hello", FilterParams{}, 0, SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Size != 13 || len(result.Hits) != 10 {
+		t.Fatalf("got %v hits of %v, want 10 hits of 13", len(result.Hits), result.Size)
+	}
+	hit := result.Hits[0]
+	if hit.ID != "org:proj:other:1000:README.md" || !reflect.DeepEqual(hit.Keyword, []string{"hello"}) || len(hit.Preview) != 1 {
+		t.Errorf("got %v, want the hit of README.md with the preview", hit)
+	}
+
+	// Facets
+	wantExt := TermFacets{{Term: ".go", Count: 12}, {Term: ".md", Count: 1}}
+	if got := result.Facets["ext"].Terms; !reflect.DeepEqual(got, wantExt) {
+		t.Errorf("got %v, want %v", got, wantExt)
+	}
+	if got := result.Facets["encoding"].Terms; len(got) != 2 || got[1].Term != "shift_jis" {
+		t.Errorf("got %v, want lower-cased encodings", got)
+	}
+	if got := result.Facets["size"].Ranges; len(got) != len(SIZE_FACET_RANGES) || got[0].Name != "<1k" || got[0].Count != 12 || got[1].Count != 1 {
+		t.Errorf("got %v, want the size ranges", got)
+	}
+
+	wantFullRefs := []OrganizationFacet{
+		{Term: "org", Count: 13, Projects: []ProjectFacet{
+			{Term: "proj", Count: 13, Repositories: []RepositoryFacet{
+				{Term: "repo", Count: 12, Refs: []RefFacet{{Term: "master", Count: 12}}},
+				{Term: "other", Count: 1, Refs: []RefFacet{{Term: "master", Count: 1}, {Term: "v1", Count: 1}}},
+			}},
+		}},
+	}
+	if !reflect.DeepEqual(result.FullRefsFacet, wantFullRefs) {
+		t.Errorf("got %v, want %v", result.FullRefsFacet, wantFullRefs)
+	}
+
+	// Pagination
+	result, err = i.SearchQuery("hello", FilterParams{}, 1, SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Hits) != 3 || result.Current != 1 {
+		t.Errorf("got %v hits in page %v, want 3 hits in page 1", len(result.Hits), result.Current)
+	}
+
+	// Filters
+	result, err = i.SearchQuery("hello size:>1k encoding:shift_jis", FilterParams{Exts: []string{".md"}, Tags: []string{"v1"}}, 0, SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Size != 1 || result.Hits[0].Path != "README.md" {
+		t.Errorf("got %v, want README.md only", result.Hits)
+	}
+
+	result, err = i.SearchQuery("hello", FilterParams{Repositories: []string{"repo"}, Sizes: []string{">1k"}}, 0, SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Size != 0 {
+		t.Errorf("got %v, want no hits", result.Size)
+	}
+}
+
+func TestESIndexerSearchQueryError(t *testing.T) {
+	i, _, closeServer := newTestESIndexer(t)
+
+	_, err := i.SearchQuery("hello size:>abc", FilterParams{}, 0, SearchOptions{})
+	if errors.Cause(err) != ErrInvalidQuery {
+		t.Errorf("got %v, want %v", err, ErrInvalidQuery)
+	}
+
+	// The search fails when the cluster is down, not "no results"
+	closeServer()
+
+	_, err = i.SearchQuery("hello", FilterParams{}, 0, SearchOptions{})
+	if err == nil || errors.Cause(err) == ErrInvalidQuery {
+		t.Errorf("got %v, want the search error", err)
+	}
+}
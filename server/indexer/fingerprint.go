@@ -0,0 +1,183 @@
+package indexer
+
+import (
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The number of the tokens in a shingle and the winnowing window size.
+// Any common token sequence longer than FINGERPRINT_SHINGLE_SIZE+FINGERPRINT_WINDOW_SIZE-1 shares a fingerprint.
+const FINGERPRINT_SHINGLE_SIZE = 6
+const FINGERPRINT_WINDOW_SIZE = 6
+
+var FINGERPRINT_TOKEN_PATTERN = regexp.MustCompile(`[\p{L}\p{N}_]+|[^\s\p{L}\p{N}_]`)
+
+// Fingerprint is the hash of the token shingle and its line range (1-based).
+type Fingerprint struct {
+	Hash      uint64
+	StartLine int
+	EndLine   int
+}
+
+type LineRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type LineRanges []LineRange
+
+func (l LineRanges) Len() int      { return len(l) }
+func (l LineRanges) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l LineRanges) Less(i, j int) bool {
+	if l[i].Start != l[j].Start {
+		return l[i].Start < l[j].Start
+	}
+	return l[i].End < l[j].End
+}
+
+type fingerprintToken struct {
+	Text string
+	Line int
+}
+
+// Winnow computes the fingerprints of the content by winnowing the hashes of the token shingles.
+// Whitespace is ignored, so the reformatted copies have the same fingerprints.
+func Winnow(content string) []Fingerprint {
+	tokens := []fingerprintToken{}
+	for i, line := range strings.Split(content, "\n") {
+		for _, token := range FINGERPRINT_TOKEN_PATTERN.FindAllString(line, -1) {
+			tokens = append(tokens, fingerprintToken{Text: token, Line: i + 1})
+		}
+	}
+
+	if len(tokens) < FINGERPRINT_SHINGLE_SIZE {
+		return []Fingerprint{}
+	}
+
+	shingles := make([]Fingerprint, len(tokens)-FINGERPRINT_SHINGLE_SIZE+1)
+	for i := range shingles {
+		h := fnv.New64a()
+		for _, token := range tokens[i : i+FINGERPRINT_SHINGLE_SIZE] {
+			h.Write([]byte(token.Text))
+			h.Write([]byte{0})
+		}
+		shingles[i] = Fingerprint{
+			Hash:      h.Sum64(),
+			StartLine: tokens[i].Line,
+			EndLine:   tokens[i+FINGERPRINT_SHINGLE_SIZE-1].Line,
+		}
+	}
+
+	window := FINGERPRINT_WINDOW_SIZE
+	if window > len(shingles) {
+		window = len(shingles)
+	}
+
+	// Select the minimum hash in each window. The rightmost one is used for the ties.
+	fingerprints := []Fingerprint{}
+	selected := -1
+	for start := 0; start+window <= len(shingles); start++ {
+		min := start
+		for i := start; i < start+window; i++ {
+			if shingles[i].Hash <= shingles[min].Hash {
+				min = i
+			}
+		}
+		if min != selected {
+			fingerprints = append(fingerprints, shingles[min])
+			selected = min
+		}
+	}
+	return fingerprints
+}
+
+// encodeFingerprints converts the fingerprints to "hash:start-end" separated by space.
+func encodeFingerprints(fingerprints []Fingerprint) string {
+	list := make([]string, len(fingerprints))
+	for i, f := range fingerprints {
+		list[i] = fingerprintHash(f.Hash) + ":" + strconv.Itoa(f.StartLine) + "-" + strconv.Itoa(f.EndLine)
+	}
+	return strings.Join(list, " ")
+}
+
+func decodeFingerprints(s string) []Fingerprint {
+	fingerprints := []Fingerprint{}
+	for _, item := range strings.Fields(s) {
+		columns := strings.Split(item, ":")
+		if len(columns) != 2 {
+			continue
+		}
+		lines := strings.Split(columns[1], "-")
+		if len(lines) != 2 {
+			continue
+		}
+		hash, err1 := strconv.ParseUint(columns[0], 16, 64)
+		start, err2 := strconv.Atoi(lines[0])
+		end, err3 := strconv.Atoi(lines[1])
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		fingerprints = append(fingerprints, Fingerprint{Hash: hash, StartLine: start, EndLine: end})
+	}
+	return fingerprints
+}
+
+func fingerprintHash(hash uint64) string {
+	return strconv.FormatUint(hash, 16)
+}
+
+// matchFingerprints returns the ratio of the query hashes found in the fingerprints,
+// and the merged line ranges of the matched fingerprints.
+func matchFingerprints(queryHashes map[uint64]struct{}, fingerprints []Fingerprint) (float64, []LineRange) {
+	if len(queryHashes) == 0 {
+		return 0, []LineRange{}
+	}
+
+	matched := make(map[uint64]struct{})
+	ranges := LineRanges{}
+	for _, f := range fingerprints {
+		if _, ok := queryHashes[f.Hash]; ok {
+			matched[f.Hash] = struct{}{}
+			ranges = append(ranges, LineRange{Start: f.StartLine, End: f.EndLine})
+		}
+	}
+
+	sort.Sort(ranges)
+
+	merged := []LineRange{}
+	for _, r := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && r.Start <= merged[last].End+1 {
+			if r.End > merged[last].End {
+				merged[last].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return float64(len(matched)) / float64(len(queryHashes)), merged
+}
+
+func countLines(content string) int {
+	if content == "" {
+		return 0
+	}
+	lines := strings.Count(content, "\n")
+	if !strings.HasSuffix(content, "\n") {
+		lines++
+	}
+	return lines
+}
+
+// countRangeLines returns the total number of the lines in the ranges.
+func countRangeLines(ranges []LineRange) int {
+	lines := 0
+	for _, r := range ranges {
+		lines += r.End - r.Start + 1
+	}
+	return lines
+}
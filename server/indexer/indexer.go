@@ -5,6 +5,12 @@ import (
 	// "log"
 	"fmt"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/wadahiro/gitss/server/repo"
 	"github.com/wadahiro/gitss/server/util"
@@ -17,16 +23,39 @@ type Indexer interface {
 	DeleteIndexByRefs(organization string, project string, repository string, branches []string, tags []string) error
 
 	Count() (uint64, error)
-	SearchQuery(query string, filters FilterParams, page int) (SearchResult, error)
+	SearchQuery(query string, filters FilterParams, page int, options SearchOptions) (SearchResult, error)
+	SuggestTerms(prefix string, filters FilterParams) (SuggestResult, error)
+	Explain(query string, filters FilterParams, page int) (ExplainResult, error)
+	AggregateRefs(query string, organization string, project string, repository string) (RefAggregationResult, error)
+	SearchSimilar(docID string, filters FilterParams, page int) (SimilarResult, error)
+	SearchSnippet(snippet string, filters FilterParams) (SnippetResult, error)
+	ReportDuplicates(size int) (DuplicateReport, error)
+	FindBlob(blob string) (BlobResult, error)
+	GetPathHistory(organization string, project string, repository string, path string) (PathHistory, error)
 
 	Exists(requestFileIndex FileIndex) (bool, error)
+
+	// SearchCacheStats returns the statistics of the search result cache.
+	SearchCacheStats() SearchCacheStats
+
+	// DropShard removes the shard of the repository, or of the organization in the organization shard mode.
+	DropShard(organization string, project string, repository string) error
+
+	// Close releases the resources of the indexer. It must be called before the process exits.
+	Close() error
 }
 
+// ErrInvalidQuery is returned by SearchQuery if the query can't be parsed.
+var ErrInvalidQuery = errors.New("Invalid query")
+
 type BatchMethod int
 
 const (
 	ADD BatchMethod = iota
 	DELETE
+	// MERGE_REFS merges the refs into the existing document, and the document isn't created if it doesn't exist.
+	// The request may have the content read before in the import, otherwise the indexer needing it reads the blob again.
+	MERGE_REFS
 )
 
 type FileIndexOperation struct {
@@ -38,6 +67,8 @@ type FileIndex struct {
 	Metadata
 	FullRefs []string `json:"fullRefs"`
 	Content  string   `json:"content"`
+	// The compressed content to make the previews without the git repository. It's set when the content storing is enabled.
+	StoredContent string `json:"storedContent,omitempty"`
 }
 
 type Metadata struct {
@@ -65,6 +96,416 @@ type SearchResult struct {
 	Hits          []Hit               `json:"hits"`
 	FullRefsFacet []OrganizationFacet `json:"fullRefsFacet"`
 	Facets        FacetResults        `json:"facets"`
+	Suggestions   []Suggestion        `json:"suggestions,omitempty"`
+	OriginalQuery string              `json:"originalQuery,omitempty"`
+	Group         string              `json:"group,omitempty"`
+	Groups        []GroupResult       `json:"groups,omitempty"`
+	// GroupsPartial is true if the repositories over GROUP_FACET_SIZE fullRefs terms weren't collected as the groups.
+	GroupsPartial bool `json:"groupsPartial,omitempty"`
+	// FacetsApproximate is true if the facet counts merged from the shards can be approximate. See COMPLETE_FACET_FIELDS.
+	FacetsApproximate bool `json:"facetsApproximate,omitempty"`
+	// The total number of the query term occurrences.
+	// OccurrencesPartial is true if only the first OCCURRENCE_SCAN_SIZE documents were counted.
+	Occurrences        int64 `json:"occurrences,omitempty"`
+	OccurrencesPartial bool  `json:"occurrencesPartial,omitempty"`
+	// The status of the live grep if it was requested. Its hits follow the indexed hits in the pages, and Size includes them.
+	LiveGrep *LiveGrepStatus `json:"liveGrep,omitempty"`
+}
+
+// LiveGrepStatus is the summary of "git grep" on the unindexed refs and files.
+// Partial is true if the time or result budget was exhausted.
+type LiveGrepStatus struct {
+	Time    float64 `json:"time"`
+	Refs    int     `json:"refs"`
+	Size    int64   `json:"size"`
+	Partial bool    `json:"partial"`
+}
+
+const GROUP_REPOSITORY = "repository"
+const SORT_OCCURRENCES = "occurrences"
+const DEFAULT_GROUP_SIZE = 3
+const MAX_GROUP_SIZE = 10
+
+// SearchCacheStats is the statistics of the search result cache.
+// Generation is incremented after each write to the index, and the cached results of the old generations aren't used.
+// Updated is the time of the last increment.
+type SearchCacheStats struct {
+	Generation uint64     `json:"generation"`
+	Updated    *time.Time `json:"updated,omitempty"`
+	Size       int        `json:"size"`
+	Capacity   int        `json:"capacity"`
+	Hits       uint64     `json:"hits"`
+	Misses     uint64     `json:"misses"`
+	HitRate    float64    `json:"hitRate"`
+}
+
+type SearchOptions struct {
+	// Re-run the search with the best suggestion when no documents are found
+	AutoCorrect bool
+	// Group the hits by GROUP_REPOSITORY. The result is paginated over the groups.
+	Group string
+	// The number of the best hits in each group
+	GroupSize int
+	// Sort the hits by SORT_OCCURRENCES. Empty means the relevance order.
+	Sort string
+	// Count the total occurrences of the query terms
+	CountOccurrences bool
+}
+
+// GroupResult is the group of the hits in a repository.
+// Size is the total number of the hits in the group and Hits has the best hits only.
+type GroupResult struct {
+	Organization string `json:"organization"`
+	Project      string `json:"project"`
+	Repository   string `json:"repository"`
+	Size         int64  `json:"size"`
+	Hits         []Hit  `json:"hits"`
+}
+
+// Suggestion is the corrected query string for the misspelled query.
+// Distance is the sum of the edit distances of the corrected terms and Count is the sum of their frequencies.
+type Suggestion struct {
+	Query    string `json:"query"`
+	Distance int    `json:"distance"`
+	Count    uint64 `json:"count"`
+}
+
+type Suggestions []Suggestion
+
+// Sort by distance, then by frequency.
+func (s Suggestions) Len() int      { return len(s) }
+func (s Suggestions) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s Suggestions) Less(i, j int) bool {
+	if s[i].Distance != s[j].Distance {
+		return s[i].Distance < s[j].Distance
+	}
+	return s[i].Count > s[j].Count
+}
+
+// SimilarResult has the documents similar to the Doc. Terms are the content terms used for the query.
+type SimilarResult struct {
+	Doc          string       `json:"doc"`
+	FilterParams FilterParams `json:"filterParams"`
+	Terms        []string     `json:"terms"`
+	Time         float64      `json:"time"`
+	Size         int64        `json:"size"`
+	Limit        int          `json:"limit"`
+	Current      int          `json:"current"`
+	Hits         []Hit        `json:"hits"`
+}
+
+// SnippetResult has the files containing the snippet or its near copy.
+// Fingerprints is the number of the fingerprints of the snippet, and zero means the snippet is too short.
+type SnippetResult struct {
+	FilterParams FilterParams `json:"filterParams"`
+	Fingerprints int          `json:"fingerprints"`
+	Time         float64      `json:"time"`
+	Size         int64        `json:"size"`
+	Hits         []SnippetHit `json:"hits"`
+}
+
+// SnippetHit is the file matching the snippet. Lines are the matched line ranges in the file.
+type SnippetHit struct {
+	Metadata
+	ID         string      `json:"id"`
+	Similarity float64     `json:"similarity"`
+	Lines      []LineRange `json:"lines"`
+}
+
+type SnippetHits []SnippetHit
+
+func (s SnippetHits) Len() int           { return len(s) }
+func (s SnippetHits) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s SnippetHits) Less(i, j int) bool { return s[i].Similarity > s[j].Similarity }
+
+// BlobResult has all indexed files of the blob.
+type BlobResult struct {
+	Blob      string     `json:"blob"`
+	Time      float64    `json:"time"`
+	Size      int64      `json:"size"`
+	Locations []Metadata `json:"locations"`
+}
+
+const DEFAULT_REPORT_SIZE = 100
+
+// DuplicateReport has the identical files and the duplicated blocks ranked by the duplicated line count.
+type DuplicateReport struct {
+	Time             float64           `json:"time"`
+	IdenticalFiles   []IdenticalFile   `json:"identicalFiles"`
+	DuplicatedBlocks []DuplicatedBlock `json:"duplicatedBlocks"`
+}
+
+// IdenticalFile is the blob in the multiple locations.
+// DuplicatedLines is the lines of the copies except the original one.
+type IdenticalFile struct {
+	Blob            string     `json:"blob"`
+	Lines           int        `json:"lines"`
+	Copies          int        `json:"copies"`
+	DuplicatedLines int        `json:"duplicatedLines"`
+	Locations       []Metadata `json:"locations"`
+}
+
+type IdenticalFiles []IdenticalFile
+
+func (d IdenticalFiles) Len() int      { return len(d) }
+func (d IdenticalFiles) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d IdenticalFiles) Less(i, j int) bool {
+	if d[i].DuplicatedLines != d[j].DuplicatedLines {
+		return d[i].DuplicatedLines > d[j].DuplicatedLines
+	}
+	return d[i].Blob < d[j].Blob
+}
+
+// DuplicatedBlock is the pair of the different blobs sharing the code blocks.
+// DuplicatedLines is the smaller line count of the shared blocks in the two files.
+type DuplicatedBlock struct {
+	DuplicatedLines int              `json:"duplicatedLines"`
+	Files           []DuplicatedFile `json:"files"`
+}
+
+type DuplicatedFile struct {
+	Blob      string      `json:"blob"`
+	Lines     []LineRange `json:"lines"`
+	Locations []Metadata  `json:"locations"`
+}
+
+type DuplicatedBlocks []DuplicatedBlock
+
+func (d DuplicatedBlocks) Len() int      { return len(d) }
+func (d DuplicatedBlocks) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d DuplicatedBlocks) Less(i, j int) bool {
+	if d[i].DuplicatedLines != d[j].DuplicatedLines {
+		return d[i].DuplicatedLines > d[j].DuplicatedLines
+	}
+	return d[i].Files[0].Blob < d[j].Files[0].Blob
+}
+
+// RefAggregationResult has the match counts of the query per branch and tag in a repository.
+// Tags are ordered by the tag date and branches are ordered by the name.
+type RefAggregationResult struct {
+	Query        string     `json:"query"`
+	Organization string     `json:"organization"`
+	Project      string     `json:"project"`
+	Repository   string     `json:"repository"`
+	Time         float64    `json:"time"`
+	Size         int64      `json:"size"`
+	Branches     []RefCount `json:"branches"`
+	Tags         []RefCount `json:"tags"`
+}
+
+type RefCount struct {
+	Ref   string     `json:"ref"`
+	Date  *time.Time `json:"date,omitempty"`
+	Count int        `json:"count"`
+}
+
+type RefCounts []RefCount
+
+func (r RefCounts) Len() int           { return len(r) }
+func (r RefCounts) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r RefCounts) Less(i, j int) bool { return r[i].Ref < r[j].Ref }
+
+type RefCountsByDate []RefCount
+
+func (r RefCountsByDate) Len() int      { return len(r) }
+func (r RefCountsByDate) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r RefCountsByDate) Less(i, j int) bool {
+	if r[i].Date == nil || r[j].Date == nil {
+		if r[i].Date == nil && r[j].Date == nil {
+			return r[i].Ref < r[j].Ref
+		}
+		// unknown dates go last
+		return r[j].Date == nil
+	}
+	if !r[i].Date.Equal(*r[j].Date) {
+		return r[i].Date.Before(*r[j].Date)
+	}
+	return r[i].Ref < r[j].Ref
+}
+
+// buildRefCounts makes the counts of all indexed refs, so the refs without any match have zero count.
+func buildRefCounts(indexed []string, counts map[string]int, dates map[string]time.Time) []RefCount {
+	refs := make(map[string]struct{})
+	for _, ref := range indexed {
+		refs[ref] = struct{}{}
+	}
+	for ref := range counts {
+		refs[ref] = struct{}{}
+	}
+
+	list := []RefCount{}
+	for ref := range refs {
+		r := RefCount{Ref: ref, Count: counts[ref]}
+		if date, ok := dates[ref]; ok {
+			d := date
+			r.Date = &d
+		}
+		list = append(list, r)
+	}
+	return list
+}
+
+// PathHistory has the versions of the path across the indexed branches and tags of the repository.
+// MissingBranches and MissingTags are the indexed refs which don't have the path.
+type PathHistory struct {
+	Organization    string        `json:"organization"`
+	Project         string        `json:"project"`
+	Repository      string        `json:"repository"`
+	Path            string        `json:"path"`
+	Time            float64       `json:"time"`
+	Versions        []PathVersion `json:"versions"`
+	MissingBranches []string      `json:"missingBranches"`
+	MissingTags     []string      `json:"missingTags"`
+	// The unified diff between the two versions if requested
+	Diff string `json:"diff,omitempty"`
+}
+
+// PathVersion is the blob of the path and the refs sharing it.
+// Date is the newest date of the refs, so the latest version comes first.
+type PathVersion struct {
+	Blob     string     `json:"blob"`
+	Size     int64      `json:"size"`
+	Date     *time.Time `json:"date,omitempty"`
+	Branches []string   `json:"branches"`
+	Tags     []string   `json:"tags"`
+}
+
+type PathVersions []PathVersion
+
+// Sort by date descending, then by blob. Unknown dates go last.
+func (p PathVersions) Len() int      { return len(p) }
+func (p PathVersions) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p PathVersions) Less(i, j int) bool {
+	if p[i].Date == nil || p[j].Date == nil {
+		if p[i].Date == nil && p[j].Date == nil {
+			return p[i].Blob < p[j].Blob
+		}
+		return p[j].Date == nil
+	}
+	if !p[i].Date.Equal(*p[j].Date) {
+		return p[i].Date.After(*p[j].Date)
+	}
+	return p[i].Blob < p[j].Blob
+}
+
+// FindVersion returns the version of the blob.
+func (h PathHistory) FindVersion(blob string) (PathVersion, bool) {
+	for _, v := range h.Versions {
+		if v.Blob == blob {
+			return v, true
+		}
+	}
+	return PathVersion{}, false
+}
+
+// buildPathVersions groups the refs of the files by the blob.
+// The files of the same blob are merged because the document has the refs of the blob.
+func buildPathVersions(files []FileIndex, branchDates map[string]time.Time, tagDates map[string]time.Time) []PathVersion {
+	versions := make(map[string]*PathVersion)
+	for _, f := range files {
+		v, ok := versions[f.Blob]
+		if !ok {
+			v = &PathVersion{Blob: f.Blob, Size: f.Size, Branches: []string{}, Tags: []string{}}
+			versions[f.Blob] = v
+		}
+		v.Branches = appendRefDate(v, v.Branches, f.Branches, branchDates)
+		v.Tags = appendRefDate(v, v.Tags, f.Tags, tagDates)
+	}
+
+	list := PathVersions{}
+	for _, v := range versions {
+		sort.Sort(sort.StringSlice(v.Branches))
+		sort.Sort(sort.StringSlice(v.Tags))
+		list = append(list, *v)
+	}
+	sort.Sort(list)
+	return list
+}
+
+func appendRefDate(v *PathVersion, current []string, refs []string, dates map[string]time.Time) []string {
+	for _, ref := range refs {
+		if util.ContainsString(current, ref) {
+			continue
+		}
+		current = append(current, ref)
+		if date, ok := dates[ref]; ok && (v.Date == nil || date.After(*v.Date)) {
+			d := date
+			v.Date = &d
+		}
+	}
+	return current
+}
+
+// missingRefs returns the sorted indexed refs which are not in the versions.
+func missingRefs(indexed map[string]string, versions []PathVersion, refs func(v PathVersion) []string) []string {
+	found := make(map[string]struct{})
+	for _, v := range versions {
+		for _, ref := range refs(v) {
+			found[ref] = struct{}{}
+		}
+	}
+
+	list := []string{}
+	for ref := range indexed {
+		if _, ok := found[ref]; !ok {
+			list = append(list, ref)
+		}
+	}
+	sort.Sort(sort.StringSlice(list))
+	return list
+}
+
+type ExplainResult struct {
+	Query        string       `json:"query"`
+	FilterParams FilterParams `json:"filterParams"`
+	ParsedQuery  interface{}  `json:"parsedQuery"`
+	Time         float64      `json:"time"`
+	Size         int64        `json:"size"`
+	Current      int          `json:"current"`
+	Hits         []ExplainHit `json:"hits"`
+}
+
+type ExplainHit struct {
+	Metadata
+	ID          string       `json:"id"`
+	Score       float64      `json:"score"`
+	Explanation *Explanation `json:"explanation"`
+}
+
+type Explanation struct {
+	Value    float64        `json:"value"`
+	Message  string         `json:"message"`
+	Children []*Explanation `json:"children,omitempty"`
+}
+
+type SuggestResult struct {
+	Prefix       string        `json:"prefix"`
+	FilterParams FilterParams  `json:"filterParams"`
+	Terms        []SuggestTerm `json:"terms"`
+	Symbols      []SuggestTerm `json:"symbols"`
+	Files        []SuggestTerm `json:"files"`
+}
+
+type SuggestTerm struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+type SuggestTerms []SuggestTerm
+
+// Sort by count, then by term.
+func (s SuggestTerms) Len() int      { return len(s) }
+func (s SuggestTerms) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s SuggestTerms) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Term < s[j].Term
+}
+
+func (f FilterParams) hasScope() bool {
+	return len(f.Organizations) > 0 || len(f.Projects) > 0 || len(f.Repositories) > 0 ||
+		len(f.Branches) > 0 || len(f.Tags) > 0 || len(f.Exts) > 0 || len(f.Encodings) > 0
 }
 
 type OrganizationFacet struct {
@@ -89,9 +530,14 @@ type RefFacet struct {
 
 type Hit struct {
 	Metadata
+	ID      string   `json:"id"`
 	Keyword []string `json:"keyword"`
 	// Highlight map[string][]string `json:"highlight"`
 	Preview []util.TextPreview `json:"preview"`
+	// The number of the query term occurrences in the content
+	Occurrences int `json:"occurrences"`
+	// True if the hit was found by the live grep, not by the index
+	Unindexed bool `json:"unindexed,omitempty"`
 }
 
 type HighlightSource struct {
@@ -102,11 +548,12 @@ type HighlightSource struct {
 type FacetResults map[string]FacetResult
 
 type FacetResult struct {
-	Field   string     `json:"field"`
-	Total   int        `json:"total"`
-	Missing int        `json:"missing"`
-	Other   int        `json:"other"`
-	Terms   TermFacets `json:"terms"`
+	Field   string      `json:"field"`
+	Total   int         `json:"total"`
+	Missing int         `json:"missing"`
+	Other   int         `json:"other"`
+	Terms   TermFacets  `json:"terms"`
+	Ranges  RangeFacets `json:"ranges,omitempty"`
 }
 
 type TermFacets []TermFacet
@@ -116,6 +563,28 @@ type TermFacet struct {
 	Count int    `json:"count"`
 }
 
+type RangeFacets []RangeFacet
+
+type RangeFacet struct {
+	Name  string   `json:"name"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Count int      `json:"count"`
+}
+
+// Sort by min value, the unbounded range comes first.
+func (r RangeFacets) Len() int      { return len(r) }
+func (r RangeFacets) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r RangeFacets) Less(i, j int) bool {
+	if r[i].Min == nil {
+		return r[j].Min != nil
+	}
+	if r[j].Min == nil {
+		return false
+	}
+	return *r[i].Min < *r[j].Min
+}
+
 type FilterParams struct {
 	Exts          []string `json:"x,omitempty"`
 	Organizations []string `json:"o,omitempty"`
@@ -123,6 +592,137 @@ type FilterParams struct {
 	Repositories  []string `json:"r,omitempty"`
 	Branches      []string `json:"b,omitempty"`
 	Tags          []string `json:"t,omitempty"`
+	Encodings     []string `json:"e,omitempty"`
+	Sizes         []string `json:"s,omitempty"`
+}
+
+// SizeRange is the parsed form of the size filter like ">100k" or "<=1m".
+// Nil Min or Max means unbounded.
+type SizeRange struct {
+	Min          *float64
+	Max          *float64
+	InclusiveMin bool
+	InclusiveMax bool
+}
+
+type SizeFacetRange struct {
+	Name string
+	Min  *float64
+	Max  *float64
+}
+
+// SIZE_FACET_RANGES are the buckets of the size facet. Min is inclusive and Max is exclusive.
+var SIZE_FACET_RANGES = []SizeFacetRange{
+	{Name: "<1k", Min: nil, Max: float64Ptr(1024)},
+	{Name: "1k-10k", Min: float64Ptr(1024), Max: float64Ptr(10 * 1024)},
+	{Name: "10k-100k", Min: float64Ptr(10 * 1024), Max: float64Ptr(100 * 1024)},
+	{Name: "100k-1m", Min: float64Ptr(100 * 1024), Max: float64Ptr(1024 * 1024)},
+	{Name: ">=1m", Min: float64Ptr(1024 * 1024), Max: nil},
+}
+
+var FIELD_FILTER_PATTERN = regexp.MustCompile(`(?i)(?:^|\s)(size|encoding):(\S+)`)
+
+var SIZE_FILTER_PATTERN = regexp.MustCompile(`(?i)^(>=|<=|>|<)?([0-9]+(?:\.[0-9]+)?)([kmg]?)b?$`)
+
+// ExtractFieldFilters moves "size:" and "encoding:" terms from the query string into the filter params,
+// because the query string parser can't handle range syntax and case-insensitive keywords.
+// It returns the remaining query string and the merged filter params.
+func ExtractFieldFilters(queryString string, filterParams FilterParams) (string, FilterParams) {
+	sizes := append([]string{}, filterParams.Sizes...)
+	encodings := append([]string{}, filterParams.Encodings...)
+
+	for _, group := range FIELD_FILTER_PATTERN.FindAllStringSubmatch(queryString, -1) {
+		switch strings.ToLower(group[1]) {
+		case "size":
+			sizes = append(sizes, group[2])
+		case "encoding":
+			encodings = append(encodings, group[2])
+		}
+	}
+
+	filterParams.Sizes = sizes
+	filterParams.Encodings = encodings
+
+	return strings.Join(strings.Fields(FIELD_FILTER_PATTERN.ReplaceAllString(queryString, " ")), " "), filterParams
+}
+
+var GREP_FIELD_TERM_PATTERN = regexp.MustCompile(`^[+-]?\w+:`)
+
+// ExtractGrepTerms extracts the plain terms and phrases from the query string for "git grep".
+// The field queries and the excluded terms are dropped. all is false if the query has "OR",
+// so the files having any of the terms match.
+func ExtractGrepTerms(queryString string) ([]string, bool) {
+	queryString, _ = ExtractFieldFilters(queryString, FilterParams{})
+
+	terms := []string{}
+	all := true
+
+	for i, phrase := range strings.Split(queryString, `"`) {
+		// the odd parts are in the quotes
+		if i%2 == 1 {
+			if phrase != "" {
+				terms = append(terms, phrase)
+			}
+			continue
+		}
+		for _, token := range strings.Fields(phrase) {
+			switch token {
+			case "OR", "||":
+				all = false
+				continue
+			case "AND", "&&", "NOT":
+				continue
+			}
+			if strings.HasPrefix(token, "-") || strings.HasPrefix(token, "!") || GREP_FIELD_TERM_PATTERN.MatchString(token) {
+				continue
+			}
+			token = strings.Trim(strings.TrimPrefix(token, "+"), "()*")
+			if token != "" {
+				terms = append(terms, token)
+			}
+		}
+	}
+	return terms, all
+}
+
+// ParseSizeRange parses the size filter expression.
+// The supported forms are ">N", ">=N", "<N", "<=N" and "N" (exact size).
+// N is bytes and can have k, m or g suffix (1k = 1024 bytes).
+func ParseSizeRange(expr string) (SizeRange, error) {
+	group := SIZE_FILTER_PATTERN.FindStringSubmatch(strings.TrimSpace(expr))
+	if group == nil {
+		return SizeRange{}, errors.Errorf("Invalid size filter: %s", expr)
+	}
+
+	size, err := strconv.ParseFloat(group[2], 64)
+	if err != nil {
+		return SizeRange{}, errors.Wrapf(err, "Invalid size filter: %s", expr)
+	}
+
+	switch strings.ToLower(group[3]) {
+	case "k":
+		size = size * 1024
+	case "m":
+		size = size * 1024 * 1024
+	case "g":
+		size = size * 1024 * 1024 * 1024
+	}
+
+	switch group[1] {
+	case ">":
+		return SizeRange{Min: &size, InclusiveMin: false}, nil
+	case ">=":
+		return SizeRange{Min: &size, InclusiveMin: true}, nil
+	case "<":
+		return SizeRange{Max: &size, InclusiveMax: false}, nil
+	case "<=":
+		return SizeRange{Max: &size, InclusiveMax: true}, nil
+	}
+	return SizeRange{Min: &size, Max: &size, InclusiveMin: true, InclusiveMax: true}, nil
+}
+
+func float64Ptr(f float64) *float64 {
+	return &f
 }
 
 func getGitRepo(reader *repo.GitRepoReader, fileIndex *FileIndex) (*repo.GitRepo, error) {
@@ -240,9 +840,11 @@ func mergeRef2(fileIndex *FileIndex, refs []string, currentRefs []string, refTyp
 	return false, addRefs, addFullRefs
 }
 
+// removeRef removes the branches from the branches and the tags from the tags of the document.
+// It returns true if the document doesn't have any refs.
 func removeRef(fileIndex *FileIndex, branches []string, tags []string) bool {
 	newBranches := removeRef2(branches, fileIndex.Metadata.Branches)
-	newTags := removeRef2(branches, fileIndex.Metadata.Tags)
+	newTags := removeRef2(tags, fileIndex.Metadata.Tags)
 
 	// All delete case
 	if len(newBranches) == 0 && len(newTags) == 0 {
@@ -0,0 +1,326 @@
+package indexer
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/search"
+	"github.com/wadahiro/gitss/server/config"
+)
+
+func TestParseSizeRange(t *testing.T) {
+	r, err := ParseSizeRange(">100k")
+	if err != nil {
+		t.Errorf("Unexpected returned err %+v", err)
+	}
+	if r.Min == nil || *r.Min != 100*1024 || r.InclusiveMin || r.Max != nil {
+		t.Errorf("Unexpected range for >100k: %#v", r)
+	}
+
+	r, err = ParseSizeRange("<=1MB")
+	if err != nil {
+		t.Errorf("Unexpected returned err %+v", err)
+	}
+	if r.Max == nil || *r.Max != 1024*1024 || !r.InclusiveMax || r.Min != nil {
+		t.Errorf("Unexpected range for <=1MB: %#v", r)
+	}
+
+	r, err = ParseSizeRange("512")
+	if err != nil {
+		t.Errorf("Unexpected returned err %+v", err)
+	}
+	if r.Min == nil || r.Max == nil || *r.Min != 512 || *r.Max != 512 {
+		t.Errorf("Unexpected range for 512: %#v", r)
+	}
+
+	_, err = ParseSizeRange(">abc")
+	if err == nil {
+		t.Errorf("Expected err for >abc")
+	}
+}
+
+func TestExtractFieldFilters(t *testing.T) {
+	q, f := ExtractFieldFilters("foo size:>100k bar encoding:Shift_JIS size:<1m", FilterParams{Sizes: []string{">1"}})
+
+	if q != "foo bar" {
+		t.Errorf("got %v, want %v", q, "foo bar")
+	}
+	if !reflect.DeepEqual(f.Sizes, []string{">1", ">100k", "<1m"}) {
+		t.Errorf("Unexpected sizes %#v", f.Sizes)
+	}
+	if !reflect.DeepEqual(f.Encodings, []string{"Shift_JIS"}) {
+		t.Errorf("Unexpected encodings %#v", f.Encodings)
+	}
+
+	q, f = ExtractFieldFilters("size:>1m", FilterParams{})
+	if q != "" {
+		t.Errorf("got %v, want empty query", q)
+	}
+	if !reflect.DeepEqual(f.Sizes, []string{">1m"}) {
+		t.Errorf("Unexpected sizes %#v", f.Sizes)
+	}
+}
+
+func TestReplaceQueryTerms(t *testing.T) {
+	q := `getUsrName path:src/main "fooo bar" AND baz`
+	terms := extractQueryTerms(q)
+
+	actual := []string{}
+	for _, term := range terms {
+		actual = append(actual, term.Term)
+	}
+	if !reflect.DeepEqual(actual, []string{"getUsrName", "fooo", "bar", "baz"}) {
+		t.Errorf("Unexpected terms %#v", actual)
+	}
+
+	replaced := replaceQueryTerms(q, terms, []string{"getusername", "foo", "", ""})
+	expected := `getusername path:src/main "foo bar" AND baz`
+	if replaced != expected {
+		t.Errorf("got %v, want %v", replaced, expected)
+	}
+}
+
+func TestIdentifierTokenizer(t *testing.T) {
+	tokens := (&IdentifierTokenizer{}).Tokenize([]byte("func (r *GitRepo) GetBlobSize(blob string) (int64, error) { x := 1 }"))
+
+	actual := []string{}
+	for _, token := range tokens {
+		actual = append(actual, string(token.Term))
+	}
+	expected := []string{"func", "GitRepo", "GetBlobSize", "blob", "string", "int64", "error"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %v, want %v", actual, expected)
+	}
+}
+
+func TestBasenameTokenizer(t *testing.T) {
+	tokens := (&BasenameTokenizer{}).Tokenize([]byte("server/indexer/indexer.go"))
+	if len(tokens) != 1 || string(tokens[0].Term) != "indexer.go" {
+		t.Errorf("Unexpected tokens %v", tokens)
+	}
+
+	tokens = (&BasenameTokenizer{}).Tokenize([]byte("README.md"))
+	if len(tokens) != 1 || string(tokens[0].Term) != "README.md" {
+		t.Errorf("Unexpected tokens %v", tokens)
+	}
+}
+
+func TestMatchPathPattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{"vendor/", "vendor/github.com/foo/bar.go", true},
+		{"vendor/", "src/vendor/foo.go", true},
+		{"vendor/", "src/vendor.go", false},
+		{"/test/", "test/foo_test.go", true},
+		{"/test/", "src/test/foo_test.go", false},
+		{"src/test/", "module/src/test/Foo.java", true},
+		{"*.min.js", "static/js/jquery.min.js", true},
+		{"*.min.js", "static/js/main.js", false},
+		{"docs/*.md", "docs/README.md", true},
+		{"docs/*.md", "docs/api/README.md", false},
+	}
+
+	for _, test := range tests {
+		actual := matchPathPattern(test.pattern, test.path)
+		if actual != test.expected {
+			t.Errorf("matchPathPattern(%v, %v): got %v, want %v", test.pattern, test.path, actual, test.expected)
+		}
+	}
+}
+
+func TestRankingBoosts(t *testing.T) {
+	setting := config.RankingSetting{DefaultBranchBoost: 1.5, FilenameBoost: 2.0, PathBoost: 1.2, DemotePaths: []string{"vendor/"}, DemoteBoost: 0.5}
+
+	boosts := rankingBoosts(setting, "master", []string{"master", "develop"}, "server/repo/git_repo.go", []string{"GitRepo"})
+	if len(boosts) != 2 || boosts[0].Boost != setting.DefaultBranchBoost || boosts[1].Boost != setting.FilenameBoost {
+		t.Errorf("Unexpected boosts %v", boosts)
+	}
+
+	boosts = rankingBoosts(setting, "master", []string{"develop"}, "vendor/repo/utils.go", []string{"repo"})
+	if len(boosts) != 2 || boosts[0].Boost != setting.PathBoost || boosts[1].Boost != setting.DemoteBoost {
+		t.Errorf("Unexpected boosts %v", boosts)
+	}
+
+	// the default branch of the setting overrides the default branch of the repository
+	setting.DefaultBranch = "develop"
+	boosts = rankingBoosts(setting, "master", []string{"develop"}, "README.md", []string{})
+	if len(boosts) != 1 || boosts[0].Name != "default branch boost (develop)" {
+		t.Errorf("Unexpected boosts %v", boosts)
+	}
+
+	// the default setting doesn't change the score
+	for _, boost := range rankingBoosts(config.DefaultRankingSetting(), "master", []string{"master"}, "server/repo/git_repo.go", []string{"GitRepo"}) {
+		if boost.Boost != 1.0 {
+			t.Errorf("got %v, want 1.0 for %s", boost.Boost, boost.Name)
+		}
+	}
+}
+
+func TestBuildRefCounts(t *testing.T) {
+	dates := map[string]time.Time{
+		"v1.0": time.Unix(100, 0),
+		"v2.0": time.Unix(300, 0),
+		"v1.1": time.Unix(200, 0),
+	}
+	counts := map[string]int{"v1.0": 5, "v1.1": 3}
+
+	tags := buildRefCounts([]string{"v1.0", "v1.1", "v2.0"}, counts, dates)
+	sort.Sort(RefCountsByDate(tags))
+
+	actual := []string{}
+	for _, tag := range tags {
+		actual = append(actual, fmt.Sprintf("%s=%d", tag.Ref, tag.Count))
+	}
+	expected := []string{"v1.0=5", "v1.1=3", "v2.0=0"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %v, want %v", actual, expected)
+	}
+}
+
+func TestBuildPathVersions(t *testing.T) {
+	files := []FileIndex{
+		{Metadata: Metadata{Blob: "aaa", Branches: []string{"master"}, Tags: []string{"v2.0"}}},
+		{Metadata: Metadata{Blob: "bbb", Branches: []string{}, Tags: []string{"v1.1", "v1.0"}}},
+	}
+	dates := map[string]time.Time{
+		"v1.0": time.Unix(100, 0),
+		"v1.1": time.Unix(200, 0),
+		"v2.0": time.Unix(300, 0),
+	}
+
+	versions := buildPathVersions(files, map[string]time.Time{}, dates)
+
+	actual := []string{}
+	for _, v := range versions {
+		actual = append(actual, fmt.Sprintf("%s=%v%v", v.Blob, v.Branches, v.Tags))
+	}
+	expected := []string{"aaa=[master][v2.0]", "bbb=[][v1.0 v1.1]"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %v, want %v", actual, expected)
+	}
+
+	missing := missingRefs(map[string]string{"v1.0": "", "v1.1": "", "v2.0": "", "v0.9": ""}, versions, func(v PathVersion) []string { return v.Tags })
+	if !reflect.DeepEqual(missing, []string{"v0.9"}) {
+		t.Errorf("got %v, want [v0.9]", missing)
+	}
+}
+
+func TestCountOccurrences(t *testing.T) {
+	hit := &search.DocumentMatch{
+		Locations: search.FieldTermLocationMap{
+			"content": search.TermLocationMap{
+				"foo": search.Locations{&search.Location{}, &search.Location{}},
+				"bar": search.Locations{&search.Location{}},
+			},
+			"path": search.TermLocationMap{
+				"foo": search.Locations{&search.Location{}},
+			},
+		},
+	}
+	if count := countOccurrences(hit); count != 3 {
+		t.Errorf("got %v, want 3", count)
+	}
+}
+
+func TestWinnow(t *testing.T) {
+	content := `func add(a int, b int) int {
+	sum := a + b
+	return sum
+}
+`
+	reformatted := `func add(a int, b int) int { sum := a + b; return sum }`
+
+	fingerprints := Winnow(content)
+	if len(fingerprints) == 0 {
+		t.Errorf("Unexpected empty fingerprints")
+	}
+
+	hashes := make(map[uint64]struct{})
+	for _, f := range Winnow(reformatted) {
+		hashes[f.Hash] = struct{}{}
+	}
+
+	similarity, lines := matchFingerprints(hashes, fingerprints)
+	if similarity < 0.5 {
+		t.Errorf("got %v, want >= 0.5", similarity)
+	}
+	if len(lines) != 1 || lines[0].Start != 1 || lines[0].End > 4 {
+		t.Errorf("Unexpected lines %v", lines)
+	}
+
+	if len(Winnow("a b")) != 0 {
+		t.Errorf("Unexpected fingerprints for the short content")
+	}
+}
+
+func TestEncodeFingerprints(t *testing.T) {
+	fingerprints := []Fingerprint{{Hash: 0xabc, StartLine: 1, EndLine: 3}, {Hash: 0x12, StartLine: 5, EndLine: 5}}
+
+	actual := decodeFingerprints(encodeFingerprints(fingerprints))
+	if !reflect.DeepEqual(actual, fingerprints) {
+		t.Errorf("got %v, want %v", actual, fingerprints)
+	}
+}
+
+func TestCountRangeLines(t *testing.T) {
+	if lines := countLines("a\nb\nc"); lines != 3 {
+		t.Errorf("got %v, want 3", lines)
+	}
+	if lines := countLines("a\nb\n"); lines != 2 {
+		t.Errorf("got %v, want 2", lines)
+	}
+	if lines := countRangeLines([]LineRange{{Start: 1, End: 3}, {Start: 10, End: 10}}); lines != 4 {
+		t.Errorf("got %v, want 4", lines)
+	}
+}
+
+func TestExtractGrepTerms(t *testing.T) {
+	terms, all := ExtractGrepTerms(`foo +bar -baz ext:go size:>1k "hello world"`)
+	if !reflect.DeepEqual(terms, []string{"foo", "bar", "hello world"}) || !all {
+		t.Errorf("got %v %v, want [foo bar hello world] true", terms, all)
+	}
+
+	terms, all = ExtractGrepTerms(`(foo OR bar*)`)
+	if !reflect.DeepEqual(terms, []string{"foo", "bar"}) || all {
+		t.Errorf("got %v %v, want [foo bar] false", terms, all)
+	}
+}
+
+func TestRemoveRef(t *testing.T) {
+	tests := []struct {
+		branches     []string
+		tags         []string
+		wantRemoved  bool
+		wantBranches []string
+		wantTags     []string
+	}{
+		{[]string{"master"}, []string{}, false, []string{"develop"}, []string{"v1", "v2"}},
+		{[]string{}, []string{"v1"}, false, []string{"master", "develop"}, []string{"v2"}},
+		// a branch name doesn't remove the tag of the same name
+		{[]string{"v1"}, []string{}, false, []string{"master", "develop"}, []string{"v1", "v2"}},
+		{[]string{"master", "develop"}, []string{"v1", "v2"}, true, nil, nil},
+	}
+	for _, test := range tests {
+		f := &FileIndex{}
+		f.Metadata.Branches = []string{"master", "develop"}
+		f.Metadata.Tags = []string{"v1", "v2"}
+
+		removed := removeRef(f, test.branches, test.tags)
+		if removed != test.wantRemoved {
+			t.Errorf("removeRef(%v, %v): got %v, want %v", test.branches, test.tags, removed, test.wantRemoved)
+			continue
+		}
+		if removed {
+			continue
+		}
+		if !reflect.DeepEqual(f.Metadata.Branches, test.wantBranches) || !reflect.DeepEqual(f.Metadata.Tags, test.wantTags) {
+			t.Errorf("removeRef(%v, %v): got %v %v, want %v %v", test.branches, test.tags, f.Metadata.Branches, f.Metadata.Tags, test.wantBranches, test.wantTags)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package indexer
+
+import (
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/wadahiro/gitss/server/config"
+	"github.com/wadahiro/gitss/server/util"
+)
+
+// The number of top hits which are re-ranked by the ranking boosts
+const RANKING_WINDOW = 100
+
+// The fields loaded for the re-ranking. The other fields and the highlights are loaded for the returned page only.
+var RANKING_FIELDS = []string{"organization", "project", "repository", "branches", "path"}
+
+type RankingBoost struct {
+	Name  string
+	Boost float64
+}
+
+// rankingBoosts returns the boosts of the ranking setting which apply to the hit.
+// The default branch of the setting takes priority over the default branch of the repository.
+// The filename boost takes priority over the path boost, and only the first matched demotion pattern is used.
+func rankingBoosts(setting config.RankingSetting, defaultBranch string, branches []string, filePath string, terms []string) []RankingBoost {
+	boosts := []RankingBoost{}
+
+	if setting.DefaultBranch != "" {
+		defaultBranch = setting.DefaultBranch
+	}
+	if defaultBranch != "" && util.ContainsString(branches, defaultBranch) {
+		boosts = append(boosts, RankingBoost{Name: "default branch boost (" + defaultBranch + ")", Boost: setting.DefaultBranchBoost})
+	}
+
+	dir, file := path.Split(filePath)
+	if term, ok := matchPathTerms(file, terms); ok {
+		boosts = append(boosts, RankingBoost{Name: "filename match boost (" + term + ")", Boost: setting.FilenameBoost})
+	} else if term, ok := matchPathTerms(dir, terms); ok {
+		boosts = append(boosts, RankingBoost{Name: "path match boost (" + term + ")", Boost: setting.PathBoost})
+	}
+
+	for _, pattern := range setting.DemotePaths {
+		if matchPathPattern(pattern, filePath) {
+			boosts = append(boosts, RankingBoost{Name: "demoted path (" + pattern + ")", Boost: setting.DemoteBoost})
+			break
+		}
+	}
+
+	return boosts
+}
+
+// matchPathTerms finds the query term in the path.
+// Case, "_" and "-" are ignored, so "GitRepo" matches "git_repo.go".
+func matchPathTerms(p string, terms []string) (string, bool) {
+	normalized := normalizePathTerm(p)
+	for _, term := range terms {
+		t := normalizePathTerm(term)
+		if utf8.RuneCountInString(t) < 2 {
+			continue
+		}
+		if strings.Contains(normalized, t) {
+			return term, true
+		}
+	}
+	return "", false
+}
+
+func normalizePathTerm(s string) string {
+	s = strings.ToLower(s)
+	s = strings.Replace(s, "_", "", -1)
+	s = strings.Replace(s, "-", "", -1)
+	return s
+}
+
+// matchPathPattern matches the file path with the glob pattern.
+// The pattern ending with "/" matches the directory, otherwise matches the file.
+// The pattern starting with "/" matches from the root, otherwise matches at any depth.
+func matchPathPattern(pattern string, filePath string) bool {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	anchored := strings.HasPrefix(pattern, "/")
+
+	pattern = strings.Trim(pattern, "/")
+	if pattern == "" {
+		return false
+	}
+
+	patterns := strings.Split(pattern, "/")
+	segments := strings.Split(strings.Trim(filePath, "/"), "/")
+
+	for start := 0; start+len(patterns) <= len(segments); start++ {
+		if anchored && start > 0 {
+			break
+		}
+
+		end := start + len(patterns)
+		if dirOnly && end == len(segments) {
+			// the last segment is the file
+			break
+		}
+		if !dirOnly && end != len(segments) {
+			continue
+		}
+
+		if matchSegments(patterns, segments[start:end]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(patterns []string, segments []string) bool {
+	for i := range patterns {
+		matched, err := path.Match(patterns[i], segments[i])
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
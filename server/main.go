@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/codegangsta/cli"
 
@@ -47,6 +55,12 @@ func main() {
 					Value: "0 */10 * * * *",
 					Usage: "Sync schedule",
 				},
+				cli.StringFlag{
+					Name:   "admin-token",
+					Value:  "",
+					Usage:  "Enable the sync API for the requests with \"Authorization: Bearer <token>\" header. The API is disabled if not specified",
+					EnvVar: "GITSS_ADMIN_TOKEN",
+				},
 			},
 		},
 		{
@@ -94,6 +108,99 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:      "replace",
+			Usage:     "Make search-and-replace patches from the git mirrors",
+			ArgsUsage: "SEARCH REPLACEMENT",
+			Action:    Replace,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "regex",
+					Usage: "Use SEARCH as regex pattern. REPLACEMENT can use $1 style references",
+				},
+				cli.StringSliceFlag{
+					Name:  "organization",
+					Usage: "Set the organizations to replace",
+				},
+				cli.StringSliceFlag{
+					Name:  "project",
+					Usage: "Set the projects to replace",
+				},
+				cli.StringSliceFlag{
+					Name:  "repository",
+					Usage: "Set the repositories to replace",
+				},
+				cli.StringSliceFlag{
+					Name:  "branch",
+					Usage: "Set the branches to replace",
+				},
+				cli.StringSliceFlag{
+					Name:  "tag",
+					Usage: "Set the tags to replace",
+				},
+				cli.StringSliceFlag{
+					Name:  "ext",
+					Usage: "Set the file extensions to replace (e.g. .java)",
+				},
+				cli.StringFlag{
+					Name:  "out",
+					Value: "",
+					Usage: "Output directory of the patch files. The patches are printed to stdout if not specified",
+				},
+				cli.IntFlag{
+					Name:  "max-patches",
+					Value: service.REPLACE_CLI_MAX_PATCHES,
+					Usage: "Stop making the patches at this number. 0 is unlimited",
+				},
+				cli.Int64Flag{
+					Name:  "max-bytes",
+					Value: service.REPLACE_CLI_MAX_BYTES,
+					Usage: "Stop making the patches at this total size (byte). 0 is unlimited",
+				},
+			},
+		},
+		{
+			Name:      "report",
+			Usage:     "Report commands",
+			ArgsUsage: "",
+			Subcommands: []cli.Command{
+				{
+					Name:   "duplicates",
+					Usage:  "Report the identical files and the duplicated blocks across the repositories",
+					Action: ReportDuplicates,
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "size",
+							Value: indexer.DEFAULT_REPORT_SIZE,
+							Usage: "The number of the identical files and the duplicated blocks",
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print the report as JSON",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:      "shard",
+			Usage:     "Sharded index commands",
+			ArgsUsage: "",
+			Subcommands: []cli.Command{
+				{
+					Name:      "drop",
+					Usage:     "Drop the shard of the repository (or the organization). The repositories are indexed again by the next syncing",
+					ArgsUsage: "ORGANIZATION [PROJECT REPOSITORY]",
+					Action:    DropShard,
+				},
+				{
+					Name:      "rebuild",
+					Usage:     "Drop the shard of the repository (or the organization), then index the repositories again",
+					ArgsUsage: "ORGANIZATION [PROJECT REPOSITORY]",
+					Action:    RebuildShard,
+				},
+			},
+		},
 		{
 			Name:      "bitbucket",
 			Usage:     "Bitbucket server related commands",
@@ -176,6 +283,45 @@ func main() {
 			Value: "bleve",
 			Usage: "Indexer implementation",
 		},
+		cli.StringFlag{
+			Name:  "shard",
+			Value: "",
+			Usage: "Split the bleve index per \"organization\" or per \"repository\". The single index is used if not specified",
+		},
+		cli.StringFlag{
+			Name:  "es-url",
+			Value: "http://127.0.0.1:9200",
+			Usage: "Set the URL of the elasticsearch used by the \"es\" indexer",
+		},
+		cli.BoolFlag{
+			Name:  "store-content",
+			Usage: "Store the compressed content in the bleve index to make the previews without the git repositories",
+		},
+		cli.IntFlag{
+			Name:  "sync-workers",
+			Value: 2,
+			Usage: "Set the number of the repositories synced at the same time",
+		},
+		cli.IntFlag{
+			Name:  "scan-workers",
+			Value: 3,
+			Usage: "Set the number of the goroutines reading the blobs of a repository",
+		},
+		cli.IntFlag{
+			Name:  "queue-size",
+			Value: 100,
+			Usage: "Set the size of the queue between the blob reading and the indexing",
+		},
+		cli.Int64Flag{
+			Name:  "batch-size",
+			Value: 1024 * 512,
+			Usage: "Set the initial size of an index batch in bytes",
+		},
+		cli.Int64Flag{
+			Name:  "batch-latency",
+			Value: 1000,
+			Usage: "Set the target latency of an index batch in milliseconds. The batch size is adjusted to keep it",
+		},
 	}
 	app.Run(args)
 }
@@ -196,11 +342,39 @@ func RunServer(c *cli.Context) {
 	log.Println("-----------------------------------------")
 
 	reader := repo.NewGitRepoReader(config)
-	indexer := newIndexer(config, reader)
+	indexer, err := newIndexer(config, reader)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer indexer.Close()
+
+	closeOnSignal(indexer)
+
 	importer := importer.NewGitImporter(config, indexer)
 	service.RunSyncScheduler(config, importer)
 
-	initRouter(config, indexer)
+	initRouter(config, indexer, importer)
+}
+
+// closeOnSignal closes the indexer when the server is stopped by the signal,
+// so the index files are released after the requests in flight.
+func closeOnSignal(indexer indexer.Indexer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v. Closing the indexer.\n", sig)
+
+		service.StopSyncScheduler()
+		repo.CloseCatFilePools()
+
+		if err := indexer.Close(); err != nil {
+			log.Printf("Failed to close the indexer. %+v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
 }
 
 func Sync(c *cli.Context) error {
@@ -210,7 +384,12 @@ func Sync(c *cli.Context) error {
 
 	config := config.NewConfig(c, debugMode)
 	reader := repo.NewGitRepoReader(config)
-	indexer := newIndexer(config, reader)
+	indexer, err := newIndexer(config, reader)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer indexer.Close()
+
 	importer := importer.NewGitImporter(config, indexer)
 
 	if all {
@@ -298,6 +477,162 @@ func AddBitbucketServerSetting(c *cli.Context) error {
 	return nil
 }
 
+func Replace(c *cli.Context) error {
+	debugMode := isDebugMode()
+
+	if len(c.Args()) != 2 {
+		return cli.NewExitError("Please specified "+c.Command.ArgsUsage, 1)
+	}
+
+	config := config.NewConfig(c, debugMode)
+	reader := repo.NewGitRepoReader(config)
+
+	request := service.ReplaceRequest{
+		Search:  c.Args()[0],
+		Replace: c.Args()[1],
+		Regex:   c.Bool("regex"),
+		FilterParams: indexer.FilterParams{
+			Organizations: c.StringSlice("organization"),
+			Projects:      c.StringSlice("project"),
+			Repositories:  c.StringSlice("repository"),
+			Branches:      c.StringSlice("branch"),
+			Tags:          c.StringSlice("tag"),
+			Exts:          c.StringSlice("ext"),
+		},
+	}
+
+	limits := service.ReplaceLimits{MaxPatches: c.Int("max-patches"), MaxBytes: c.Int64("max-bytes")}
+
+	result, err := service.RunReplace(context.Background(), config, reader, request, limits)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	if result.Partial {
+		log.Println("The patches are partial by the limits. Change --max-patches or --max-bytes to make more patches.")
+	}
+
+	out := c.String("out")
+
+	for _, patch := range result.Patches {
+		if out == "" {
+			// git apply skips the leading comment line
+			fmt.Printf("# %s:%s/%s %s:%s %s\n", patch.Organization, patch.Project, patch.Repository, patch.RefType, patch.Ref, patch.CommitId)
+			fmt.Print(patch.Patch)
+			continue
+		}
+
+		// out/org/project/repo/branch/master.patch
+		file := filepath.Join(out, patch.Organization, patch.Project, patch.Repository, patch.RefType, patch.Ref+".patch")
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		if err := ioutil.WriteFile(file, []byte(patch.Patch), 0644); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		log.Printf("Wrote %s (%d files)\n", file, patch.Files)
+	}
+	return nil
+}
+
+func ReportDuplicates(c *cli.Context) error {
+	debugMode := isDebugMode()
+
+	config := config.NewConfig(c, debugMode)
+	reader := repo.NewGitRepoReader(config)
+	indexer, err := newIndexer(config, reader)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer indexer.Close()
+
+	report, err := indexer.ReportDuplicates(c.Int("size"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	if c.Bool("json") {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	fmt.Println("# Identical files")
+	for _, f := range report.IdenticalFiles {
+		fmt.Printf("%d lines x %d copies (blob %s)\n", f.Lines, f.Copies, f.Blob)
+		for _, l := range f.Locations {
+			fmt.Printf("  %s:%s/%s %s\n", l.Organization, l.Project, l.Repository, l.Path)
+		}
+	}
+
+	fmt.Println("\n# Duplicated blocks")
+	for _, block := range report.DuplicatedBlocks {
+		fmt.Printf("%d lines\n", block.DuplicatedLines)
+		for _, f := range block.Files {
+			lines := []string{}
+			for _, r := range f.Lines {
+				lines = append(lines, fmt.Sprintf("L%d-%d", r.Start, r.End))
+			}
+			for _, l := range f.Locations {
+				fmt.Printf("  %s:%s/%s %s %s\n", l.Organization, l.Project, l.Repository, l.Path, strings.Join(lines, ","))
+			}
+		}
+	}
+	return nil
+}
+
+func DropShard(c *cli.Context) error {
+	return runShardCommand(c, func(config *config.Config, indexer indexer.Indexer, organization, project, repository string) error {
+		return service.DropShard(config, indexer, organization, project, repository)
+	})
+}
+
+func RebuildShard(c *cli.Context) error {
+	return runShardCommand(c, func(config *config.Config, indexer indexer.Indexer, organization, project, repository string) error {
+		importer := importer.NewGitImporter(config, indexer)
+		return service.RebuildShard(config, importer, indexer, organization, project, repository)
+	})
+}
+
+func runShardCommand(c *cli.Context, command func(config *config.Config, indexer indexer.Indexer, organization, project, repository string) error) error {
+	debugMode := isDebugMode()
+
+	if len(c.Args()) != 1 && len(c.Args()) != 3 {
+		return cli.NewExitError("Please specified "+c.Command.ArgsUsage, 1)
+	}
+
+	config := config.NewConfig(c, debugMode)
+	if config.IndexShard == "" {
+		return cli.NewExitError("The index isn't sharded. Please specified --shard option", 1)
+	}
+	if config.IndexShard == indexer.SHARD_REPOSITORY && len(c.Args()) != 3 {
+		return cli.NewExitError("Please specified PROJECT and REPOSITORY in the repository shard mode", 1)
+	}
+
+	reader := repo.NewGitRepoReader(config)
+	indexer, err := newIndexer(config, reader)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer indexer.Close()
+
+	organization := c.Args()[0]
+	project := ""
+	repository := ""
+	if len(c.Args()) == 3 {
+		project = c.Args()[1]
+		repository = c.Args()[2]
+	}
+
+	err = command(config, indexer, organization, project, repository)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
 func regex(pattern string) string {
 	regexp.MustCompile(pattern)
 	return pattern
@@ -307,12 +642,12 @@ func isDebugMode() bool {
 	return BuildTarget == "develop"
 }
 
-func newIndexer(config *config.Config, reader *repo.GitRepoReader) indexer.Indexer {
+func newIndexer(config *config.Config, reader *repo.GitRepoReader) (indexer.Indexer, error) {
 	switch config.IndexerType {
 	case "bleve":
 		return indexer.NewBleveIndexer(config, reader)
 	case "es":
 		return indexer.NewESIndexer(config, reader)
 	}
-	panic("Unknown Indexer type")
+	return nil, fmt.Errorf("Unknown indexer type: %s", config.IndexerType)
 }
@@ -0,0 +1,299 @@
+package repo
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The max number of the "git cat-file --batch" processes per repository.
+// The blob reads more than this wait for a free process.
+const CAT_FILE_POOL_SIZE = 4
+
+// The idle processes are stopped and the pool is removed after this time
+const CAT_FILE_IDLE_TIMEOUT = 1 * time.Minute
+
+// The time to read a blob. The process which doesn't respond in this time is killed and replaced.
+const CAT_FILE_READ_TIMEOUT = 30 * time.Second
+
+// ErrBlobNotFound is returned when the object doesn't exist in the repository.
+var ErrBlobNotFound = errors.New("Blob not found")
+
+// ErrCatFileTimeout is returned when the process doesn't respond in the read timeout.
+var ErrCatFileTimeout = errors.New("git cat-file --batch timed out")
+
+var catFilePoolsMutex = new(sync.Mutex)
+var catFilePools = make(map[string]*CatFilePool)
+var catFileJanitor sync.Once
+
+// CatFilePool is the pool of the long-running "git cat-file --batch" processes of a repository.
+// The blob reads are multiplexed over the processes, and a crashed process is replaced by a new one.
+type CatFilePool struct {
+	repoPath    string
+	slots       chan struct{}
+	idle        chan *catFileProcess
+	readTimeout time.Duration
+	mutex       sync.Mutex
+	lastUsed    time.Time
+	closed      bool
+}
+
+type catFileProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// getCatFilePool returns the shared pool of the repository.
+// It marks the pool used, so the janitor doesn't remove it before the read.
+func getCatFilePool(repoPath string) *CatFilePool {
+	catFileJanitor.Do(func() {
+		go func() {
+			for range time.Tick(CAT_FILE_IDLE_TIMEOUT) {
+				closeIdleCatFilePools()
+			}
+		}()
+	})
+
+	catFilePoolsMutex.Lock()
+	defer catFilePoolsMutex.Unlock()
+
+	pool, ok := catFilePools[repoPath]
+	if !ok {
+		pool = &CatFilePool{
+			repoPath:    repoPath,
+			slots:       make(chan struct{}, CAT_FILE_POOL_SIZE),
+			idle:        make(chan *catFileProcess, CAT_FILE_POOL_SIZE),
+			readTimeout: CAT_FILE_READ_TIMEOUT,
+		}
+		catFilePools[repoPath] = pool
+	}
+
+	pool.mutex.Lock()
+	pool.lastUsed = time.Now()
+	pool.mutex.Unlock()
+
+	return pool
+}
+
+// closeIdleCatFilePools stops the processes of the pools unused for CAT_FILE_IDLE_TIMEOUT and removes the pools,
+// so the pools of the removed repositories don't stay in the map.
+func closeIdleCatFilePools() {
+	catFilePoolsMutex.Lock()
+	defer catFilePoolsMutex.Unlock()
+
+	for repoPath, pool := range catFilePools {
+		pool.mutex.Lock()
+		expired := time.Since(pool.lastUsed) > CAT_FILE_IDLE_TIMEOUT
+		pool.mutex.Unlock()
+
+		// a pool with a running read is removed at the next tick
+		if expired && len(pool.slots) == 0 {
+			pool.closeIdle()
+			delete(catFilePools, repoPath)
+		}
+	}
+}
+
+// CloseCatFilePools stops all processes. The blob reads after this fail.
+func CloseCatFilePools() {
+	catFilePoolsMutex.Lock()
+	defer catFilePoolsMutex.Unlock()
+
+	for _, pool := range catFilePools {
+		pool.mutex.Lock()
+		pool.closed = true
+		pool.mutex.Unlock()
+
+		pool.closeIdle()
+	}
+}
+
+// ReadBlob returns the content of the blob.
+// If the process is broken, it's retried once with a newly started process since the other idle ones may be broken too.
+// The read isn't retried after the timeout not to wait twice.
+func (p *CatFilePool) ReadBlob(blob string) ([]byte, error) {
+	// The object name must not break the line-based protocol
+	if blob == "" || strings.ContainsAny(blob, " \t\r\n") {
+		return nil, errors.Errorf("Invalid blob: %q", blob)
+	}
+
+	var lastErr error
+	for retry := 0; retry < 2; retry++ {
+		process, err := p.get(retry > 0)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := process.read(blob, p.readTimeout)
+		if err == nil || errors.Cause(err) == ErrBlobNotFound {
+			p.put(process)
+			return content, err
+		}
+
+		log.Printf("git cat-file --batch process is broken in %s. Restarting. %+v", p.repoPath, err)
+		process.kill()
+		p.release()
+		if errors.Cause(err) == ErrCatFileTimeout {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// get takes an idle process or starts a new one. It waits while all processes are busy.
+// If fresh is true, it always starts a new process.
+func (p *CatFilePool) get(fresh bool) (*catFileProcess, error) {
+	p.slots <- struct{}{}
+
+	p.mutex.Lock()
+	closed := p.closed
+	p.lastUsed = time.Now()
+	p.mutex.Unlock()
+
+	if closed {
+		<-p.slots
+		return nil, errors.Errorf("The cat-file pool of %s is already closed", p.repoPath)
+	}
+
+	if !fresh {
+		select {
+		case process := <-p.idle:
+			return process, nil
+		default:
+		}
+	}
+
+	process, err := startCatFile(p.repoPath)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return process, nil
+}
+
+func (p *CatFilePool) put(process *catFileProcess) {
+	p.mutex.Lock()
+	closed := p.closed
+	p.mutex.Unlock()
+
+	if closed {
+		process.close()
+	} else {
+		// never blocks because the processes are limited by the slots
+		p.idle <- process
+	}
+	p.release()
+}
+
+func (p *CatFilePool) release() {
+	<-p.slots
+}
+
+func (p *CatFilePool) closeIdle() {
+	for {
+		select {
+		case process := <-p.idle:
+			process.close()
+		default:
+			return
+		}
+	}
+}
+
+func startCatFile(repoPath string) (*catFileProcess, error) {
+	cmd := exec.Command("git", "cat-file", "--batch")
+	cmd.Dir = repoPath
+
+	return startCatFileProcess(cmd)
+}
+
+func startCatFileProcess(cmd *exec.Cmd) (*catFileProcess, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, `Failed to start "git cat-file --batch" in %s`, cmd.Dir)
+	}
+
+	return &catFileProcess{cmd: cmd, stdin: stdin, stdout: bufio.NewReaderSize(stdout, 64*1024)}, nil
+}
+
+// read requests the object and reads the response in the timeout.
+// The process is killed at the timeout to stop the blocked read, so it can't be reused after ErrCatFileTimeout.
+func (c *catFileProcess) read(blob string, timeout time.Duration) ([]byte, error) {
+	timer := time.AfterFunc(timeout, func() {
+		c.cmd.Process.Kill()
+	})
+
+	content, err := c.readResponse(blob)
+
+	// the timer has fired if it can't be stopped, so the process is killed even if the response was read
+	if !timer.Stop() {
+		return nil, errors.Wrapf(ErrCatFileTimeout, "blob: %s, timeout: %v", blob, timeout)
+	}
+	return content, err
+}
+
+// readResponse requests the object and reads the response.
+// The response is "<sha> <type> <size>\n<content>\n", or "<name> missing\n" if it doesn't exist.
+func (c *catFileProcess) readResponse(blob string) ([]byte, error) {
+	if _, err := io.WriteString(c.stdin, blob+"\n"); err != nil {
+		return nil, errors.Wrap(err, "Failed to write the request")
+	}
+
+	header, err := c.stdout.ReadString('\n')
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the response header")
+	}
+
+	columns := strings.Fields(header)
+	if len(columns) == 2 && (columns[1] == "missing" || columns[1] == "ambiguous") {
+		return nil, errors.Wrapf(ErrBlobNotFound, "blob: %s", blob)
+	}
+	if len(columns) != 3 {
+		return nil, errors.Errorf("Unexpected response header: %q", header)
+	}
+
+	size, err := strconv.Atoi(columns[2])
+	if err != nil {
+		return nil, errors.Errorf("Unexpected response header: %q", header)
+	}
+
+	// the content is followed by a newline
+	content := make([]byte, size+1)
+	if _, err := io.ReadFull(c.stdout, content); err != nil {
+		return nil, errors.Wrap(err, "Failed to read the content")
+	}
+
+	if columns[1] != "blob" {
+		return nil, errors.Wrapf(ErrBlobNotFound, "%s is %s", blob, columns[1])
+	}
+	return content[:size], nil
+}
+
+// close stops the process by closing the stdin.
+func (c *catFileProcess) close() {
+	c.stdin.Close()
+	c.cmd.Wait()
+}
+
+func (c *catFileProcess) kill() {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+}
@@ -0,0 +1,123 @@
+package repo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func gitOutput(t *testing.T, dir string, args ...string) []byte {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Failed to run git %v: %v", args, err)
+	}
+	return out
+}
+
+// newFixtureRepo makes a temp repository with a commit of README.md.
+func newFixtureRepo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gitss-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("# fixture\n\nThe content of the fixture.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitOutput(t, dir, "init", "-q")
+	gitOutput(t, dir, "add", "README.md")
+	gitOutput(t, dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "fixture")
+	return dir
+}
+
+func TestCatFilePool(t *testing.T) {
+	dir := newFixtureRepo(t)
+	defer os.RemoveAll(dir)
+
+	blob := strings.TrimSpace(string(gitOutput(t, dir, "rev-parse", "HEAD:README.md")))
+	expected := gitOutput(t, dir, "cat-file", "blob", blob)
+
+	pool := getCatFilePool(dir)
+
+	var wg sync.WaitGroup
+	for i := 0; i < CAT_FILE_POOL_SIZE*3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content, err := pool.ReadBlob(blob)
+			if err != nil {
+				t.Errorf("Unexpected returned err %+v", err)
+			}
+			if !bytes.Equal(content, expected) {
+				t.Errorf("got %d bytes, want %d bytes", len(content), len(expected))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := pool.ReadBlob(strings.Repeat("0", 40)); errors.Cause(err) != ErrBlobNotFound {
+		t.Errorf("got %v, want %v", err, ErrBlobNotFound)
+	}
+
+	// kill the idle processes, then the next read must recover
+	for i := 0; i < len(pool.idle); i++ {
+		process := <-pool.idle
+		process.cmd.Process.Kill()
+		pool.idle <- process
+	}
+
+	content, err := pool.ReadBlob(blob)
+	if err != nil {
+		t.Errorf("Unexpected returned err %+v", err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Errorf("got %d bytes, want %d bytes", len(content), len(expected))
+	}
+
+	// the janitor removes the idle pool, then the next read uses a new one
+	pool.mutex.Lock()
+	pool.lastUsed = time.Now().Add(-2 * CAT_FILE_IDLE_TIMEOUT)
+	pool.mutex.Unlock()
+
+	closeIdleCatFilePools()
+
+	catFilePoolsMutex.Lock()
+	_, ok := catFilePools[dir]
+	catFilePoolsMutex.Unlock()
+	if ok {
+		t.Errorf("got the pool of %s, want removed", dir)
+	}
+	if len(pool.idle) != 0 {
+		t.Errorf("got %d idle processes, want 0", len(pool.idle))
+	}
+	if getCatFilePool(dir) == pool {
+		t.Errorf("got the removed pool, want a new pool")
+	}
+}
+
+func TestCatFileReadTimeout(t *testing.T) {
+	// the process reads the request but never responds
+	process, err := startCatFileProcess(exec.Command("sleep", "10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer process.kill()
+
+	start := time.Now()
+	_, err = process.read(strings.Repeat("0", 40), 100*time.Millisecond)
+	if errors.Cause(err) != ErrCatFileTimeout {
+		t.Errorf("got %v, want %v", err, ErrCatFileTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("got %v, want the read stopped at the timeout", elapsed)
+	}
+}
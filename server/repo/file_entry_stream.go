@@ -0,0 +1,521 @@
+package repo
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The number of the refs enumerated together. The blobs shared by the refs in a chunk are merged before indexing,
+// and the refs in the other chunks are merged by the indexer.
+const REF_CHUNK_SIZE = 32
+
+// The max number of the file entries kept in memory. The more entries are spilled to the sorted run files.
+const SPILL_RUN_SIZE = 100000
+
+const REF_TYPE_BRANCH = "branch"
+const REF_TYPE_TAG = "tag"
+
+// StreamFileEntries enumerates the file entries on the branches and tags chunk by chunk,
+// and calls the callback once per blob of each chunk with the merged locations.
+// The callback of the first chunk is called before the next chunk is enumerated,
+// so the indexing can start early. The memory is bounded by SPILL_RUN_SIZE entries.
+// The locations enumerated by the previous chunks are marked as Seen, and chunkDone is called after each chunk if it isn't nil.
+func (r *GitRepo) StreamFileEntries(branchesMap map[string]string, tagsMap map[string]string, callback func(blob string, file GitFile), chunkDone func()) error {
+	refs := sortedRefEntries(branchesMap, tagsMap)
+
+	seen, err := newSeenEntries(r.Config.DataDir)
+	if err != nil {
+		return err
+	}
+	defer seen.Close()
+
+	for start := 0; start < len(refs); start += REF_CHUNK_SIZE {
+		end := start + REF_CHUNK_SIZE
+		if end > len(refs) {
+			end = len(refs)
+		}
+
+		err := r.streamChunk(refs[start:end], seen, callback)
+		if err != nil {
+			return err
+		}
+		if chunkDone != nil {
+			chunkDone()
+		}
+	}
+	return nil
+}
+
+type refEntry struct {
+	refType  string
+	ref      string
+	commitId string
+}
+
+// sortedRefEntries sorts the refs by name, so the similar refs like "v1.0" and "v1.1" are in the same chunk.
+func sortedRefEntries(branchesMap map[string]string, tagsMap map[string]string) []refEntry {
+	branches := []string{}
+	for branch := range branchesMap {
+		branches = append(branches, branch)
+	}
+	sort.Sort(sort.StringSlice(branches))
+
+	tags := []string{}
+	for tag := range tagsMap {
+		tags = append(tags, tag)
+	}
+	sort.Sort(sort.StringSlice(tags))
+
+	refs := []refEntry{}
+	for _, branch := range branches {
+		refs = append(refs, refEntry{refType: REF_TYPE_BRANCH, ref: branch, commitId: branchesMap[branch]})
+	}
+	for _, tag := range tags {
+		refs = append(refs, refEntry{refType: REF_TYPE_TAG, ref: tag, commitId: tagsMap[tag]})
+	}
+	return refs
+}
+
+func (r *GitRepo) streamChunk(refs []refEntry, seen *seenEntries, callback func(blob string, file GitFile)) error {
+	spill, err := newEntrySpill(r.Config.DataDir, SPILL_RUN_SIZE)
+	if err != nil {
+		return err
+	}
+	defer spill.Close()
+
+	for _, ref := range refs {
+		var addErr error
+		err := r.GetFileEntriesIterator(ref.commitId, func(entry FileEntry) {
+			if addErr == nil {
+				addErr = spill.Add(entryRecord{Blob: entry.Blob, Path: entry.Path, Size: entry.Size, RefType: ref.refType, Ref: ref.ref})
+			}
+		})
+		if err == nil {
+			err = addErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get file entries of %s %s commit %s.", ref.refType, ref.ref, ref.commitId)
+		}
+	}
+
+	if err := seen.begin(); err != nil {
+		return err
+	}
+	if err := spill.each(seen, callback); err != nil {
+		return err
+	}
+	return seen.end()
+}
+
+// entryRecord is a file entry on a ref.
+type entryRecord struct {
+	Blob    string
+	Path    string
+	Size    int64
+	RefType string
+	Ref     string
+}
+
+type entryRecords []entryRecord
+
+func (e entryRecords) Len() int      { return len(e) }
+func (e entryRecords) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e entryRecords) Less(i, j int) bool {
+	if e[i].Blob != e[j].Blob {
+		return e[i].Blob < e[j].Blob
+	}
+	return e[i].Path < e[j].Path
+}
+
+// encode makes a line of the run file. The path doesn't have the newline and NUL since "git ls-tree" quotes them.
+func (e entryRecord) encode() string {
+	return strings.Join([]string{e.Blob, e.Path, strconv.FormatInt(e.Size, 10), e.RefType, e.Ref}, "\x00") + "\n"
+}
+
+func decodeEntryRecord(line string) (entryRecord, error) {
+	columns := strings.Split(strings.TrimSuffix(line, "\n"), "\x00")
+	if len(columns) != 5 {
+		return entryRecord{}, errors.Errorf("Broken spill record: %q", line)
+	}
+	size, err := strconv.ParseInt(columns[2], 10, 64)
+	if err != nil {
+		return entryRecord{}, errors.Wrapf(err, "Broken spill record: %q", line)
+	}
+	return entryRecord{Blob: columns[0], Path: columns[1], Size: size, RefType: columns[3], Ref: columns[4]}, nil
+}
+
+// entrySpill groups the entry records by the blob with the bounded memory.
+// The records over runSize are sorted and written to the run files, then they are merged by the blob order.
+type entrySpill struct {
+	dir     string
+	runSize int
+	records entryRecords
+	runs    []string
+}
+
+func newEntrySpill(parentDir string, runSize int) (*entrySpill, error) {
+	if parentDir != "" {
+		if err := os.MkdirAll(parentDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := ioutil.TempDir(parentDir, "gitss-spill")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to make the spill directory")
+	}
+	return &entrySpill{dir: dir, runSize: runSize, records: entryRecords{}}, nil
+}
+
+func (s *entrySpill) Add(record entryRecord) error {
+	s.records = append(s.records, record)
+	if len(s.records) >= s.runSize {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *entrySpill) flush() error {
+	if len(s.records) == 0 {
+		return nil
+	}
+	sort.Sort(s.records)
+
+	path := filepath.Join(s.dir, fmt.Sprintf("run%d", len(s.runs)))
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to make the spill file")
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, record := range s.records {
+		if _, err := w.WriteString(record.encode()); err != nil {
+			return errors.Wrapf(err, "Failed to write the spill file")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Wrapf(err, "Failed to write the spill file")
+	}
+
+	s.runs = append(s.runs, path)
+	s.records = s.records[:0]
+	return nil
+}
+
+// Each calls the callback per blob in the blob order.
+func (s *entrySpill) Each(callback func(blob string, file GitFile)) error {
+	return s.each(nil, callback)
+}
+
+// each marks the locations in the seen entries if it isn't nil.
+func (s *entrySpill) each(seen *seenEntries, callback func(blob string, file GitFile)) error {
+	group := newBlobGroup(seen, callback)
+
+	// All records are in memory
+	if len(s.runs) == 0 {
+		sort.Sort(s.records)
+		for _, record := range s.records {
+			if err := group.add(record); err != nil {
+				return err
+			}
+		}
+		group.done()
+		return nil
+	}
+
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	readers := runReaders{}
+	for _, path := range s.runs {
+		f, err := os.Open(path)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to open the spill file")
+		}
+		defer f.Close()
+
+		reader := &runReader{reader: bufio.NewReader(f)}
+		ok, err := reader.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			readers = append(readers, reader)
+		}
+	}
+
+	heap.Init(&readers)
+	for readers.Len() > 0 {
+		reader := readers[0]
+		if err := group.add(reader.current); err != nil {
+			return err
+		}
+
+		ok, err := reader.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&readers, 0)
+		} else {
+			heap.Pop(&readers)
+		}
+	}
+	group.done()
+
+	return nil
+}
+
+func (s *entrySpill) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+// blobGroup merges the consecutive records of the same blob into a GitFile.
+type blobGroup struct {
+	blob     string
+	file     GitFile
+	seen     *seenEntries
+	callback func(blob string, file GitFile)
+}
+
+func newBlobGroup(seen *seenEntries, callback func(blob string, file GitFile)) *blobGroup {
+	return &blobGroup{seen: seen, callback: callback}
+}
+
+func (g *blobGroup) add(record entryRecord) error {
+	if record.Blob != g.blob {
+		g.done()
+		g.blob = record.Blob
+		g.file = GitFile{Locations: make(map[string]GitFileLocation), Size: record.Size}
+	}
+
+	location, ok := g.file.Locations[record.Path]
+	if !ok {
+		location = GitFileLocation{Branches: []string{}, Tags: []string{}}
+		if g.seen != nil {
+			seen, err := g.seen.check(record.Blob, record.Path)
+			if err != nil {
+				return err
+			}
+			location.Seen = seen
+		}
+	}
+	if record.RefType == REF_TYPE_BRANCH {
+		location.Branches = append(location.Branches, record.Ref)
+	} else {
+		location.Tags = append(location.Tags, record.Ref)
+	}
+	g.file.Locations[record.Path] = location
+	return nil
+}
+
+func (g *blobGroup) done() {
+	if g.blob != "" {
+		g.callback(g.blob, g.file)
+	}
+	g.blob = ""
+}
+
+type runReader struct {
+	reader  *bufio.Reader
+	current entryRecord
+}
+
+func (r *runReader) next() (bool, error) {
+	line, err := r.reader.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return false, nil
+	}
+	if err != nil && err != io.EOF {
+		return false, errors.Wrapf(err, "Failed to read the spill file")
+	}
+	record, err := decodeEntryRecord(line)
+	if err != nil {
+		return false, err
+	}
+	r.current = record
+	return true, nil
+}
+
+// runReaders is the min-heap of the run readers by the current record.
+type runReaders []*runReader
+
+func (h runReaders) Len() int      { return len(h) }
+func (h runReaders) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h runReaders) Less(i, j int) bool {
+	return entryRecords{h[i].current, h[j].current}.Less(0, 1)
+}
+
+func (h *runReaders) Push(x interface{}) {
+	*h = append(*h, x.(*runReader))
+}
+
+func (h *runReaders) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// seenEntries is the sorted file of the blob and path pairs enumerated by the previous chunks of an import.
+// The pairs of a chunk come in the same order, so they are checked and merged into the next file
+// by reading the previous file sequentially without keeping them in memory.
+type seenEntries struct {
+	dir     string
+	files   int
+	prev    *os.File
+	reader  *bufio.Reader
+	current [2]string
+	hasNext bool
+	next    *os.File
+	writer  *bufio.Writer
+}
+
+func newSeenEntries(parentDir string) (*seenEntries, error) {
+	if parentDir != "" {
+		if err := os.MkdirAll(parentDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := ioutil.TempDir(parentDir, "gitss-seen")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to make the seen entries directory")
+	}
+	return &seenEntries{dir: dir}, nil
+}
+
+func (s *seenEntries) filePath(n int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("seen%d", n))
+}
+
+// begin opens the file of the previous chunks, and the next file including the pairs of the chunk.
+func (s *seenEntries) begin() error {
+	if s.files > 0 {
+		f, err := os.Open(s.filePath(s.files - 1))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to open the seen entries file")
+		}
+		s.prev = f
+		s.reader = bufio.NewReader(f)
+		if err := s.read(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(s.filePath(s.files))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to make the seen entries file")
+	}
+	s.next = f
+	s.writer = bufio.NewWriter(f)
+	return nil
+}
+
+func (s *seenEntries) read() error {
+	s.hasNext = false
+	if s.reader == nil {
+		return nil
+	}
+	line, err := s.reader.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return nil
+	}
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(err, "Failed to read the seen entries file")
+	}
+	columns := strings.Split(strings.TrimSuffix(line, "\n"), "\x00")
+	if len(columns) != 2 {
+		return errors.Errorf("Broken seen entries record: %q", line)
+	}
+	s.current = [2]string{columns[0], columns[1]}
+	s.hasNext = true
+	return nil
+}
+
+func (s *seenEntries) write(pair [2]string) error {
+	if _, err := s.writer.WriteString(pair[0] + "\x00" + pair[1] + "\n"); err != nil {
+		return errors.Wrapf(err, "Failed to write the seen entries file")
+	}
+	return nil
+}
+
+// copyUntil copies the previous pairs before the pair to the next file.
+func (s *seenEntries) copyUntil(pair [2]string, all bool) error {
+	for s.hasNext && (all || lessPair(s.current, pair)) {
+		if err := s.write(s.current); err != nil {
+			return err
+		}
+		if err := s.read(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check reports whether the pair was enumerated by the previous chunks. It must be called in the pair order once per pair in a chunk.
+func (s *seenEntries) check(blob string, path string) (bool, error) {
+	pair := [2]string{blob, path}
+	if err := s.copyUntil(pair, false); err != nil {
+		return false, err
+	}
+
+	seen := s.hasNext && s.current == pair
+	if seen {
+		if err := s.read(); err != nil {
+			return false, err
+		}
+	}
+	return seen, s.write(pair)
+}
+
+// end copies the rest of the previous pairs, and replaces the previous file with the next file.
+func (s *seenEntries) end() error {
+	if err := s.copyUntil([2]string{}, true); err != nil {
+		return err
+	}
+	if err := s.writer.Flush(); err != nil {
+		return errors.Wrapf(err, "Failed to write the seen entries file")
+	}
+	if err := s.next.Close(); err != nil {
+		return errors.Wrapf(err, "Failed to write the seen entries file")
+	}
+	s.next = nil
+
+	if s.prev != nil {
+		s.prev.Close()
+		s.prev = nil
+		s.reader = nil
+		os.Remove(s.filePath(s.files - 1))
+	}
+	s.files++
+	return nil
+}
+
+func (s *seenEntries) Close() error {
+	if s.prev != nil {
+		s.prev.Close()
+	}
+	if s.next != nil {
+		s.next.Close()
+	}
+	return os.RemoveAll(s.dir)
+}
+
+func lessPair(a [2]string, b [2]string) bool {
+	if a[0] != b[0] {
+		return a[0] < b[0]
+	}
+	return a[1] < b[1]
+}
@@ -0,0 +1,138 @@
+package repo
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestEntrySpill(t *testing.T) {
+	// the small run size makes the multiple run files
+	spill, err := newEntrySpill("", 3)
+	if err != nil {
+		t.Fatalf("Unexpected returned err %+v", err)
+	}
+	defer spill.Close()
+
+	records := []entryRecord{
+		{Blob: "b2", Path: "x.go", Size: 2, RefType: REF_TYPE_BRANCH, Ref: "master"},
+		{Blob: "b1", Path: "a.go", Size: 1, RefType: REF_TYPE_BRANCH, Ref: "master"},
+		{Blob: "b1", Path: "b.go", Size: 1, RefType: REF_TYPE_BRANCH, Ref: "master"},
+		{Blob: "b3", Path: "y.go", Size: 3, RefType: REF_TYPE_BRANCH, Ref: "master"},
+		{Blob: "b1", Path: "a.go", Size: 1, RefType: REF_TYPE_TAG, Ref: "v1.0"},
+		{Blob: "b2", Path: "x.go", Size: 2, RefType: REF_TYPE_TAG, Ref: "v1.0"},
+		{Blob: "b1", Path: "a.go", Size: 1, RefType: REF_TYPE_TAG, Ref: "v1.1"},
+	}
+	for _, record := range records {
+		if err := spill.Add(record); err != nil {
+			t.Fatalf("Unexpected returned err %+v", err)
+		}
+	}
+
+	if len(spill.runs) != 2 {
+		t.Errorf("got %v runs, want 2", len(spill.runs))
+	}
+
+	actual := []string{}
+	err = spill.Each(func(blob string, file GitFile) {
+		paths := []string{}
+		for path, location := range file.Locations {
+			sort.Sort(sort.StringSlice(location.Tags))
+			paths = append(paths, fmt.Sprintf("%s%v%v", path, location.Branches, location.Tags))
+		}
+		sort.Sort(sort.StringSlice(paths))
+		actual = append(actual, fmt.Sprintf("%s(%d)=%v", blob, file.Size, paths))
+	})
+	if err != nil {
+		t.Fatalf("Unexpected returned err %+v", err)
+	}
+
+	expected := []string{
+		"b1(1)=[a.go[master][v1.0 v1.1] b.go[master][]]",
+		"b2(2)=[x.go[master][v1.0]]",
+		"b3(3)=[y.go[master][]]",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %v, want %v", actual, expected)
+	}
+}
+
+func TestSortedRefEntries(t *testing.T) {
+	refs := sortedRefEntries(map[string]string{"master": "c1", "develop": "c2"}, map[string]string{"v1.1": "c3", "v1.0": "c4"})
+
+	actual := []string{}
+	for _, ref := range refs {
+		actual = append(actual, ref.refType+":"+ref.ref+":"+ref.commitId)
+	}
+	expected := []string{"branch:develop:c2", "branch:master:c1", "tag:v1.0:c4", "tag:v1.1:c3"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %v, want %v", actual, expected)
+	}
+}
+
+func TestSeenEntries(t *testing.T) {
+	seen, err := newSeenEntries("")
+	if err != nil {
+		t.Fatalf("Unexpected returned err %+v", err)
+	}
+	defer seen.Close()
+
+	chunks := [][]entryRecord{
+		{
+			{Blob: "b1", Path: "a.go", Size: 1, RefType: REF_TYPE_TAG, Ref: "v1.0"},
+			{Blob: "b2", Path: "x.go", Size: 2, RefType: REF_TYPE_TAG, Ref: "v1.0"},
+		},
+		{
+			{Blob: "b1", Path: "a.go", Size: 1, RefType: REF_TYPE_TAG, Ref: "v2.0"},
+			{Blob: "b1", Path: "b.go", Size: 1, RefType: REF_TYPE_TAG, Ref: "v2.0"},
+			{Blob: "b3", Path: "y.go", Size: 3, RefType: REF_TYPE_TAG, Ref: "v2.0"},
+		},
+		{
+			{Blob: "b2", Path: "x.go", Size: 2, RefType: REF_TYPE_TAG, Ref: "v3.0"},
+			{Blob: "b3", Path: "y.go", Size: 3, RefType: REF_TYPE_TAG, Ref: "v3.0"},
+		},
+	}
+
+	actual := []string{}
+	for _, records := range chunks {
+		spill, err := newEntrySpill("", 10)
+		if err != nil {
+			t.Fatalf("Unexpected returned err %+v", err)
+		}
+		for _, record := range records {
+			spill.Add(record)
+		}
+
+		if err := seen.begin(); err != nil {
+			t.Fatalf("Unexpected returned err %+v", err)
+		}
+		err = spill.each(seen, func(blob string, file GitFile) {
+			paths := []string{}
+			for path, location := range file.Locations {
+				paths = append(paths, fmt.Sprintf("%s:%v", path, location.Seen))
+			}
+			sort.Sort(sort.StringSlice(paths))
+			actual = append(actual, fmt.Sprintf("%s=%v", blob, paths))
+		})
+		if err != nil {
+			t.Fatalf("Unexpected returned err %+v", err)
+		}
+		if err := seen.end(); err != nil {
+			t.Fatalf("Unexpected returned err %+v", err)
+		}
+		spill.Close()
+	}
+
+	expected := []string{
+		"b1=[a.go:false]",
+		"b2=[x.go:false]",
+		"b1=[a.go:true b.go:false]",
+		"b3=[y.go:false]",
+		"b2=[x.go:true]",
+		"b3=[y.go:true]",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %v, want %v", actual, expected)
+	}
+}
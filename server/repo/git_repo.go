@@ -7,10 +7,15 @@ import (
 	// "io/ioutil"
 	// "os"
 	// "path/filepath"
+	"bufio"
 	"fmt"
+	"io"
+	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	// "gopkg.in/src-d/go-git.v4/utils/fs"
 	// "strings"
@@ -126,6 +131,38 @@ func (r *GitRepo) GetTags() ([]string, error) {
 	return t, nil
 }
 
+// GetRefDates returns the dates of the branches and tags.
+// The date of the annotated tag is the tagger date, otherwise the committer date.
+func (r *GitRepo) GetRefDates() (map[string]time.Time, map[string]time.Time, error) {
+	stdout, err := gitm.NewCommand("for-each-ref", "--format=%(refname) %(creatordate:raw)", "refs/heads", "refs/tags").RunInDir(r.Path)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, `Failed to get ref dates. cmd: "git for-each-ref refs/heads refs/tags"`)
+	}
+
+	branches := make(map[string]time.Time)
+	tags := make(map[string]time.Time)
+
+	for _, row := range strings.Split(stdout, "\n") {
+		// refs/tags/v1.0 1490000000 +0900
+		columns := strings.Split(row, " ")
+		if len(columns) < 2 {
+			continue
+		}
+		sec, err := strconv.ParseInt(columns[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		date := time.Unix(sec, 0)
+
+		if strings.HasPrefix(columns[0], gitm.BRANCH_PREFIX) {
+			branches[columns[0][len(gitm.BRANCH_PREFIX):]] = date
+		} else if strings.HasPrefix(columns[0], gitm.TAG_PREFIX) {
+			tags[columns[0][len(gitm.TAG_PREFIX):]] = date
+		}
+	}
+	return branches, tags, nil
+}
+
 func filter(array []string, include *regexp.Regexp, exclude *regexp.Regexp) []string {
 	newArray := []string{}
 	for _, str := range array {
@@ -197,6 +234,15 @@ func (r *GitRepo) GetLatestCommitIdsMap() (config.BrancheIndexedMap, config.TagI
 	return resultBranches, resultTags, nil
 }
 
+// GetDefaultBranch returns the branch of HEAD, which is the default branch of the remote repository in the mirror.
+func (r *GitRepo) GetDefaultBranch() (string, error) {
+	stdout, err := gitm.NewCommand("symbolic-ref", "--short", "HEAD").RunInDir(r.Path)
+	if err != nil {
+		return "", errors.Wrapf(err, `Failed to get the default branch. cmd: "git symbolic-ref --short HEAD"`)
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
 func (r *GitRepo) GetBranchCommitID(name string) (string, error) {
 	return r.gitmRepo.GetBranchCommitID(name)
 }
@@ -229,7 +275,7 @@ func (r *GitRepo) GetBlobSize(blob string) (int64, error) {
 }
 
 func (r *GitRepo) GetBlobContent(blob string) ([]byte, error) {
-	b, err := gitm.NewCommand("cat-file", "-p", blob).RunInDirBytes(r.Path)
+	b, err := getCatFilePool(r.Path).ReadBlob(blob)
 	if err != nil {
 		return nil, err
 	}
@@ -237,8 +283,35 @@ func (r *GitRepo) GetBlobContent(blob string) ([]byte, error) {
 	return b, nil
 }
 
+// GetRawBlobContent returns the blob content as it is, while GetBlobContent trims the trailing newlines.
+func (r *GitRepo) GetRawBlobContent(blob string) ([]byte, error) {
+	return getCatFilePool(r.Path).ReadBlob(blob)
+}
+
+// GetBlobText returns the blob content decoded by the encoding which was detected when indexing.
+func (r *GitRepo) GetBlobText(blob string, encoding string) (string, error) {
+	b, err := getCatFilePool(r.Path).ReadBlob(blob)
+	if err != nil {
+		return "", err
+	}
+
+	ee, _ := charset.Lookup(encoding)
+	if ee == nil {
+		return string(b), nil
+	}
+	var buf bytes.Buffer
+	ic := transform.NewWriter(&buf, ee.NewDecoder())
+	if _, err := ic.Write(b); err != nil {
+		return "", errors.Wrapf(err, "Failed to decode the blob %s by %s", blob, encoding)
+	}
+	if err := ic.Close(); err != nil {
+		return "", errors.Wrapf(err, "Failed to decode the blob %s by %s", blob, encoding)
+	}
+	return buf.String(), nil
+}
+
 func (r *GitRepo) DetectBlobContentType(blob string) (string, []byte, error) {
-	b, err := gitm.NewCommand("cat-file", "-p", blob).RunInDirBytes(r.Path)
+	b, err := getCatFilePool(r.Path).ReadBlob(blob)
 	if err != nil {
 		return "", nil, err
 	}
@@ -273,34 +346,54 @@ type FileEntry struct {
 	Size int64
 }
 
+// GetFileEntriesIterator calls the callback for each file entry of the commit.
+// The output of "git ls-tree" is streamed, so the entries aren't kept in memory.
 func (r *GitRepo) GetFileEntriesIterator(commitId string, callback func(fileEntry FileEntry)) error {
-	// see https://git-scm.com/docs/git-ls-tree
-	s, err := gitm.NewCommand("ls-tree", "-r", "-l", "--abbrev=40", commitId).RunInDir(r.Path)
-	if err != nil {
-		return errors.Wrapf(err, `Faild to get file list. cmd: "git ls-tree -r -l --abbrev=40 %s"`, commitId)
-	}
-	s = strings.TrimRight(s, "\n")
-	rows := strings.Split(s, "\n")
+	return r.GetFileEntriesIteratorTimeout(commitId, -1, callback)
+}
 
-	for i := range rows {
-		row := rows[i]
-		pathColumns := strings.Split(row, "\t")
-		columns := strings.Fields(row)
+// GetFileEntriesIteratorTimeout is GetFileEntriesIterator which fails when "git ls-tree" doesn't finish in the timeout.
+// The timeout -1 is the default timeout of the git commands.
+func (r *GitRepo) GetFileEntriesIteratorTimeout(commitId string, timeout time.Duration, callback func(fileEntry FileEntry)) error {
+	stdout, writer := io.Pipe()
+	stderr := new(bytes.Buffer)
 
-		if len(pathColumns) != 2 {
-			return errors.Errorf("Unexpected git ls-tree output. %s" + row)
+	go func() {
+		// see https://git-scm.com/docs/git-ls-tree
+		err := gitm.NewCommand("ls-tree", "-r", "-l", "--abbrev=40", commitId).RunInDirTimeoutPipeline(timeout, r.Path, writer, stderr)
+		if err != nil && stderr.Len() > 0 {
+			err = errors.Errorf("%v - %s", err, stderr.String())
+		}
+		writer.CloseWithError(err)
+	}()
+	// stop the command if the output isn't read to the end
+	defer stdout.Close()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		row := scanner.Text()
+		pathColumns := strings.SplitN(row, "\t", 2)
+		columns := strings.Fields(pathColumns[0])
+
+		if len(pathColumns) != 2 || len(columns) != 4 {
+			return errors.Errorf("Unexpected git ls-tree output. %s", row)
 		}
 
 		blob := columns[2]
 		size, _ := strconv.ParseInt(columns[3], 10, 64)
 
-		path := strings.Split(row, "\t")[1]
+		path := pathColumns[1]
 
 		f := FileEntry{Blob: blob, Size: size, Path: path}
 
 		callback(f)
 	}
 
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, `Faild to get file list. cmd: "git ls-tree -r -l --abbrev=40 %s"`, commitId)
+	}
 	return nil
 }
 
@@ -326,6 +419,9 @@ type GitFile struct {
 type GitFileLocation struct {
 	Branches []string
 	Tags     []string
+	// Seen is true if the path of the blob was enumerated by a previous chunk of StreamFileEntries,
+	// so only the refs need to be merged into the index.
+	Seen bool
 }
 
 func (r *GitRepo) GetFileEntriesMapByRefs(includeBranches []string, includeTags []string, excludeBranches []string, excludeTags []string) (map[string]GitFile, error) {
@@ -340,57 +436,29 @@ func (r *GitRepo) GetFileEntriesMapByRefs(includeBranches []string, includeTags
 // It returns as GitFiles map with the blob key.
 // The branchesMap's key is branch name, and the value is commitId.
 // The tagsMap's key is tag name, and the value is commitId.
+// All entries are kept in memory, so use StreamFileEntries for many refs.
 func (r *GitRepo) GetFileEntriesMap(branchesMap map[string]string, tagsMap map[string]string) (map[string]GitFile, error) {
 	files := make(map[string]GitFile)
 
-	for branch, commitId := range branchesMap {
-		entries, err := r.GetFileEntries(commitId)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to get file entries of branch commit %s.", commitId)
+	err := r.StreamFileEntries(branchesMap, tagsMap, func(blob string, file GitFile) {
+		current, ok := files[blob]
+		if !ok {
+			files[blob] = file
+			return
 		}
-
-		for _, entry := range entries {
-			_, ok := files[entry.Blob]
+		for path, location := range file.Locations {
+			currentLocation, ok := current.Locations[path]
 			if !ok {
-				locations := make(map[string]GitFileLocation)
-				locations[entry.Path] = GitFileLocation{Branches: []string{branch}, Tags: []string{}}
-				files[entry.Blob] = GitFile{Locations: locations, Size: entry.Size}
-			} else {
-				_, ok := files[entry.Blob].Locations[entry.Path]
-				if !ok {
-					files[entry.Blob].Locations[entry.Path] = GitFileLocation{Branches: []string{branch}, Tags: []string{}}
-				} else {
-					location := files[entry.Blob].Locations[entry.Path]
-					location.Branches = append(location.Branches, branch)
-					files[entry.Blob].Locations[entry.Path] = location
-				}
-			}
-		}
-	}
-
-	for tag, commitId := range tagsMap {
-		entries, err := r.GetFileEntries(commitId)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to get file entries of tag commit %s.", commitId)
-		}
-
-		for _, entry := range entries {
-			_, ok := files[entry.Blob]
-			if !ok {
-				locations := make(map[string]GitFileLocation)
-				locations[entry.Path] = GitFileLocation{Branches: []string{}, Tags: []string{tag}}
-				files[entry.Blob] = GitFile{Locations: locations, Size: entry.Size}
-			} else {
-				_, ok := files[entry.Blob].Locations[entry.Path]
-				if !ok {
-					files[entry.Blob].Locations[entry.Path] = GitFileLocation{Branches: []string{}, Tags: []string{tag}}
-				} else {
-					location := files[entry.Blob].Locations[entry.Path]
-					location.Tags = append(location.Tags, tag)
-					files[entry.Blob].Locations[entry.Path] = location
-				}
+				current.Locations[path] = location
+				continue
 			}
+			currentLocation.Branches = append(currentLocation.Branches, location.Branches...)
+			currentLocation.Tags = append(currentLocation.Tags, location.Tags...)
+			current.Locations[path] = currentLocation
 		}
+	}, nil)
+	if err != nil {
+		return nil, err
 	}
 	return files, nil
 }
@@ -589,6 +657,164 @@ func (r *GitRepo) ExistsInCommit(commitId string, filePath string, blobId string
 	return columns[2] == blobId, nil
 }
 
+// GrepMatch is the matched line of "git grep". Line is 1-based.
+type GrepMatch struct {
+	Path string
+	Line int
+	Text string
+}
+
+// errGrepOutputLimit stops reading the output of "git grep" when it exceeds the limit.
+var errGrepOutputLimit = errors.New("git grep output limit exceeded")
+
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		b.Buffer.Write(p[:b.limit-b.Len()])
+		return 0, errGrepOutputLimit
+	}
+	return b.Buffer.Write(p)
+}
+
+// The max bytes of the paths passed to a "git grep" command. "git grep" can't read the pathspecs from a file or stdin,
+// so the paths are split into the multiple commands under the command line limit.
+const GREP_PATHSPEC_BYTES = 16 * 1024
+
+// Grep runs "git grep" for the fixed strings in the commit, ignoring case and binary files.
+// If all is true, the files must contain all of the terms. The paths limit the files if given.
+// The output over outputLimit bytes is dropped and the returned bool is true in that case or the timeout.
+func (r *GitRepo) Grep(commitId string, terms []string, all bool, paths []string, outputLimit int, timeout time.Duration) ([]GrepMatch, bool, error) {
+	if len(paths) == 0 {
+		matches, partial, _, err := r.grep(commitId, terms, all, paths, outputLimit, timeout)
+		return matches, partial, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	matches := []GrepMatch{}
+
+	for _, batch := range splitPathspecs(paths, GREP_PATHSPEC_BYTES) {
+		timeout := deadline.Sub(time.Now())
+		if timeout <= 0 || outputLimit <= 0 {
+			return matches, true, nil
+		}
+
+		found, partial, size, err := r.grep(commitId, terms, all, batch, outputLimit, timeout)
+		if err != nil {
+			return nil, false, err
+		}
+		matches = append(matches, found...)
+		if partial {
+			return matches, true, nil
+		}
+		outputLimit -= size
+	}
+	return matches, false, nil
+}
+
+// grep runs a "git grep" command and returns the output size too.
+func (r *GitRepo) grep(commitId string, terms []string, all bool, paths []string, outputLimit int, timeout time.Duration) ([]GrepMatch, bool, int, error) {
+	cmd := gitm.NewCommand("grep", "-I", "-i", "-F", "-n", "--null", "--no-color")
+	if all {
+		cmd.AddArguments("--all-match")
+	}
+	for _, term := range terms {
+		cmd.AddArguments("-e", term)
+	}
+	cmd.AddArguments(commitId)
+	if len(paths) > 0 {
+		cmd.AddArguments("--")
+		for _, path := range paths {
+			cmd.AddArguments(literalPathspec(path))
+		}
+	}
+
+	stdout := &limitedBuffer{limit: outputLimit}
+	stderr := new(bytes.Buffer)
+
+	partial := false
+	err := cmd.RunInDirTimeoutPipeline(timeout, r.Path, stdout, stderr)
+	if err != nil {
+		// exit status 1 means no match
+		if stderr.Len() == 0 && isExitStatus(err, 1) {
+			return []GrepMatch{}, false, 0, nil
+		}
+		if stderr.Len() > 0 {
+			return nil, false, 0, errors.Wrapf(err, `Failed to grep. cmd: "git grep %s" stderr: %s`, commitId, stderr.String())
+		}
+		// The output limit or the timeout
+		partial = true
+	}
+
+	return parseGrepOutput(stdout.String(), commitId, partial), partial, stdout.Len(), nil
+}
+
+// literalPathspec makes the pathspec which doesn't treat the wildcards in the path as the pattern.
+func literalPathspec(path string) string {
+	return ":(literal)" + path
+}
+
+// splitPathspecs splits the paths into the batches up to maxBytes. A batch has one path at least.
+func splitPathspecs(paths []string, maxBytes int) [][]string {
+	batches := [][]string{}
+	batch := []string{}
+	size := 0
+	for _, path := range paths {
+		n := len(literalPathspec(path)) + 1
+		if len(batch) > 0 && size+n > maxBytes {
+			batches = append(batches, batch)
+			batch = []string{}
+			size = 0
+		}
+		batch = append(batch, path)
+		size += n
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// isExitStatus checks the exit code of the failed command.
+func isExitStatus(err error, code int) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.ExitStatus() == code
+}
+
+// parseGrepOutput parses "<commitId>:<path>\0<line>\0<text>" rows.
+// The last row is dropped if the output is partial since it may be cut.
+func parseGrepOutput(output string, commitId string, partial bool) []GrepMatch {
+	rows := strings.Split(output, "\n")
+	if partial || rows[len(rows)-1] == "" {
+		rows = rows[:len(rows)-1]
+	}
+
+	matches := []GrepMatch{}
+	for _, row := range rows {
+		columns := strings.SplitN(row, "\x00", 3)
+		if len(columns) != 3 {
+			continue
+		}
+		line, err := strconv.Atoi(columns[1])
+		if err != nil {
+			continue
+		}
+		matches = append(matches, GrepMatch{
+			Path: strings.TrimPrefix(columns[0], commitId+":"),
+			Line: line,
+			Text: strings.TrimRight(columns[2], "\r"),
+		})
+	}
+	return matches
+}
+
 func getGitRepoPath(GitDataDir string, organization string, project string, repoName string) string {
 	repoPath := fmt.Sprintf("%s/%s/%s/%s.git", GitDataDir, organization, project, repoName)
 	return repoPath
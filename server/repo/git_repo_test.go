@@ -2,6 +2,8 @@ package repo
 
 import (
 	// "fmt"
+	"errors"
+	"os/exec"
 	"testing"
 
 	"github.com/wadahiro/gitss/server/config"
@@ -76,3 +78,53 @@ func TestGetFileEntriesMap(t *testing.T) {
 		t.Errorf("Unexpected branch. expected: master, actual: %v", location.Branches[0])
 	}
 }
+
+func TestParseGrepOutput(t *testing.T) {
+	output := "abc:src/main.go\x0012\x00\tfoo := bar\nabc:README.md\x001\x00# foo: a:b\nabc:cut\x00"
+
+	matches := parseGrepOutput(output, "abc", true)
+
+	if len(matches) != 2 {
+		t.Fatalf("got %v, want 2 matches", matches)
+	}
+	if matches[0].Path != "src/main.go" || matches[0].Line != 12 || matches[0].Text != "\tfoo := bar" {
+		t.Errorf("Unexpected match %v", matches[0])
+	}
+	if matches[1].Path != "README.md" || matches[1].Line != 1 || matches[1].Text != "# foo: a:b" {
+		t.Errorf("Unexpected match %v", matches[1])
+	}
+
+	if matches := parseGrepOutput("", "abc", false); len(matches) != 0 {
+		t.Errorf("got %v, want no match", matches)
+	}
+}
+
+func TestSplitPathspecs(t *testing.T) {
+	// ":(literal)a.go" and the separator are 15 bytes
+	batches := splitPathspecs([]string{"a.go", "b.go", "c.go"}, 30)
+
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Errorf("got %v, want [[a.go b.go] [c.go]]", batches)
+	}
+
+	// The path over the limit is in its own batch
+	batches = splitPathspecs([]string{"a.go", "very/long/path.go"}, 10)
+	if len(batches) != 2 {
+		t.Errorf("got %v, want 2 batches", batches)
+	}
+}
+
+func TestIsExitStatus(t *testing.T) {
+	// "git rev-parse --verify -q" exits with 1 if the ref doesn't exist
+	err := exec.Command("git", "rev-parse", "--verify", "-q", "refs/heads/no-such-branch-for-test").Run()
+
+	if !isExitStatus(err, 1) {
+		t.Errorf("got %v, want exit status 1", err)
+	}
+	if isExitStatus(err, 128) {
+		t.Errorf("got exit status 128 for %v", err)
+	}
+	if isExitStatus(errors.New("exit status 1"), 1) {
+		t.Errorf("got exit status 1 for the error message")
+	}
+}
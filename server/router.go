@@ -15,10 +15,11 @@ import (
 	"github.com/nu7hatch/gouuid"
 	"github.com/wadahiro/gitss/server/config"
 	"github.com/wadahiro/gitss/server/controller"
+	"github.com/wadahiro/gitss/server/importer"
 	"github.com/wadahiro/gitss/server/indexer"
 )
 
-func initRouter(config *config.Config, indexer indexer.Indexer) {
+func initRouter(config *config.Config, indexer indexer.Indexer, importer *importer.GitImporter) {
 	if !config.Debug {
 		gin.SetMode(gin.ReleaseMode)
 	}
@@ -30,6 +31,7 @@ func initRouter(config *config.Config, indexer indexer.Indexer) {
 	r.Use(func(c *gin.Context) {
 		c.Set("indexer", indexer)
 		c.Set("config", config)
+		c.Set("importer", importer)
 	})
 
 	r.Use(func(c *gin.Context) {
@@ -48,6 +50,8 @@ func initRouter(config *config.Config, indexer indexer.Indexer) {
 		c.Set("uuid", id)
 	})
 
+	r.Use(controller.Compress())
+
 	apiPrefix := "/api/v1/"
 
 	// add API routes
@@ -59,12 +63,29 @@ func initRouter(config *config.Config, indexer indexer.Indexer) {
 	})
 
 	r.GET(apiPrefix+"search", controller.SearchIndex)
+	r.GET(apiPrefix+"search/explain", controller.ExplainSearch)
+	r.GET(apiPrefix+"suggest", controller.SuggestTerms)
+	r.GET(apiPrefix+"similar", controller.SearchSimilar)
+	r.POST(apiPrefix+"snippet", controller.SearchSnippet)
+	r.GET(apiPrefix+"reports/duplicates", controller.ReportDuplicates)
+	r.GET(apiPrefix+"blobs/:sha", controller.FindBlob)
+	r.POST(apiPrefix+"blobs", controller.FindUploadedBlob)
+	r.GET(apiPrefix+"aggregations/refs/:organization/:project/:repository", controller.AggregateRefs)
+	r.GET(apiPrefix+"history/:organization/:project/:repository/*path", controller.GetPathHistory)
+	r.POST(apiPrefix+"replace", controller.MakeReplacePatches)
 	r.GET(apiPrefix+"statistics", controller.GetIndexStatistics)
 	r.GET(apiPrefix+"filters", controller.GetBaseFilters)
 	r.GET(apiPrefix+"filters/:organization", controller.GetBaseFilters)
 	r.GET(apiPrefix+"filters/:organization/:project", controller.GetBaseFilters)
 	r.GET(apiPrefix+"filters/:organization/:project/:repository", controller.GetBaseFilters)
 
+	// The sync API is enabled with the admin token only
+	if config.AdminToken != "" {
+		admin := r.Group(apiPrefix, controller.RequireAdminToken(config.AdminToken))
+		admin.POST("sync", controller.SyncRepositories)
+		admin.POST("sync/:organization/:project/:repository", controller.SyncRepositories)
+	}
+
 	// react server-side rendering
 	// react := NewReact(
 	// 	"assets/js/bundle.js",
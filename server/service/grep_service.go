@@ -0,0 +1,372 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/wadahiro/gitss/server/config"
+	"github.com/wadahiro/gitss/server/indexer"
+	"github.com/wadahiro/gitss/server/repo"
+	"github.com/wadahiro/gitss/server/util"
+)
+
+// The budget of the live grep. It stops when the time is over or the matched lines reach the limit.
+const LIVE_GREP_TIMEOUT = 5 * time.Second
+const LIVE_GREP_MAX_MATCHES = 200
+
+// The max output of a "git grep" command
+const LIVE_GREP_OUTPUT_LIMIT = 1024 * 1024
+
+const LIVE_GREP_CONCURRENCY = 4
+
+// The oversized paths of the indexed commits are cached, since listing the files of a commit is heavy
+const OVERSIZED_PATHS_CACHE_SIZE = 1000
+
+var oversizedPathsCache = util.NewLRUCache(OVERSIZED_PATHS_CACHE_SIZE, 0)
+
+// grepTarget is a commit of the repository and the refs pointing to it.
+// If indexed is true, only the files over the size limit are grepped because others are in the index.
+type grepTarget struct {
+	organization string
+	project      string
+	repository   string
+	commitId     string
+	branches     []string
+	tags         []string
+	indexed      bool
+	sizeLimit    int64
+}
+
+// RunLiveGrep runs "git grep" in parallel across the mirrors and refs in the filter params,
+// for the refs not indexed yet and the files over the size limit which are never indexed.
+// The hits are marked as unindexed. Finding the refs and the files is in LIVE_GREP_TIMEOUT too.
+func RunLiveGrep(config *config.Config, reader *repo.GitRepoReader, queryString string, filterParams indexer.FilterParams) ([]indexer.Hit, indexer.LiveGrepStatus) {
+	start := time.Now()
+	deadline := start.Add(LIVE_GREP_TIMEOUT)
+
+	status := indexer.LiveGrepStatus{}
+	hits := []indexer.Hit{}
+
+	terms, all := indexer.ExtractGrepTerms(queryString)
+	if len(terms) == 0 {
+		return hits, status
+	}
+
+	targets, partial := findGrepTargets(config, reader, filterParams, deadline)
+	status.Refs = len(targets)
+	status.Partial = partial
+
+	var mutex sync.Mutex
+	matches := 0
+
+	workers, stopWorkers := util.GenWorkers(LIVE_GREP_CONCURRENCY)
+
+	for i := range targets {
+		target := targets[i]
+
+		workers <- func() {
+			mutex.Lock()
+			exhausted := matches >= LIVE_GREP_MAX_MATCHES
+			mutex.Unlock()
+
+			if exhausted || !time.Now().Before(deadline) {
+				mutex.Lock()
+				status.Partial = true
+				mutex.Unlock()
+				return
+			}
+
+			found, partial, err := grepRefs(reader, target, terms, all, filterParams, deadline)
+			if err != nil {
+				log.Printf("Failed to grep %s:%s/%s %s. %+v", target.organization, target.project, target.repository, target.commitId, err)
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			for _, hit := range found {
+				if matches >= LIVE_GREP_MAX_MATCHES {
+					partial = true
+					break
+				}
+				hits = append(hits, hit)
+				for _, p := range hit.Preview {
+					matches += len(p.Hits)
+				}
+			}
+			if partial {
+				status.Partial = true
+			}
+		}
+	}
+	stopWorkers()
+
+	sort.Sort(liveGrepHits(hits))
+
+	end := time.Now()
+	status.Time = (end.Sub(start)).Seconds()
+	status.Size = int64(len(hits))
+
+	return hits, status
+}
+
+// findGrepTargets collects the current commits of the refs in the scope in parallel.
+// The refs pointing to the same commit are grepped once.
+// The repositories not started by the deadline are skipped, and it returns true as partial then.
+func findGrepTargets(config *config.Config, reader *repo.GitRepoReader, filterParams indexer.FilterParams, deadline time.Time) ([]grepTarget, bool) {
+	type scope struct {
+		organization string
+		project      string
+		repository   string
+	}
+	scopes := []scope{}
+
+	for _, setting := range config.GetSettings() {
+		organization := setting.GetName()
+		if !matchScope(filterParams.Organizations, organization) {
+			continue
+		}
+
+		for _, projectSetting := range setting.GetProjects() {
+			if !matchScope(filterParams.Projects, projectSetting.Name) {
+				continue
+			}
+
+			for i := range projectSetting.Repositories {
+				repository := projectSetting.Repositories[i].GetName()
+				if !matchScope(filterParams.Repositories, repository) {
+					continue
+				}
+				scopes = append(scopes, scope{organization: organization, project: projectSetting.Name, repository: repository})
+			}
+		}
+	}
+
+	// The targets are kept per repository to keep the order of the settings
+	found := make([][]grepTarget, len(scopes))
+
+	var mutex sync.Mutex
+	partial := false
+
+	workers, stopWorkers := util.GenWorkers(LIVE_GREP_CONCURRENCY)
+
+	for i := range scopes {
+		i := i
+		s := scopes[i]
+
+		workers <- func() {
+			if !time.Now().Before(deadline) {
+				mutex.Lock()
+				partial = true
+				mutex.Unlock()
+				return
+			}
+			found[i] = findRepositoryGrepTargets(config, reader, s.organization, s.project, s.repository, filterParams)
+		}
+	}
+	stopWorkers()
+
+	targets := []grepTarget{}
+	for _, t := range found {
+		targets = append(targets, t...)
+	}
+
+	// The pending refs are grepped first because they have no hits in the index at all
+	sort.Stable(grepTargets(targets))
+
+	return targets, partial
+}
+
+// findRepositoryGrepTargets collects the current commits of the refs of the repository.
+func findRepositoryGrepTargets(config *config.Config, reader *repo.GitRepoReader, organization, project, repository string, filterParams indexer.FilterParams) []grepTarget {
+	targets := []grepTarget{}
+
+	gitRepo, err := reader.GetGitRepo(organization, project, repository)
+	if err != nil {
+		log.Printf("Not cloned yet? %s:%s/%s. %+v", organization, project, repository, err)
+		return targets
+	}
+
+	branches, tags, err := gitRepo.GetLatestCommitIdsMap()
+	if err != nil {
+		log.Printf("Failed to get refs of %s:%s/%s. %+v", organization, project, repository, err)
+		return targets
+	}
+
+	indexed := config.GetIndexed(organization, project, repository)
+	sizeLimit := config.GetSizeLimit(organization, project, repository)
+
+	commits := make(map[string]*grepTarget)
+	getTarget := func(commitId string) *grepTarget {
+		t, ok := commits[commitId]
+		if !ok {
+			t = &grepTarget{
+				organization: organization,
+				project:      project,
+				repository:   repository,
+				commitId:     commitId,
+				branches:     []string{},
+				tags:         []string{},
+				indexed:      true,
+				sizeLimit:    sizeLimit,
+			}
+			commits[commitId] = t
+		}
+		return t
+	}
+
+	for _, branch := range sortedRefs(branches, filterParams.Branches) {
+		t := getTarget(branches[branch])
+		t.branches = append(t.branches, branch)
+		t.indexed = t.indexed && indexed.Branches[branch] == branches[branch]
+	}
+	for _, tag := range sortedRefs(tags, filterParams.Tags) {
+		t := getTarget(tags[tag])
+		t.tags = append(t.tags, tag)
+		t.indexed = t.indexed && indexed.Tags[tag] == tags[tag]
+	}
+
+	commitIds := []string{}
+	for commitId := range commits {
+		commitIds = append(commitIds, commitId)
+	}
+	sort.Sort(sort.StringSlice(commitIds))
+
+	for _, commitId := range commitIds {
+		targets = append(targets, *commits[commitId])
+	}
+	return targets
+}
+
+// grepRefs greps the commit of the target. Listing the oversized files and the grep stop at the deadline.
+func grepRefs(reader *repo.GitRepoReader, target grepTarget, terms []string, all bool, filterParams indexer.FilterParams, deadline time.Time) ([]indexer.Hit, bool, error) {
+	gitRepo, err := reader.GetGitRepo(target.organization, target.project, target.repository)
+	if err != nil {
+		return nil, false, err
+	}
+
+	paths := []string{}
+	if target.indexed {
+		// All files are indexed without the size limit
+		if target.sizeLimit <= 0 {
+			return []indexer.Hit{}, false, nil
+		}
+		paths, err = findOversizedPaths(gitRepo, target, deadline.Sub(time.Now()))
+		if err != nil && !time.Now().Before(deadline) {
+			// stopped by the deadline
+			return []indexer.Hit{}, true, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if len(paths) == 0 {
+			return []indexer.Hit{}, false, nil
+		}
+	}
+
+	timeout := deadline.Sub(time.Now())
+	if timeout <= 0 {
+		return []indexer.Hit{}, true, nil
+	}
+
+	matches, partial, err := gitRepo.Grep(target.commitId, terms, all, paths, LIVE_GREP_OUTPUT_LIMIT, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hits := []indexer.Hit{}
+	for _, m := range matches {
+		if !matchScope(filterParams.Exts, indexer.GetExt(m.Path)) {
+			continue
+		}
+
+		last := len(hits) - 1
+		if last < 0 || hits[last].Path != m.Path {
+			hits = append(hits, indexer.Hit{
+				Metadata: indexer.Metadata{
+					Organization: target.organization,
+					Project:      target.project,
+					Repository:   target.repository,
+					Branches:     target.branches,
+					Tags:         target.tags,
+					Path:         m.Path,
+					Ext:          indexer.GetExt(m.Path),
+				},
+				Keyword:   terms,
+				Preview:   []util.TextPreview{},
+				Unindexed: true,
+			})
+			last++
+		}
+
+		hits[last].Preview = appendGrepPreview(hits[last].Preview, m)
+	}
+
+	return hits, partial, nil
+}
+
+// findOversizedPaths lists the files over the size limit in the commit. They are cached per commit and size limit.
+// It fails if "git ls-tree" doesn't finish in the timeout, and the paths aren't cached then.
+func findOversizedPaths(gitRepo *repo.GitRepo, target grepTarget, timeout time.Duration) ([]string, error) {
+	key := fmt.Sprintf("%s:%s/%s:%s:%d", target.organization, target.project, target.repository, target.commitId, target.sizeLimit)
+	if cached, ok := oversizedPathsCache.Get(key); ok {
+		return cached.([]string), nil
+	}
+
+	if timeout <= 0 {
+		return nil, errors.Errorf("No time to list the files of %s", target.commitId)
+	}
+
+	paths := []string{}
+	err := gitRepo.GetFileEntriesIteratorTimeout(target.commitId, timeout, func(entry repo.FileEntry) {
+		if entry.Size > target.sizeLimit {
+			paths = append(paths, entry.Path)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	oversizedPathsCache.Add(key, paths)
+	return paths, nil
+}
+
+// appendGrepPreview adds the matched line to the previews. The consecutive lines are merged.
+func appendGrepPreview(previews []util.TextPreview, m repo.GrepMatch) []util.TextPreview {
+	last := len(previews) - 1
+	if last >= 0 {
+		p := &previews[last]
+		if p.Hits[len(p.Hits)-1] == m.Line-1 {
+			p.Preview = p.Preview + "\n" + m.Text
+			p.Hits = append(p.Hits, m.Line)
+			return previews
+		}
+	}
+	return append(previews, util.TextPreview{Offset: m.Line, Preview: m.Text, Hits: []int{m.Line}})
+}
+
+type grepTargets []grepTarget
+
+func (g grepTargets) Len() int           { return len(g) }
+func (g grepTargets) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+func (g grepTargets) Less(i, j int) bool { return !g[i].indexed && g[j].indexed }
+
+// Sort by repository, then by path
+type liveGrepHits []indexer.Hit
+
+func (l liveGrepHits) Len() int      { return len(l) }
+func (l liveGrepHits) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l liveGrepHits) Less(i, j int) bool {
+	a := l[i].Organization + ":" + l[i].Project + "/" + l[i].Repository
+	b := l[j].Organization + ":" + l[j].Project + "/" + l[j].Repository
+	if a != b {
+		return a < b
+	}
+	return l[i].Path < l[j].Path
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/wadahiro/gitss/server/indexer"
+	"github.com/wadahiro/gitss/server/repo"
+	"github.com/wadahiro/gitss/server/util"
+)
+
+// DiffPathVersions makes the unified diff of the path between the two versions in the history.
+// Both blobs must be the versions of the history. The result is empty if they are same.
+func DiffPathVersions(reader *repo.GitRepoReader, history indexer.PathHistory, from string, to string) (string, error) {
+	if _, ok := history.FindVersion(from); !ok {
+		return "", errors.Errorf("%s is not a version of %s", from, history.Path)
+	}
+	if _, ok := history.FindVersion(to); !ok {
+		return "", errors.Errorf("%s is not a version of %s", to, history.Path)
+	}
+	if from == to {
+		return "", nil
+	}
+
+	gitRepo, err := reader.GetGitRepo(history.Organization, history.Project, history.Repository)
+	if err != nil {
+		return "", err
+	}
+
+	a, err := gitRepo.GetRawBlobContent(from)
+	if err != nil {
+		return "", err
+	}
+	b, err := gitRepo.GetRawBlobContent(to)
+	if err != nil {
+		return "", err
+	}
+
+	if bytes.IndexByte(a, 0) >= 0 || bytes.IndexByte(b, 0) >= 0 {
+		return fmt.Sprintf("Binary files a/%s and b/%s differ\n", history.Path, history.Path), nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "diff --git a/%s b/%s\nindex %s..%s\n--- a/%s\n+++ b/%s\n", history.Path, history.Path, from, to, history.Path, history.Path)
+	buf.WriteString(util.UnifiedDiff(a, b, PATCH_CONTEXT_LINES))
+
+	return buf.String(), nil
+}
@@ -0,0 +1,268 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/wadahiro/gitss/server/config"
+	"github.com/wadahiro/gitss/server/indexer"
+	"github.com/wadahiro/gitss/server/repo"
+	"github.com/wadahiro/gitss/server/util"
+)
+
+const PATCH_CONTEXT_LINES = 3
+
+// The limits of the replace API
+const REPLACE_TIMEOUT = 30 * time.Second
+const REPLACE_MAX_PATCHES = 100
+const REPLACE_MAX_BYTES = 10 * 1024 * 1024
+const REPLACE_MAX_SEARCH_LENGTH = 1024
+
+// The default limits of the replace command. They can be changed by the options.
+const REPLACE_CLI_MAX_PATCHES = 1000
+const REPLACE_CLI_MAX_BYTES = 100 * 1024 * 1024
+
+// ReplaceRequest is the search-and-replace request.
+// The search is a literal string unless Regex is true. The replacement of the regex can use "$1" style references.
+// FilterParams limits the organizations, projects, repositories, branches, tags and exts.
+type ReplaceRequest struct {
+	Search       string               `json:"search"`
+	Replace      string               `json:"replace"`
+	Regex        bool                 `json:"regex"`
+	FilterParams indexer.FilterParams `json:"filterParams"`
+}
+
+// ReplacePatch is the unified-diff patch for a ref of the repository.
+// The patch can be applied to the CommitId by "git apply".
+type ReplacePatch struct {
+	Organization string `json:"organization"`
+	Project      string `json:"project"`
+	Repository   string `json:"repository"`
+	RefType      string `json:"refType"`
+	Ref          string `json:"ref"`
+	CommitId     string `json:"commitId"`
+	Files        int    `json:"files"`
+	Patch        string `json:"patch"`
+}
+
+// ReplaceLimits stops making the patches when the number or the total bytes of them reaches the limit. Zero is unlimited.
+type ReplaceLimits struct {
+	MaxPatches int
+	MaxBytes   int64
+}
+
+// ReplaceResult is the patches. Partial is true if they were stopped by the limits or the context.
+type ReplaceResult struct {
+	Patches []ReplacePatch `json:"patches"`
+	Partial bool           `json:"partial"`
+	bytes   int64
+}
+
+// RunReplace makes the patches from the indexed refs in the git mirrors without changing anything.
+// The refs without any change are not included in the result.
+// It stops with the partial result when the context is done or the limits are reached.
+func RunReplace(ctx context.Context, config *config.Config, reader *repo.GitRepoReader, request ReplaceRequest, limits ReplaceLimits) (ReplaceResult, error) {
+	result := ReplaceResult{Patches: []ReplacePatch{}}
+
+	if request.Search == "" {
+		return result, errors.New("search is required")
+	}
+
+	pattern, err := compileReplacePattern(request)
+	if err != nil {
+		return result, err
+	}
+
+	filterParams := request.FilterParams
+
+	for _, setting := range config.GetSettings() {
+		organization := setting.GetName()
+		if !matchScope(filterParams.Organizations, organization) {
+			continue
+		}
+
+		for _, projectSetting := range setting.GetProjects() {
+			if !matchScope(filterParams.Projects, projectSetting.Name) {
+				continue
+			}
+
+			for i := range projectSetting.Repositories {
+				repository := projectSetting.Repositories[i].GetName()
+				if !matchScope(filterParams.Repositories, repository) {
+					continue
+				}
+
+				err := replaceRepository(ctx, config, reader, organization, projectSetting.Name, repository, pattern, request, limits, &result)
+				if err != nil {
+					return result, errors.Wrapf(err, "Failed to replace in %s:%s/%s", organization, projectSetting.Name, repository)
+				}
+				if result.Partial {
+					log.Printf("Stopped making patches by the limits. %d patches (%d bytes)\n", len(result.Patches), result.bytes)
+					return result, nil
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// add appends the patch if it's in the limits. Otherwise the result is marked as partial.
+func (r *ReplaceResult) add(patch ReplacePatch, limits ReplaceLimits) bool {
+	if (limits.MaxPatches > 0 && len(r.Patches) >= limits.MaxPatches) ||
+		(limits.MaxBytes > 0 && r.bytes+int64(len(patch.Patch)) > limits.MaxBytes) {
+		r.Partial = true
+		return false
+	}
+	r.Patches = append(r.Patches, patch)
+	r.bytes += int64(len(patch.Patch))
+	return true
+}
+
+func compileReplacePattern(request ReplaceRequest) (*regexp.Regexp, error) {
+	if !request.Regex {
+		return regexp.MustCompile(regexp.QuoteMeta(request.Search)), nil
+	}
+	pattern, err := regexp.Compile(request.Search)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid regex: %s", request.Search)
+	}
+	return pattern, nil
+}
+
+func replaceRepository(ctx context.Context, config *config.Config, reader *repo.GitRepoReader, organization, project, repository string, pattern *regexp.Regexp, request ReplaceRequest, limits ReplaceLimits, result *ReplaceResult) error {
+	gitRepo, err := reader.GetGitRepo(organization, project, repository)
+	if err != nil {
+		return err
+	}
+
+	indexed := config.GetIndexed(organization, project, repository)
+	sizeLimit := config.GetSizeLimit(organization, project, repository)
+
+	// The same blob appears in many refs, so the diff is made once per blob
+	diffs := make(map[string]string)
+
+	patches := 0
+
+	replaceRef := func(refType, ref, commitId string) error {
+		entries, err := gitRepo.GetFileEntries(commitId)
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		files := 0
+
+		for _, entry := range entries {
+			if ctx.Err() != nil {
+				result.Partial = true
+				return nil
+			}
+			if (sizeLimit > 0 && entry.Size > sizeLimit) || !matchScope(request.FilterParams.Exts, indexer.GetExt(entry.Path)) {
+				continue
+			}
+
+			diff, ok := diffs[entry.Blob]
+			if !ok {
+				diff, err = replaceBlob(ctx, gitRepo, entry.Blob, pattern, request)
+				if ctx.Err() != nil {
+					result.Partial = true
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				diffs[entry.Blob] = diff
+			}
+			if diff == "" {
+				continue
+			}
+
+			fmt.Fprintf(&buf, "diff --git a/%s b/%s\n--- a/%s\n+++ b/%s\n", entry.Path, entry.Path, entry.Path, entry.Path)
+			buf.WriteString(diff)
+			files++
+		}
+
+		if files > 0 {
+			added := result.add(ReplacePatch{
+				Organization: organization,
+				Project:      project,
+				Repository:   repository,
+				RefType:      refType,
+				Ref:          ref,
+				CommitId:     commitId,
+				Files:        files,
+				Patch:        buf.String(),
+			}, limits)
+			if added {
+				patches++
+			}
+		}
+		return nil
+	}
+
+	for _, branch := range sortedRefs(indexed.Branches, request.FilterParams.Branches) {
+		if result.Partial {
+			break
+		}
+		if err := replaceRef("branch", branch, indexed.Branches[branch]); err != nil {
+			return err
+		}
+	}
+	for _, tag := range sortedRefs(indexed.Tags, request.FilterParams.Tags) {
+		if result.Partial {
+			break
+		}
+		if err := replaceRef("tag", tag, indexed.Tags[tag]); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Made %d patches for %s:%s/%s\n", patches, organization, project, repository)
+
+	return nil
+}
+
+// replaceBlob returns the diff hunks of the replaced blob. Binary blobs are skipped.
+// The diff stops with the error of the context when it's done.
+func replaceBlob(ctx context.Context, gitRepo *repo.GitRepo, blob string, pattern *regexp.Regexp, request ReplaceRequest) (string, error) {
+	content, err := gitRepo.GetRawBlobContent(blob)
+	if err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(content, 0) >= 0 || !pattern.Match(content) {
+		return "", nil
+	}
+
+	var replaced []byte
+	if request.Regex {
+		replaced = pattern.ReplaceAll(content, []byte(request.Replace))
+	} else {
+		replaced = pattern.ReplaceAllLiteral(content, []byte(request.Replace))
+	}
+
+	return util.UnifiedDiffContext(ctx, content, replaced, PATCH_CONTEXT_LINES)
+}
+
+// matchScope returns true if the scope is empty or contains the value.
+func matchScope(scope []string, value string) bool {
+	return len(scope) == 0 || util.ContainsString(scope, value)
+}
+
+func sortedRefs(refs map[string]string, scope []string) []string {
+	list := []string{}
+	for ref := range refs {
+		if matchScope(scope, ref) {
+			list = append(list, ref)
+		}
+	}
+	sort.Sort(sort.StringSlice(list))
+	return list
+}
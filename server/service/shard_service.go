@@ -0,0 +1,104 @@
+package service
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+	"github.com/wadahiro/gitss/server/config"
+	"github.com/wadahiro/gitss/server/importer"
+	"github.com/wadahiro/gitss/server/indexer"
+	"github.com/wadahiro/gitss/server/util"
+)
+
+// ErrShardNotFound is returned if the organization or the repository of the shard isn't in the settings.
+var ErrShardNotFound = errors.New("Not found the shard")
+
+type shardRepository struct {
+	project    string
+	repository config.RepositorySetting
+}
+
+// DropShard removes the shard and forgets the indexed refs of the repositories in it, so the next syncing indexes them again.
+// In the organization shard mode, all repositories of the organization are in the shard and project and repository are ignored.
+func DropShard(config *config.Config, i indexer.Indexer, organization, project, repository string) error {
+	_, err := dropShard(config, i, organization, project, repository)
+	return err
+}
+
+// RebuildShard drops the shard, then indexes the repositories in it again.
+func RebuildShard(config *config.Config, importer *importer.GitImporter, i indexer.Indexer, organization, project, repository string) error {
+	repositories, err := dropShard(config, i, organization, project, repository)
+	if err != nil {
+		return err
+	}
+
+	workers, stopWorkers := util.GenWorkers(config.GetImport(organization).SyncWorkers)
+	for k := range repositories {
+		r := repositories[k]
+
+		workers <- func() {
+			log.Printf("Rebuild for %s:%s/%s\n", organization, r.project, r.repository.GetName())
+
+			importer.Run(organization, r.project, r.repository.Url)
+		}
+	}
+	stopWorkers()
+
+	return nil
+}
+
+func dropShard(config *config.Config, i indexer.Indexer, organization, project, repository string) ([]shardRepository, error) {
+	config.Sync()
+
+	repositories, err := findShardRepositories(config, organization, project, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	err = i.DropShard(organization, project, repository)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to drop the shard of %s:%s/%s", organization, project, repository)
+	}
+
+	for _, r := range repositories {
+		indexed := config.GetIndexed(organization, r.project, r.repository.GetName())
+
+		err := config.DeleteIndexed(organization, r.project, r.repository.GetName(), keys(indexed.Branches), keys(indexed.Tags))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to update indexed.")
+		}
+	}
+
+	return repositories, nil
+}
+
+func findShardRepositories(c *config.Config, organization, project, repository string) ([]shardRepository, error) {
+	setting, ok := c.FindSetting(organization)
+	if !ok {
+		return nil, errors.Wrapf(ErrShardNotFound, "Not found organization: %s", organization)
+	}
+
+	if c.IndexShard == indexer.SHARD_ORGANIZATION {
+		repositories := []shardRepository{}
+		for _, p := range setting.GetProjects() {
+			for _, r := range p.Repositories {
+				repositories = append(repositories, shardRepository{project: p.Name, repository: r})
+			}
+		}
+		return repositories, nil
+	}
+
+	r, ok := setting.FindRepositorySetting(project, repository)
+	if !ok {
+		return nil, errors.Wrapf(ErrShardNotFound, "Not found repository: %s:%s/%s", organization, project, repository)
+	}
+	return []shardRepository{shardRepository{project: project, repository: *r}}, nil
+}
+
+func keys(m map[string]string) []string {
+	list := []string{}
+	for k := range m {
+		list = append(list, k)
+	}
+	return list
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"sync"
 
+	"github.com/pkg/errors"
 	"github.com/robfig/cron"
 	// "github.com/wadahiro/gitss/server/model"
 	"github.com/wadahiro/gitss/server/config"
@@ -15,6 +16,12 @@ import (
 var mutex = new(sync.Mutex)
 var scheduler *cron.Cron
 
+// ErrBusy is returned if another sync is running in the server.
+var ErrBusy = errors.New("Another sync is running")
+
+// syncSlot runs one sync at a time in the server, so the scheduled job and the sync API don't import the same repository concurrently.
+var syncSlot = make(chan struct{}, 1)
+
 func RunSyncScheduler(config *config.Config, importer *importer.GitImporter) {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -30,6 +37,12 @@ func RunSyncScheduler(config *config.Config, importer *importer.GitImporter) {
 	log.Printf("Setup sync job. spec: %s\n", spec)
 
 	job := func() {
+		if !acquireSyncSlot() {
+			log.Println("Skip sync job. Another sync is running.")
+			return
+		}
+		defer releaseSyncSlot()
+
 		log.Println("Start sync job.")
 		defer log.Println("End Start sync job.")
 
@@ -42,6 +55,18 @@ func RunSyncScheduler(config *config.Config, importer *importer.GitImporter) {
 	fmt.Println("Started sync schduler.")
 }
 
+// StopSyncScheduler stops the scheduled sync job. The running job isn't cancelled.
+func StopSyncScheduler() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if scheduler != nil {
+		log.Println("Stop sync schduler.")
+		scheduler.Stop()
+		scheduler = nil
+	}
+}
+
 func RunSync(config *config.Config, importer *importer.GitImporter, organization, project, repository string) {
 	config.Sync()
 
@@ -68,31 +93,83 @@ func RunSync(config *config.Config, importer *importer.GitImporter, organization
 	importer.Run(setting.GetName(), projectSetting.Name, repositorySetting.Url)
 }
 
+// StartSync syncs the repository in background. It's used by the running server, which keeps the index open.
+func StartSync(config *config.Config, importer *importer.GitImporter, organization, project, repository string) error {
+	return startSync(func() {
+		RunSync(config, importer, organization, project, repository)
+	})
+}
+
+// StartSyncAll syncs all repositories in background. It's used by the running server, which keeps the index open.
+func StartSyncAll(config *config.Config, importer *importer.GitImporter) error {
+	return startSync(func() {
+		RunSyncAll(config, importer)
+	})
+}
+
+func startSync(run func()) error {
+	if !acquireSyncSlot() {
+		return ErrBusy
+	}
+
+	go func() {
+		defer releaseSyncSlot()
+		run()
+	}()
+	return nil
+}
+
+func acquireSyncSlot() bool {
+	select {
+	case syncSlot <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseSyncSlot() {
+	<-syncSlot
+}
+
+// RunSyncAll syncs all repositories. The total number of the repositories synced at the same time is limited
+// by the server import setting, and the number per organization is limited by the organization import setting.
 func RunSyncAll(config *config.Config, importer *importer.GitImporter) {
 	config.Sync()
 
 	settings := config.GetSettings()
 
-	workers := util.GenWorkers(2)
+	slots := make(chan struct{}, config.GetImport("").SyncWorkers)
 	var wg sync.WaitGroup
 
 	for i := range settings {
 		setting := settings[i]
 
-		for _, project := range setting.GetProjects() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			workers, stopWorkers := util.GenWorkers(config.GetImport(setting.GetName()).SyncWorkers)
+			defer stopWorkers()
 
-			for k := range project.Repositories {
-				repository := project.Repositories[k]
+			projects := setting.GetProjects()
+			for j := range projects {
+				project := projects[j]
 
-				log.Printf("Sync for %s:%s/%s\n", setting.GetName(), project.Name, repository.GetName())
+				for k := range project.Repositories {
+					repository := project.Repositories[k]
 
-				wg.Add(1)
-				workers <- func() {
-					defer wg.Done()
-					importer.Run(setting.GetName(), project.Name, repository.Url)
+					workers <- func() {
+						slots <- struct{}{}
+						defer func() { <-slots }()
+
+						log.Printf("Sync for %s:%s/%s\n", setting.GetName(), project.Name, repository.GetName())
+
+						importer.Run(setting.GetName(), project.Name, repository.Url)
+					}
 				}
 			}
-		}
+		}()
 	}
 	wg.Wait()
 }
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"io/ioutil"
+)
+
+// CompressText compresses the text with deflate, and encodes it with base64 to store it as a text field.
+func CompressText(text string) (string, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write([]byte(text)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// DecompressText restores the text compressed by CompressText.
+func DecompressText(compressed string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(compressed)
+	if err != nil {
+		return "", err
+	}
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+
+	text, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompressText(t *testing.T) {
+	texts := []string{
+		"",
+		"package main\n\nfunc main() {\n}\n",
+		strings.Repeat("日本語のテキスト\r\n", 1000),
+	}
+
+	for _, text := range texts {
+		compressed, err := CompressText(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecompressText(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != text {
+			t.Errorf("got %q, want %q", got, text)
+		}
+	}
+
+	compressed, _ := CompressText(texts[2])
+	if len(compressed) >= len(texts[2]) {
+		t.Errorf("got %v bytes, want less than %v bytes", len(compressed), len(texts[2]))
+	}
+
+	if _, err := DecompressText("not base64!"); err == nil {
+		t.Errorf("got nil, want error")
+	}
+}
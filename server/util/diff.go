@@ -0,0 +1,268 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// The edit distance where the search of the shortest edit script stops.
+// The memory of the search grows by the square of the distance, so the changed area is replaced as a whole beyond it.
+const DIFF_MAX_EDITS = 1000
+
+type DiffOp int
+
+const (
+	DIFF_EQUAL DiffOp = iota
+	DIFF_DELETE
+	DIFF_INSERT
+)
+
+type DiffLine struct {
+	Op   DiffOp
+	Text string
+}
+
+// DiffLines computes the shortest edit script between the lines with the Myers algorithm.
+// The common prefix and suffix are skipped first, so the cost depends on the changed area only.
+// If the edit distance is over DIFF_MAX_EDITS, the changed area is deleted and inserted as a whole.
+func DiffLines(a, b []string) []DiffLine {
+	lines, _ := DiffLinesContext(context.Background(), a, b)
+	return lines
+}
+
+// DiffLinesContext is DiffLines which stops with the error of the context when it's done.
+func DiffLinesContext(ctx context.Context, a, b []string) ([]DiffLine, error) {
+	return diffLines(ctx, a, b, DIFF_MAX_EDITS)
+}
+
+func diffLines(ctx context.Context, a, b []string, maxEdits int) ([]DiffLine, error) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	changed, err := myersDiff(ctx, a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], maxEdits)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []DiffLine{}
+	for _, line := range a[:prefix] {
+		result = append(result, DiffLine{Op: DIFF_EQUAL, Text: line})
+	}
+	result = append(result, changed...)
+	for _, line := range a[len(a)-suffix:] {
+		result = append(result, DiffLine{Op: DIFF_EQUAL, Text: line})
+	}
+	return result, nil
+}
+
+func myersDiff(ctx context.Context, a, b []string, maxEdits int) ([]DiffLine, error) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil, nil
+	}
+	if max > maxEdits {
+		max = maxEdits
+	}
+
+	// v[k] is the furthest x on the diagonal k. trace[d] keeps v[-d..d] after the step d.
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	trace := [][]int{}
+
+	for d := 0; d <= max; d++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				trace = append(trace, append([]int{}, v[offset-d:offset+d+1]...))
+				return backtrackDiff(trace, a, b), nil
+			}
+		}
+		trace = append(trace, append([]int{}, v[offset-d:offset+d+1]...))
+	}
+	return replaceAllLines(a, b), nil
+}
+
+// replaceAllLines is the edit script which deletes all lines of a and inserts all lines of b.
+func replaceAllLines(a, b []string) []DiffLine {
+	result := make([]DiffLine, 0, len(a)+len(b))
+	for _, line := range a {
+		result = append(result, DiffLine{Op: DIFF_DELETE, Text: line})
+	}
+	for _, line := range b {
+		result = append(result, DiffLine{Op: DIFF_INSERT, Text: line})
+	}
+	return result
+}
+
+func backtrackDiff(trace [][]int, a, b []string) []DiffLine {
+	reversed := []DiffLine{}
+	x, y := len(a), len(b)
+
+	for d := len(trace) - 1; d > 0; d-- {
+		// the furthest x of the previous step
+		prev := func(k int) int { return trace[d-1][k+d-1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev(k-1) < prev(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, DiffLine{Op: DIFF_EQUAL, Text: a[x]})
+		}
+		if x == prevX {
+			reversed = append(reversed, DiffLine{Op: DIFF_INSERT, Text: b[prevY]})
+		} else {
+			reversed = append(reversed, DiffLine{Op: DIFF_DELETE, Text: a[prevX]})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		reversed = append(reversed, DiffLine{Op: DIFF_EQUAL, Text: a[x]})
+	}
+
+	result := make([]DiffLine, len(reversed))
+	for i := range reversed {
+		result[i] = reversed[len(reversed)-1-i]
+	}
+	return result
+}
+
+// SplitLines splits the content into the lines. Each line keeps its "\n" except the last line without newline.
+func SplitLines(content []byte) []string {
+	lines := []string{}
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n')
+		if i < 0 {
+			lines = append(lines, string(content))
+			break
+		}
+		lines = append(lines, string(content[:i+1]))
+		content = content[i+1:]
+	}
+	return lines
+}
+
+// UnifiedDiff returns the hunks of the unified diff format with the context lines.
+// It returns empty string if there is no difference.
+func UnifiedDiff(a, b []byte, context int) string {
+	return formatUnifiedDiff(DiffLines(SplitLines(a), SplitLines(b)), context)
+}
+
+// UnifiedDiffContext is UnifiedDiff which stops with the error of the context when it's done.
+func UnifiedDiffContext(ctx context.Context, a, b []byte, contextLines int) (string, error) {
+	lines, err := DiffLinesContext(ctx, SplitLines(a), SplitLines(b))
+	if err != nil {
+		return "", err
+	}
+	return formatUnifiedDiff(lines, contextLines), nil
+}
+
+func formatUnifiedDiff(lines []DiffLine, context int) string {
+
+	// line numbers (0-based) in a and b before each diff line
+	aPos := make([]int, len(lines)+1)
+	bPos := make([]int, len(lines)+1)
+	for i, line := range lines {
+		aPos[i+1] = aPos[i]
+		bPos[i+1] = bPos[i]
+		if line.Op != DIFF_INSERT {
+			aPos[i+1]++
+		}
+		if line.Op != DIFF_DELETE {
+			bPos[i+1]++
+		}
+	}
+
+	var buf bytes.Buffer
+
+	i := 0
+	for i < len(lines) {
+		if lines[i].Op == DIFF_EQUAL {
+			i++
+			continue
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		// extend the hunk while the next change is close enough to share the context
+		end := i
+		for j := i; j < len(lines) && j <= end+2*context; j++ {
+			if lines[j].Op != DIFF_EQUAL {
+				end = j
+			}
+		}
+		end += context + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		aCount := aPos[end] - aPos[start]
+		bCount := bPos[end] - bPos[start]
+		aStart := aPos[start] + 1
+		if aCount == 0 {
+			aStart = aPos[start]
+		}
+		bStart := bPos[start] + 1
+		if bCount == 0 {
+			bStart = bPos[start]
+		}
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+
+		for _, line := range lines[start:end] {
+			switch line.Op {
+			case DIFF_EQUAL:
+				buf.WriteString(" ")
+			case DIFF_DELETE:
+				buf.WriteString("-")
+			case DIFF_INSERT:
+				buf.WriteString("+")
+			}
+			buf.WriteString(line.Text)
+			if !strings.HasSuffix(line.Text, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,107 @@
+package util
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	a := []string{"a", "b", "c", "a", "b", "b", "a"}
+	b := []string{"c", "b", "a", "b", "a", "c"}
+
+	lines := DiffLines(a, b)
+
+	// applying the script must restore both sides
+	var actualA, actualB []string
+	changes := 0
+	for _, line := range lines {
+		if line.Op != DIFF_INSERT {
+			actualA = append(actualA, line.Text)
+		}
+		if line.Op != DIFF_DELETE {
+			actualB = append(actualB, line.Text)
+		}
+		if line.Op != DIFF_EQUAL {
+			changes++
+		}
+	}
+	if len(actualA) != len(a) || len(actualB) != len(b) {
+		t.Errorf("Unexpected diff %v", lines)
+	}
+	for i := range a {
+		if actualA[i] != a[i] {
+			t.Errorf("got %v, want %v", actualA, a)
+			break
+		}
+	}
+	for i := range b {
+		if actualB[i] != b[i] {
+			t.Errorf("got %v, want %v", actualB, b)
+			break
+		}
+	}
+	// the shortest edit script of this example has 5 edits
+	if changes != 5 {
+		t.Errorf("got %v, want 5", changes)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n")
+	b := []byte("1\n2\n3\nfour\n5\n6\n7\n8\n9\n10\n")
+
+	expected := "@@ -1,7 +1,7 @@\n 1\n 2\n 3\n-4\n+four\n 5\n 6\n 7\n"
+	if actual := UnifiedDiff(a, b, 3); actual != expected {
+		t.Errorf("got %q, want %q", actual, expected)
+	}
+
+	if actual := UnifiedDiff(a, a, 3); actual != "" {
+		t.Errorf("got %q, want empty", actual)
+	}
+}
+
+func TestUnifiedDiffNoNewline(t *testing.T) {
+	a := []byte("foo\nbar")
+	b := []byte("foo\nbaz")
+
+	expected := "@@ -1,2 +1,2 @@\n foo\n-bar\n\\ No newline at end of file\n+baz\n\\ No newline at end of file\n"
+	if actual := UnifiedDiff(a, b, 3); actual != expected {
+		t.Errorf("got %q, want %q", actual, expected)
+	}
+}
+
+func TestDiffLinesMaxEdits(t *testing.T) {
+	a := []string{"same", "a1", "a2", "a3", "same"}
+	b := []string{"same", "b1", "b2", "b3", "same"}
+
+	lines, err := diffLines(context.Background(), a, b, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// over the max edits, the changed area is replaced as a whole
+	expected := []DiffLine{
+		{DIFF_EQUAL, "same"},
+		{DIFF_DELETE, "a1"}, {DIFF_DELETE, "a2"}, {DIFF_DELETE, "a3"},
+		{DIFF_INSERT, "b1"}, {DIFF_INSERT, "b2"}, {DIFF_INSERT, "b3"},
+		{DIFF_EQUAL, "same"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("got %v, want %v", lines, expected)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("got %v, want %v", lines, expected)
+			break
+		}
+	}
+}
+
+func TestDiffLinesContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := DiffLinesContext(ctx, []string{"a"}, []string{"b"}); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip, deflate", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"identity", ""},
+		{"GZIP", "gzip"},
+	}
+
+	for _, test := range tests {
+		got := NegotiateEncoding(test.acceptEncoding, "br", "gzip")
+		if got != test.want {
+			t.Errorf("got %v, want %v for %q", got, test.want, test.acceptEncoding)
+		}
+	}
+}
+
+func TestMatchETag(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`"xyz"`, false},
+		{"*", true},
+	}
+
+	for _, test := range tests {
+		got := MatchETag(test.ifNoneMatch, `W/"abc"`)
+		if got != test.want {
+			t.Errorf("got %v, want %v for %q", got, test.want, test.ifNoneMatch)
+		}
+	}
+}
+
+func TestNotModifiedSince(t *testing.T) {
+	lastModified := time.Date(2017, 1, 2, 3, 4, 5, 600, time.UTC)
+
+	if !NotModifiedSince(lastModified.Format(http.TimeFormat), lastModified) {
+		t.Errorf("got modified, want not modified for the same second")
+	}
+	if NotModifiedSince(lastModified.Add(-time.Second).Format(http.TimeFormat), lastModified) {
+		t.Errorf("got not modified, want modified")
+	}
+	if NotModifiedSince("", lastModified) {
+		t.Errorf("got not modified, want modified without the header")
+	}
+	if NotModifiedSince("broken", lastModified) {
+		t.Errorf("got not modified, want modified for the broken header")
+	}
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRUCache is a goroutine safe LRU cache.
+// The entries older than ttl are treated as missing. Zero ttl means no expiration.
+type LRUCache struct {
+	mutex    sync.Mutex
+	capacity int
+	ttl      time.Duration
+	list     *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	created time.Time
+}
+
+func NewLRUCache(capacity int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		capacity: capacity,
+		ttl:      ttl,
+		list:     list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *LRUCache) Get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*lruEntry)
+	if c.ttl > 0 && time.Since(entry.created) > c.ttl {
+		c.list.Remove(e)
+		delete(c.items, key)
+		return nil, false
+	}
+
+	c.list.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *LRUCache) Add(key string, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		e.Value = &lruEntry{key: key, value: value, created: time.Now()}
+		c.list.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.list.PushFront(&lruEntry{key: key, value: value, created: time.Now()})
+
+	for c.list.Len() > c.capacity {
+		oldest := c.list.Back()
+		c.list.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *LRUCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.list.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+func (c *LRUCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.list.Len()
+}
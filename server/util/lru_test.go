@@ -0,0 +1,46 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := NewLRUCache(2, 0)
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+
+	// "a" becomes the most recently used
+	if v, ok := c.Get("a"); !ok || v.(int) != 1 {
+		t.Errorf("got %v, want 1", v)
+	}
+
+	c.Add("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("b should be evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("a should be cached")
+	}
+	if c.Len() != 2 {
+		t.Errorf("got %v, want 2", c.Len())
+	}
+
+	c.Purge()
+	if c.Len() != 0 {
+		t.Errorf("got %v, want 0", c.Len())
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	c := NewLRUCache(2, time.Millisecond)
+
+	c.Add("a", 1)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("a should be expired")
+	}
+}
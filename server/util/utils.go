@@ -1,11 +1,14 @@
 package util
 
 import (
-	// "fmt"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"io"
 	// "log"
 	// "fmt"
 	"strings"
+	"sync"
 )
 
 type TextPreview struct {
@@ -94,16 +97,28 @@ func Must(e error) {
 	}
 }
 
-func GenWorkers(num int) chan<- func() {
+// GenWorkers starts the num goroutines running the tasks sent to the returned channel.
+// Call the returned stop function after sending all tasks. It closes the channel and waits for the goroutines to exit.
+func GenWorkers(num int) (chan<- func(), func()) {
+	if num < 1 {
+		num = 1
+	}
 	tasks := make(chan func())
+	var wg sync.WaitGroup
 	for i := 0; i < num; i++ {
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			for f := range tasks {
 				f()
 			}
 		}()
 	}
-	return tasks
+	stop := func() {
+		close(tasks)
+		wg.Wait()
+	}
+	return tasks, stop
 }
 
 func DifferenceStrings(strs []string, excludes []string) []string {
@@ -123,6 +138,38 @@ func DifferenceStrings(strs []string, excludes []string) []string {
 	return newStrs
 }
 
+// LevenshteinDistance returns the edit distance between a and b counted in runes.
+func LevenshteinDistance(a, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, minInt(curr[j-1]+1, prev[j-1]+cost))
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func ContainsString(array []string, obj string) bool {
 	for _, o := range array {
 		if o == obj {
@@ -131,3 +178,11 @@ func ContainsString(array []string, obj string) bool {
 	}
 	return false
 }
+
+// GitBlobHash returns the SHA-1 of the content in the same way as "git hash-object".
+func GitBlobHash(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
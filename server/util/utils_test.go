@@ -5,6 +5,9 @@ import (
 	"strings"
 	"testing"
 	"reflect"
+	"runtime"
+	"sync/atomic"
+	"time"
 )
 
 func TestFilterPreviewText(t *testing.T) {
@@ -99,3 +102,57 @@ func TestDifferenceStrings(t *testing.T) {
 		t.Errorf("Not \"a\", %s\n", result[0])
 	}
 }
+
+func TestLevenshteinDistance(t *testing.T) {
+	cases := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"kitten", "sitting", 3},
+		{"getusername", "getusrname", 1},
+		{"検索", "検査", 1},
+	}
+	for _, c := range cases {
+		actual := LevenshteinDistance(c.a, c.b)
+		if actual != c.expected {
+			t.Errorf("LevenshteinDistance(%q, %q) got %v, want %v", c.a, c.b, actual, c.expected)
+		}
+	}
+}
+
+func TestGitBlobHash(t *testing.T) {
+	if actual := GitBlobHash([]byte("hello\n")); actual != "ce013625030ba8dba906f756967f9e9ca394464a" {
+		t.Errorf("got %v, want ce013625030ba8dba906f756967f9e9ca394464a", actual)
+	}
+	if actual := GitBlobHash([]byte{}); actual != "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391" {
+		t.Errorf("got %v, want e69de29bb2d1d6434b8b29ae775ad8c2e48c5391", actual)
+	}
+}
+
+func TestGenWorkers(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	workers, stop := GenWorkers(3)
+	var done int32
+	for i := 0; i < 10; i++ {
+		workers <- func() {
+			atomic.AddInt32(&done, 1)
+		}
+	}
+	stop()
+
+	if atomic.LoadInt32(&done) != 10 {
+		t.Errorf("got %v, want %v", done, 10)
+	}
+
+	// The goroutines exit shortly after wg.Done()
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runtime.NumGoroutine() > before {
+		t.Errorf("got %v goroutines, want %v", runtime.NumGoroutine(), before)
+	}
+}